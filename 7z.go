@@ -15,12 +15,26 @@ import (
 )
 
 type SevenZip struct {
-	// If true, errors that occurred while reading or writing a file in the archive
-	// will be logged and the operation will continue for the remaining files.
+	// What happens when reading or writing a file in the archive fails; see ErrorMode.
+	ErrorMode ErrorMode
+
+	// If true and ErrorMode is FailFast, the errors are handled as with ContinueCollect.
+	// Kept for compatibility; SetContinueOnError sets it.
 	ContinueOnError bool
 
+	// If set, it is called with the path of a directory when extraction starts skipping it,
+	// because handleFile returned fs.SkipDir, and again for every entry left out because of it.
+	OnSkip func(dir string)
+
 	// The password, if dealing with an encrypted archive.
 	Password string
+
+	// If true, archives preceded by an executable stub (self-extracting archives)
+	// are matched and extracted. The signature is searched for in the first sfxSearchLimit bytes.
+	AllowSFX bool
+
+	// If set, the reader of each regular entry is wrapped with this function when extracting.
+	ContentTransform func(name string, r io.Reader) (io.Reader, error)
 }
 
 var sevenZipHeader = []byte("7z\xBC\xAF\x27\x1C")
@@ -29,6 +43,13 @@ func init() {
 	RegisterFormat(SevenZip{})
 }
 
+func (z *SevenZip) SetContinueOnError(v bool) {
+	z.ContinueOnError = v
+	if !v {
+		z.ErrorMode = FailFast
+	}
+}
+
 func (z SevenZip) Name() string {
 	return ".7z"
 }
@@ -49,6 +70,15 @@ func (z SevenZip) Match(filename string, stream io.Reader) (MatchResult, error)
 
 	mr.ByStream = bytes.Equal(buf, sevenZipHeader)
 
+	// self-extracting archives have the signature after the executable stub
+	if !mr.ByStream && z.AllowSFX {
+		rest, err := readAtMost(stream, sfxSearchLimit-len(buf))
+		if err != nil {
+			return mr, err
+		}
+		mr.ByStream = bytes.Contains(append(buf, rest...), sevenZipHeader)
+	}
+
 	return mr, nil
 }
 
@@ -64,42 +94,29 @@ func (z SevenZip) Archive(_ context.Context, _ io.Writer, _ []File) error {
 // This signature is chosen for the interface because you can Read() from anything you can Read() or Seek().
 // Because of the nature of the zip archive format, if sourceArchive is not io.Seeker and io.ReaderAt, an error is returned.
 func (z SevenZip) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error {
-	sra, ok := sourceArchive.(seekReaderAt)
-	if !ok {
-		return fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
-	}
-
-	size, err := streamSizeBySeeking(sra)
-	if err != nil {
-		return fmt.Errorf("determining stream size: %w", err)
-	}
-
-	zr, err := sevenzip.NewReaderWithPassword(sra, size, z.Password)
+	zr, err := z.openArchive(sourceArchive)
 	if err != nil {
 		return err
 	}
 
-	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	included := newPathSet(pathsInArchive)
 
+	mode := errorMode(z.ErrorMode, z.ContinueOnError)
+	var errs MultiError
 	for i, f := range zr.File {
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
 		}
 
-		if !fileIsIncluded(pathsInArchive, f.Name) {
+		if !included.includes(f.Name) {
 			continue
 		}
-		if fileIsIncluded(skipDirs, f.Name) {
+		if skipDirs.skipped(f.Name, z.OnSkip) {
 			continue
 		}
 
-		file := File{
-			FileInfo: f.FileInfo(),
-			Header:   f.FileHeader,
-			FileName: f.Name,
-			Open:     func() (io.ReadCloser, error) { return f.Open() },
-		}
+		file := z.entryFile(ctx, f)
 
 		err := handleFile(ctx, file)
 		if errors.Is(err, fs.SkipDir) {
@@ -109,14 +126,90 @@ func (z SevenZip) Extract(ctx context.Context, sourceArchive io.Reader, pathsInA
 				dirPath = path.Dir(f.Name) + "/"
 			}
 			skipDirs.add(dirPath)
+			if z.OnSkip != nil {
+				z.OnSkip(dirPath)
+			}
+		} else if errors.Is(err, ErrStopWalk) {
+			break
 		} else if err != nil {
-			if z.ContinueOnError {
-				golog.Info("[ERROR] %s: %v", f.Name, err)
+			err = fmt.Errorf("handling file %d: %s: %w", i, f.Name, err)
+			if mode.continues() {
+				golog.Info("[ERROR] %v", err)
+				errs.add(err)
 				continue
 			}
-			return fmt.Errorf("handling file %d: %s: %w", i, f.Name, err)
+			return err
+		}
+	}
+
+	return mode.result(&errs)
+}
+
+// ExtractParallel is like Extract, but handles the files from the given number of goroutines,
+// or GOMAXPROCS goroutines if workers is not positive, which decompress the entries concurrently.
+// handleFile must therefore be safe for concurrent use; see SerializeHandler otherwise.
+// Since files are handled out of order, returning fs.SkipDir from handleFile has no effect.
+// Note that entries in the same solid block are decompressed from the start of the block each.
+func (z SevenZip) ExtractParallel(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler, workers int) error {
+	zr, err := z.openArchive(sourceArchive)
+	if err != nil {
+		return err
+	}
+
+	included := newPathSet(pathsInArchive)
+	files := make([]File, 0, len(zr.File))
+	for _, f := range zr.File {
+		if included.includes(f.Name) {
+			files = append(files, z.entryFile(ctx, f))
+		}
+	}
+
+	return handleFilesParallel(ctx, files, workers, handleFile, nil, errorMode(z.ErrorMode, z.ContinueOnError))
+}
+
+// openArchive returns a sevenzip.Reader for sourceArchive, which must be io.ReaderAt and io.Seeker.
+func (z SevenZip) openArchive(sourceArchive io.Reader) (*sevenzip.Reader, error) {
+	sra, ok := sourceArchive.(seekReaderAt)
+	if !ok {
+		return nil, fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
+	}
+
+	size, err := streamSizeBySeeking(sra)
+	if err != nil {
+		return nil, fmt.Errorf("determining stream size: %w", err)
+	}
+
+	var ra io.ReaderAt = sra
+	if z.AllowSFX {
+		// skip the executable stub, 7z offsets are relative to the signature header
+		sr, err := sfxSection(sra, size, sevenZipHeader)
+		if err != nil {
+			return nil, err
 		}
+		ra, size = sr, sr.Size()
+	}
+
+	return sevenzip.NewReaderWithPassword(ra, size, z.Password)
+}
+
+// entryFile returns the File to pass to the handler for the 7z entry f.
+// Reading it fails once ctx is done.
+func (z SevenZip) entryFile(ctx context.Context, f *sevenzip.File) File {
+	file := File{
+		FileInfo: f.FileInfo(),
+		Header:   f.FileHeader,
+		FileName: f.Name,
+		Open: func() (io.ReadCloser, error) {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			return contextReader{ctx, rc}, nil
+		},
+	}
+	if z.ContentTransform != nil && file.Mode().IsRegular() {
+		file = transformedFile(file, z.ContentTransform)
 	}
 
-	return nil
+	return file
 }
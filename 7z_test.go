@@ -0,0 +1,75 @@
+package compressor
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"io"
+	"sync"
+	"testing"
+)
+
+//go:embed test/test.7z
+var test7Z []byte
+
+func TestSevenZipSFX(t *testing.T) {
+	junk := bytes.Repeat([]byte("MZ stub "), 512)
+	sfx := append(junk, test7Z...)
+
+	z := SevenZip{AllowSFX: true}
+	mr, err := z.Match("", bytes.NewReader(sfx))
+	checkErr(t, err, "matching with AllowSFX")
+	if !mr.ByStream {
+		t.Fatalf("expected stream match with AllowSFX")
+	}
+
+	contents := make(map[string]string)
+	err = z.Extract(context.Background(), bytes.NewReader(sfx), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		contents[f.FileName] = string(b)
+		return nil
+	})
+	checkErr(t, err, "extracting sfx 7z")
+	if contents["foo"] != "foo\n" || contents["bar"] != "bar\n" {
+		t.Fatalf("unexpected contents: %v", contents)
+	}
+
+	err = SevenZip{}.Extract(context.Background(), bytes.NewReader(sfx), nil, func(context.Context, File) error { return nil })
+	if err == nil {
+		t.Fatalf("expected error extracting sfx 7z without AllowSFX")
+	}
+}
+
+func TestSevenZipExtractParallel(t *testing.T) {
+	var mu sync.Mutex
+	contents := make(map[string]string)
+	err := SevenZip{}.ExtractParallel(context.Background(), bytes.NewReader(test7Z), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		contents[f.FileName] = string(b)
+		mu.Unlock()
+		return nil
+	}, 2)
+	checkErr(t, err, "extracting 7z in parallel")
+	if contents["foo"] != "foo\n" || contents["bar"] != "bar\n" {
+		t.Fatalf("unexpected contents: %v", contents)
+	}
+}
@@ -1,15 +1,25 @@
 package compressor
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pchchv/golog"
 )
 
 // File abstraction for interacting with archives.
@@ -26,12 +36,106 @@ type File struct {
 	// Not all archive formats are supported.
 	LinkTarget string
 
+	// Extended attributes of the file, by name (e.g. "user.comment").
+	// Only archive formats that support them use them, see Tar.PreserveXattrs and Zip.MergeAppleDouble.
+	Xattrs map[string]string
+
 	// A callback function that opens a file to read its contents.
 	// The file must be closed when the reading is finished.
 	// Not used for files that have no content (directories and links).
 	Open func() (io.ReadCloser, error)
 }
 
+// OverwritePolicy determines what happens when a file to be extracted to disk already exists.
+type OverwritePolicy int
+
+const (
+	// OverwriteError fails the extraction; this is the default.
+	OverwriteError OverwritePolicy = iota
+	// OverwriteAlways replaces the existing file.
+	OverwriteAlways
+	// OverwriteSkip keeps the existing file and does not extract the new one.
+	OverwriteSkip
+	// OverwriteRenameWithSuffix extracts the new file with " (1)", " (2)", etc. inserted before its extension.
+	OverwriteRenameWithSuffix
+)
+
+// CaseCollisionPolicy determines what happens when ExtractToDisk extracts files whose names differ only in case,
+// like File.txt and file.txt, which are the same file on case-insensitive file systems, e.g. those of macOS and Windows.
+type CaseCollisionPolicy int
+
+const (
+	// CaseCollisionIgnore does not look for such files; this is the default.
+	// On case-insensitive file systems, the later file is handled by the OverwritePolicy.
+	CaseCollisionIgnore CaseCollisionPolicy = iota
+	// CaseCollisionError fails the extraction.
+	CaseCollisionError
+	// CaseCollisionRename extracts the later file with " (1)", " (2)", etc. inserted before its extension.
+	CaseCollisionRename
+	// CaseCollisionOverwrite removes the earlier file, so that only the later one is left.
+	CaseCollisionOverwrite
+)
+
+// ToDiskOptions specifies options for extracting files to the disk.
+type ToDiskOptions struct {
+	// What to do when a file to be extracted already exists.
+	// Directories are never considered to collide with existing ones.
+	Overwrite OverwritePolicy
+
+	// What to do with files whose names differ only in case from those of files extracted before,
+	// so that extraction behaves the same on case-sensitive and case-insensitive file systems.
+	CaseInsensitiveCollisionPolicy CaseCollisionPolicy
+
+	// Number of leading path elements to remove from the names of the files,
+	// like tar --strip-components. Files with no more elements left are skipped.
+	// The targets of hard links are stripped likewise; those of symbolic links are relative and left as they are.
+	StripComponents int
+
+	// If greater than 0, extraction fails with ErrDecompressionLimit once the contents
+	// of the extracted files add up to more than this many bytes, which guards against decompression bombs.
+	MaxDecompressedBytes int64
+
+	// If greater than 0, extraction fails with ErrDecompressionLimit at the entry after this many entries.
+	MaxEntries int
+
+	// If greater than 0, extraction fails with ErrDecompressionLimit once more bytes are read from an entry
+	// than this many times its compressed size. It only applies to formats that tell the compressed size
+	// of each entry, which are zip archives.
+	MaxRatio float64
+}
+
+// ErrDecompressionLimit is returned when extracting exceeds one of the limits of ToDiskOptions.
+var ErrDecompressionLimit = errors.New("decompression limit exceeded")
+
+// ErrLimitExceeded is returned by File.ReadAll when the contents of the file are larger than allowed.
+var ErrLimitExceeded = errors.New("size limit exceeded")
+
+// ErrStopWalk can be returned by a FileHandler to stop extracting without an error,
+// for example once it found the file it was looking for.
+var ErrStopWalk = errors.New("stop walk")
+
+// extractLimits tracks the limits of ToDiskOptions during an extraction.
+type extractLimits struct {
+	opts    ToDiskOptions
+	entries int
+	bytes   int64
+}
+
+// caseCollisions keeps the targets of the files extracted by ExtractToDisk by their names in lower case,
+// to apply the CaseInsensitiveCollisionPolicy.
+type caseCollisions struct {
+	policy  CaseCollisionPolicy
+	targets map[string]string
+}
+
+// limitedReader reads the contents of an entry, failing once the limits are exceeded.
+type limitedReader struct {
+	io.ReadCloser
+	limits  *extractLimits
+	read    int64
+	maxRead int64 // the limit of the entry by its compression ratio, or 0
+}
+
 // FromDiskOptions specifies options for gathering files from the disk.
 type FromDiskOptions struct {
 	// If true, symbolic links will be dereferenced,
@@ -42,6 +146,19 @@ type FromDiskOptions struct {
 	// If true, some attributes of the file will not be saved.
 	// The name, size, type and permissions will be saved.
 	ClearAttributes bool
+
+	// If set, it is called with errors accessing files, such as permission errors,
+	// instead of failing. If it returns nil, the file (or directory with its contents) is skipped;
+	// otherwise gathering fails with the returned error.
+	OnError func(path string, err error) error
+}
+
+// memFileInfo describes a file that is not on disk, such as one created by FileFromReader.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
 }
 
 // noAttrFileInfo is used to zero some file attributes.
@@ -49,18 +166,121 @@ type noAttrFileInfo struct {
 	fs.FileInfo
 }
 
+// sizedFileInfo overrides the size of the file, e.g. after its contents were transformed.
+type sizedFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+// renamedFileInfo overrides the name of the file, e.g. the name of a compressed file without its extension.
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+// sentinelFileInfo describes the empty file written in place of an empty directory.
+type sentinelFileInfo struct {
+	fs.FileInfo // of the directory
+	name        string
+}
+
+// pathSet is the set of paths passed to Extract, made once per call, which tells whether a file is included
+// in time proportional to the length of its name instead of the number of paths. A nil *pathSet includes all files.
+type pathSet struct {
+	exact map[string]struct{} // the paths as they are
+	dirs  map[string]struct{} // the paths without a trailing slash, whose contents are included
+}
+
 // skipList keeps a list of non-intersecting paths as long as its add method is used.
 // Identical items are rejected, more specific paths are replaced with broader ones,
 // and more specific paths won't be added when a broader one already exists in the list.
 // Slashes are ignored.
 type skipList []string
 
+// entryReader reads the file opened by OpenEntry, or holds the error opening it.
+type entryReader struct {
+	io.ReadCloser
+	closed chan<- struct{} // closed when the file is closed, to stop extracting
+	done   <-chan struct{} // closed when extracting has stopped
+	err    error
+}
+
+// progress keeps count of the bytes processed for the Progress callback of a format.
+// A nil *progress reports nothing. It is safe for concurrent use, and reports one at a time.
+type progress struct {
+	mu        sync.Mutex
+	report    func(file File, bytesProcessed, totalBytes int64)
+	processed int64
+	total     int64
+}
+
+// contextReader fails reads once its context is done,
+// so that reading a large file can be interrupted.
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+// copyChunkSize is the most copyContext copies between checks of the context.
+const copyChunkSize = 32 << 10
+
+// copyBufPool holds the buffers of copyContext.
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyChunkSize)
+		return &buf
+	},
+}
+
+// chunkedContextReader reads at most copyChunkSize bytes at a time, failing once its context is done.
+type chunkedContextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// progressWriter reports the bytes written for a file.
+type progressWriter struct {
+	io.Writer
+	p    *progress
+	file File
+}
+
+// progressReader reports the bytes read from a file.
+type progressReader struct {
+	io.Reader
+	p    *progress
+	file File
+}
+
+// ErrorMode determines what happens when reading or writing a file in an archive fails.
+// Context errors always abort the operation.
+type ErrorMode int
+
+const (
+	// FailFast aborts the operation with the error; this is the default.
+	FailFast ErrorMode = iota
+	// ContinueSilent logs the error and continues with the remaining files.
+	// The operation does not fail because of such errors.
+	ContinueSilent
+	// ContinueCollect logs the error and continues with the remaining files.
+	// The errors are then returned together as a *MultiError.
+	ContinueCollect
+)
+
+// MultiError holds the errors of the files that failed with ContinueCollect (or ContinueOnError).
+// It is returned once the remaining files were processed, so that the caller can tell which files failed,
+// e.g. by errors.As; callers that only want the failures logged can ignore it.
+type MultiError struct {
+	Errors []error
+}
+
 // FileHandler is a callback function that is used to handle files when reading them from an archive.
 // It is similar to fs.WalkDirFunc. Handler functions that open files must not overlap or execute at the same time,
 // since files can be read from the same sequential thread. Always close the file before returning it.
 // If a special error value of fs.SkipDir is returned, the file directory (or the file itself,
 // if it is a directory) will not be passed. Note that since the contents of an archive are not necessarily ordered,
 // skipping directories requires memory, and skipping a large number of directories can lead to memory overruns.
+// If ErrStopWalk is returned, no more files will be passed and the pass ends as if all files were.
 // Any other error returned will abort the pass.
 type FileHandler func(ctx context.Context, f File) error
 
@@ -68,6 +288,32 @@ func (f File) Stat() (fs.FileInfo, error) {
 	return f.FileInfo, nil
 }
 
+// ReadAll opens the file, reads its contents and closes it.
+// If the contents are larger than maxBytes, it fails with ErrLimitExceeded without reading further,
+// so that handlers can read files from untrusted archives into memory safely.
+func (f File) ReadAll(maxBytes int64) ([]byte, error) {
+	if f.Open == nil {
+		return nil, fmt.Errorf("%s: file cannot be opened", f.FileName)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// read one more byte than allowed to tell whether there is more
+	data, err := io.ReadAll(io.LimitReader(rc, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%s: %w: more than %d bytes", f.FileName, ErrLimitExceeded, maxBytes)
+	}
+
+	return data, nil
+}
+
 // Mode preserves only the type and permission bits.
 func (no noAttrFileInfo) Mode() fs.FileMode {
 	return no.FileInfo.Mode() & (fs.ModeType | fs.ModePerm)
@@ -81,6 +327,153 @@ func (noAttrFileInfo) Sys() interface{} {
 	return nil
 }
 
+func (info sizedFileInfo) Size() int64 {
+	return info.size
+}
+
+func (info renamedFileInfo) Name() string {
+	return info.name
+}
+
+func (info sentinelFileInfo) Name() string {
+	return info.name
+}
+
+func (sentinelFileInfo) Size() int64 {
+	return 0
+}
+
+func (info sentinelFileInfo) Mode() fs.FileMode {
+	return info.FileInfo.Mode().Perm() &^ 0111
+}
+
+func (sentinelFileInfo) IsDir() bool {
+	return false
+}
+
+// newProgress returns a progress reporting to report, or nil if report is nil.
+// A negative total means that the total number of bytes is unknown.
+func newProgress(report func(file File, bytesProcessed, totalBytes int64), total int64) *progress {
+	if report == nil {
+		return nil
+	}
+
+	return &progress{report: report, total: total}
+}
+
+func (p *progress) add(file File, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed += int64(n)
+	p.report(file, p.processed, p.total)
+}
+
+// writer wraps w to report the bytes written for file.
+func (p *progress) writer(w io.Writer, file File) io.Writer {
+	if p == nil {
+		return w
+	}
+
+	return progressWriter{w, p, file}
+}
+
+// file returns a copy of file that reports the bytes read from it.
+func (p *progress) file(file File) File {
+	if p == nil {
+		return file
+	}
+
+	return transformedFile(file, func(_ string, r io.Reader) (io.Reader, error) {
+		return progressReader{r, p, file}, nil
+	})
+}
+
+func (cr chunkedContextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > copyChunkSize {
+		p = p[:copyChunkSize]
+	}
+
+	return cr.r.Read(p)
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.ReadCloser.Read(p)
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.Writer.Write(b)
+	pw.p.add(pw.file, n)
+	return n, err
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.Reader.Read(b)
+	pr.p.add(pr.file, n)
+	return n, err
+}
+
+func (me *MultiError) Error() string {
+	if len(me.Errors) == 1 {
+		return me.Errors[0].Error()
+	}
+
+	msgs := make([]string, len(me.Errors))
+	for i, err := range me.Errors {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d errors occurred: %s", len(me.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors, so that errors.Is and errors.As consider each of them.
+func (me *MultiError) Unwrap() []error {
+	return me.Errors
+}
+
+// add records the error of a file.
+func (me *MultiError) add(err error) {
+	me.Errors = append(me.Errors, err)
+}
+
+// err returns me if any errors were recorded, or nil otherwise.
+func (me *MultiError) err() error {
+	if len(me.Errors) == 0 {
+		return nil
+	}
+
+	return me
+}
+
+// errorMode returns mode, or ContinueCollect if it is FailFast but the older ContinueOnError field is set.
+func errorMode(mode ErrorMode, continueOnError bool) ErrorMode {
+	if mode == FailFast && continueOnError {
+		return ContinueCollect
+	}
+
+	return mode
+}
+
+// continues reports whether the operation continues with the remaining files after an error.
+func (mode ErrorMode) continues() bool {
+	return mode == ContinueSilent || mode == ContinueCollect
+}
+
+// result returns the error of an operation that continued past the errors in errs.
+func (mode ErrorMode) result(errs *MultiError) error {
+	if mode == ContinueSilent {
+		return nil
+	}
+
+	return errs.err()
+}
+
 func (s *skipList) add(dir string) {
 	var dontAdd bool
 	trimmedDir := strings.TrimSuffix(dir, "/")
@@ -109,6 +502,608 @@ func (s *skipList) add(dir string) {
 	}
 }
 
+// skipped reports whether the file name is in one of the directories of s,
+// calling onSkip, if not nil, with that directory.
+func (s skipList) skipped(name string, onSkip func(dir string)) bool {
+	for _, dir := range s {
+		if name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/") {
+			if onSkip != nil {
+				onSkip(dir)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// SerializeHandler returns a FileHandler that calls h for one file at a time,
+// even when the returned handler is called concurrently, e.g. by parallel extraction workers.
+// This lets handlers that are not safe for concurrent use be used with such extractors.
+func SerializeHandler(h FileHandler) FileHandler {
+	var mu sync.Mutex
+	return func(ctx context.Context, f File) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return h(ctx, f)
+	}
+}
+
+// handleFilesParallel calls handleFile for each of files from the given number of goroutines,
+// or GOMAXPROCS goroutines if workers is not positive, followed by after with the index of the file
+// if it is not nil and handleFile succeeded. It stops at the first error,
+// unless mode continues, in which case errors are logged and handled according to mode at the end.
+// Returning fs.SkipDir from handleFile has no effect, since other files may already be handled,
+// and returning ErrStopWalk stops once the files that are being handled are done.
+func handleFilesParallel(ctx context.Context, files []File, workers int, handleFile FileHandler, after func(ctx context.Context, i int) error, mode ErrorMode) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		errsMu   sync.Mutex
+		errs     MultiError
+	)
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// jobs received after stopping are left alone
+				if workCtx.Err() != nil {
+					continue
+				}
+				file := files[i]
+				err := handleFile(workCtx, file)
+				if err == nil && after != nil {
+					err = after(workCtx, i)
+				}
+				if err == nil || errors.Is(err, fs.SkipDir) {
+					continue
+				}
+				if errors.Is(err, ErrStopWalk) {
+					errOnce.Do(cancel)
+					continue
+				}
+				err = fmt.Errorf("handling file %d: %s: %w", i, file.FileName, err)
+				if mode.continues() && workCtx.Err() == nil { // context errors should always abort
+					golog.Info("[ERROR] %v", err)
+					errsMu.Lock()
+					errs.add(err)
+					errsMu.Unlock()
+					continue
+				}
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+
+feed:
+	for i := range files {
+		// select picks at random when both are ready, so the cancellation is checked first
+		if workCtx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-workCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err // honor context cancellation
+	}
+
+	return mode.result(&errs)
+}
+
+// ListEntries returns the files in src, limited to paths if not nil, without reading their contents.
+// Since extraction is over once it returns, the Open functions of the returned files
+// cannot be relied upon, especially for streaming formats like tar.
+func ListEntries(ctx context.Context, ex Extractor, src io.Reader, paths []string) ([]File, error) {
+	var files []File
+	err := ex.Extract(ctx, src, paths, func(ctx context.Context, f File) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// TotalSize returns the total uncompressed size of the files in src, limited to paths if not nil,
+// and the number of entries, including directories, without reading their contents; e.g. to show progress
+// or to check for free space before extracting. The sizes are taken from the headers of the entries,
+// which is cheap for zip and 7z archives, which keep them in a central directory.
+// Tar archives have to be read entirely, and decompressed first if they are compressed.
+func TotalSize(ctx context.Context, ex Extractor, src io.Reader, paths []string) (int64, int, error) {
+	var size int64
+	var count int
+	err := ex.Extract(ctx, src, paths, func(ctx context.Context, f File) error {
+		count++
+		if !f.IsDir() {
+			size += f.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return size, count, nil
+}
+
+// OpenEntry returns the contents of the regular file name in src, which can be read like any other file
+// of the archive, instead of handling it in a FileHandler. It fails with fs.ErrNotExist if there is no such file.
+// The archive is extracted in another goroutine until the file is closed or ctx is done,
+// so src must not be used otherwise before the file is closed.
+func OpenEntry(ctx context.Context, ex Extractor, src io.Reader, name string) (io.ReadCloser, error) {
+	name = strings.Trim(name, "/")
+	opened := make(chan entryReader, 1)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		var found bool
+		err := ex.Extract(ctx, src, []string{name}, func(ctx context.Context, f File) error {
+			if found || strings.Trim(f.FileName, "/") != name {
+				return nil
+			}
+			found = true
+
+			if !f.Mode().IsRegular() {
+				return fmt.Errorf("%s: not a regular file", name)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+
+			// the archive is read until the file is closed, since it may not be readable after Extract returns
+			opened <- entryReader{ReadCloser: rc, closed: closed, done: done}
+			select {
+			case <-closed:
+			case <-ctx.Done():
+			}
+			return ErrStopWalk
+		})
+		if errors.Is(err, ErrStopWalk) {
+			return
+		}
+		if err == nil && !found {
+			err = fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		opened <- entryReader{err: err}
+	}()
+
+	entry := <-opened
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	return &entry, nil
+}
+
+// Close closes the file and waits for the extraction to stop.
+func (er *entryReader) Close() error {
+	if er.closed == nil {
+		return nil
+	}
+
+	err := er.ReadCloser.Close()
+	close(er.closed)
+	er.closed = nil
+	<-er.done
+
+	return err
+}
+
+// ExtractRecursive is like Extract with ex, but also extracts the archives in src, such as zip files in a tar archive,
+// passing their files to handleFile instead of the archives themselves. The names of the files are prefixed
+// with archiveName and the names of the archives they are in, e.g. "outer.tar/inner.zip/file.txt".
+// Archives are identified by their contents only, and each one is read into memory before it is extracted.
+// Archives nested deeper than maxDepth levels are passed to handleFile as they are, so that archives
+// containing themselves cannot recurse forever; with a maxDepth of 0, no nested archives are extracted.
+func ExtractRecursive(ctx context.Context, ex Extractor, archiveName string, src io.Reader, maxDepth int, handleFile FileHandler) error {
+	return ex.Extract(ctx, src, nil, func(ctx context.Context, f File) error {
+		if archiveName != "" {
+			f.FileName = path.Join(archiveName, f.FileName)
+		}
+		if maxDepth <= 0 || f.Open == nil || !f.Mode().IsRegular() {
+			return handleFile(ctx, f)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: opening: %w", f.FileName, err)
+		}
+		defer rc.Close()
+
+		// the name is not used, so that files that are merely named like archives are not extracted
+		format, stream, err := Identify("", rc)
+		if err != nil && !errors.Is(err, errNoFormatsMatched) {
+			return fmt.Errorf("%s: identifying: %w", f.FileName, err)
+		}
+
+		if nested, ok := format.(Extractor); ok {
+			buf := new(bytes.Buffer)
+			if _, err := copyContext(ctx, buf, stream); err != nil {
+				return fmt.Errorf("%s: reading: %w", f.FileName, err)
+			}
+			return ExtractRecursive(ctx, nested, f.FileName, bytes.NewReader(buf.Bytes()), maxDepth-1, handleFile)
+		}
+
+		// the file was opened already, and the contents of streaming formats like tar cannot be read again
+		open := f.Open
+		var opened bool
+		f.Open = func() (io.ReadCloser, error) {
+			if opened {
+				return open()
+			}
+			opened = true
+			return io.NopCloser(stream), nil
+		}
+
+		return handleFile(ctx, f)
+	})
+}
+
+// ExtractToDisk extracts the files in src, limited to paths if not nil, into the directory dest.
+// Symbolic links are recreated as such, as are the hard links of tar archives.
+// Entries whose names or link targets would end up outside of dest are rejected.
+// Entries that are neither directories, regular files nor links (e.g. devices) are skipped.
+// On Linux and macOS, the Xattrs of directories and regular files are set on them,
+// except for the ones the file system does not support.
+// Options may be nil, in which case the defaults are used.
+func ExtractToDisk(ctx context.Context, ex Extractor, src io.Reader, paths []string, dest string, options *ToDiskOptions) error {
+	var opts ToDiskOptions
+	if options != nil {
+		opts = *options
+	}
+
+	limits := &extractLimits{opts: opts}
+	collisions := &caseCollisions{policy: opts.CaseInsensitiveCollisionPolicy, targets: make(map[string]string)}
+	return ex.Extract(ctx, src, paths, func(ctx context.Context, f File) error {
+		f, err := limits.file(f)
+		if err != nil {
+			return err
+		}
+
+		name, err := localPath(f.FileName)
+		if err != nil {
+			return err
+		}
+		if name = stripComponents(name, opts.StripComponents); name == "" {
+			return nil
+		}
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		if f.IsDir() {
+			if err := checkNoSymlinks(dest, name); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			return setXattrs(target, f.Xattrs)
+		}
+		if !isHardLink(f) && !isSymlink(f) && !f.Mode().IsRegular() {
+			return nil
+		}
+
+		if err := checkNoSymlinks(dest, path.Dir(name)); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		target, err = collisions.resolve(target)
+		if err != nil {
+			return err
+		}
+		target, err = opts.Overwrite.resolve(target)
+		if err != nil || target == "" {
+			return err
+		}
+		collisions.add(target)
+
+		switch {
+		case isHardLink(f):
+			linkName, err := localPath(f.LinkTarget)
+			if err != nil {
+				return fmt.Errorf("%s: hard link: %w", f.FileName, err)
+			}
+			if linkName = stripComponents(linkName, opts.StripComponents); linkName == "" {
+				return fmt.Errorf("%s: hard link to %s has no path left after stripping components", f.FileName, f.LinkTarget)
+			}
+			if err := checkNoSymlinks(dest, path.Dir(linkName)); err != nil {
+				return fmt.Errorf("%s: hard link: %w", f.FileName, err)
+			}
+			return os.Link(filepath.Join(dest, filepath.FromSlash(linkName)), target)
+		case isSymlink(f):
+			linkTarget, err := symlinkTarget(ctx, f)
+			if err != nil {
+				return fmt.Errorf("%s: symbolic link: %w", f.FileName, err)
+			}
+			// the target is relative to the directory of the link
+			if _, err := localPath(path.Join(path.Dir(name), linkTarget)); path.IsAbs(linkTarget) || err != nil {
+				return fmt.Errorf("%s: symbolic link to %s leaves the destination", f.FileName, linkTarget)
+			}
+			return os.Symlink(filepath.FromSlash(linkTarget), target)
+		default:
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, f.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if err := openAndCopyFile(ctx, f, out); err != nil {
+				out.Close()
+				return fmt.Errorf("%s: %w", f.FileName, err)
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			return setXattrs(target, f.Xattrs)
+		}
+	})
+}
+
+// file counts the entry f and returns it with its contents limited.
+func (l *extractLimits) file(f File) (File, error) {
+	l.entries++
+	if l.opts.MaxEntries > 0 && l.entries > l.opts.MaxEntries {
+		return f, fmt.Errorf("%w: more than %d entries", ErrDecompressionLimit, l.opts.MaxEntries)
+	}
+
+	if f.Open == nil || l.opts.MaxDecompressedBytes <= 0 && l.opts.MaxRatio <= 0 {
+		return f, nil
+	}
+
+	var maxRead int64
+	if hdr, ok := f.Header.(zip.FileHeader); ok && l.opts.MaxRatio > 0 && hdr.CompressedSize64 > 0 {
+		maxRead = int64(l.opts.MaxRatio * float64(hdr.CompressedSize64))
+	}
+
+	open := f.Open
+	f.Open = func() (io.ReadCloser, error) {
+		rc, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReader{ReadCloser: rc, limits: l, maxRead: maxRead}, nil
+	}
+
+	return f, nil
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	r.limits.bytes += int64(n)
+
+	if limit := r.limits.opts.MaxDecompressedBytes; limit > 0 && r.limits.bytes > limit {
+		return n, fmt.Errorf("%w: more than %d bytes decompressed", ErrDecompressionLimit, limit)
+	}
+	if r.maxRead > 0 && r.read > r.maxRead {
+		return n, fmt.Errorf("%w: compression ratio of more than %g", ErrDecompressionLimit, r.limits.opts.MaxRatio)
+	}
+
+	return n, err
+}
+
+// stripComponents removes the first n elements from the cleaned, slash-separated name,
+// returning an empty string if no elements are left.
+func stripComponents(name string, n int) string {
+	if name == "." {
+		return ""
+	}
+
+	for i := 0; i < n; i++ {
+		pos := strings.Index(name, "/")
+		if pos < 0 {
+			return ""
+		}
+		name = name[pos+1:]
+	}
+
+	return name
+}
+
+// resolve returns the path to write the file destined for target to according to the policy,
+// or an empty path if the file is to be skipped.
+func (policy OverwritePolicy) resolve(target string) (string, error) {
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch policy {
+	case OverwriteAlways:
+		// remove the existing file instead of writing into it, which might be a link to anywhere
+		if err := os.Remove(target); err != nil {
+			return "", err
+		}
+		return target, nil
+	case OverwriteSkip:
+		return "", nil
+	case OverwriteRenameWithSuffix:
+		for i := 1; ; i++ {
+			renamed := withSuffix(target, i)
+			if _, err := os.Lstat(renamed); errors.Is(err, fs.ErrNotExist) {
+				return renamed, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	default:
+		kind := "file"
+		if info.IsDir() {
+			kind = "directory"
+		}
+		return "", fmt.Errorf("%s: %s already exists: %w", target, kind, fs.ErrExist)
+	}
+}
+
+// withSuffix returns target with " (i)" inserted before its extension.
+func withSuffix(target string, i int) string {
+	ext := filepath.Ext(target)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(target, ext), i, ext)
+}
+
+// resolve returns the target to extract a file to according to the policy, if its name differs only in case
+// from that of a file extracted before, or target otherwise.
+func (c *caseCollisions) resolve(target string) (string, error) {
+	if c.policy == CaseCollisionIgnore {
+		return target, nil
+	}
+
+	earlier, ok := c.targets[strings.ToLower(target)]
+	if !ok || earlier == target {
+		return target, nil
+	}
+
+	switch c.policy {
+	case CaseCollisionRename:
+		for i := 1; ; i++ {
+			renamed := withSuffix(target, i)
+			if _, ok := c.targets[strings.ToLower(renamed)]; ok {
+				continue
+			}
+			if _, err := os.Lstat(renamed); errors.Is(err, fs.ErrNotExist) {
+				return renamed, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	case CaseCollisionOverwrite:
+		if err := os.Remove(earlier); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		delete(c.targets, strings.ToLower(earlier))
+		return target, nil
+	default:
+		return "", fmt.Errorf("%s: name differs only in case from %s: %w", target, earlier, fs.ErrExist)
+	}
+}
+
+// add records the target of an extracted file.
+func (c *caseCollisions) add(target string) {
+	if c.policy != CaseCollisionIgnore {
+		c.targets[strings.ToLower(target)] = target
+	}
+}
+
+// localPath cleans the slash-separated name of a file in an archive, stripping leading slashes like tar does,
+// and returns an error if it leaves its root by "..".
+func localPath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("illegal path: %s", name)
+	}
+
+	return cleaned, nil
+}
+
+// checkNoSymlinks returns an error if dest, joined with any leading part of the cleaned, slash-separated name,
+// is a symbolic link that was already extracted. Each link is only checked to point into dest on its own,
+// so going through a chain of them could still lead out of it.
+func checkNoSymlinks(dest, name string) error {
+	if name == "." {
+		return nil
+	}
+
+	dir := dest
+	for _, elem := range strings.Split(name, "/") {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s: path leads through symbolic link %s", name, dir)
+		}
+	}
+
+	return nil
+}
+
+// isHardLink reports whether f is a hard link of a tar archive.
+func isHardLink(f File) bool {
+	hdr, ok := f.Header.(*tar.Header)
+	return ok && hdr.Typeflag == tar.TypeLink
+}
+
+// symlinkTarget returns the target of the symbolic link f, which zip archives store as its contents.
+func symlinkTarget(ctx context.Context, f File) (string, error) {
+	if f.LinkTarget != "" || f.Open == nil {
+		return f.LinkTarget, nil
+	}
+
+	var buf bytes.Buffer
+	if err := openAndCopyFile(ctx, f, &buf); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// ArchiveAtomic writes files to the archive at finalPath with archiver, so that there is never
+// an incomplete archive at finalPath, even if the process crashes: the archive is written to a temporary
+// file with a unique name next to finalPath, like "archive.tar.123456.tmp", synced to disk and only then
+// renamed to finalPath, replacing the file there. As the temporary file is made by os.CreateTemp,
+// the archive only gets permissions for its owner.
+// If archiving fails, the temporary file is removed and finalPath is left as it was.
+func ArchiveAtomic(ctx context.Context, archiver Archiver, finalPath string, files []File) (err error) {
+	out, err := os.CreateTemp(filepath.Dir(finalPath), filepath.Base(finalPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := out.Name()
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := archiver.Archive(ctx, out, files); err != nil {
+		return fmt.Errorf("archiving: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", tmpPath, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, finalPath)
+}
+
 // FilesFromDisk returns a list of files by traversing the directories in a given filename map.
 // The keys are the names on disk, and the values are the associated names in the archive.
 // Map keys pointing to directories on disk will be looked up and added to the archive recursively,
@@ -123,70 +1118,225 @@ func (s *skipList) add(dir string) {
 // This function is mainly used when preparing a list of files to add to the archive.
 func FilesFromDisk(options *FromDiskOptions, filenames map[string]string) (files []File, err error) {
 	for rootOnDisk, rootInArchive := range filenames {
-		walkErr := filepath.WalkDir(rootOnDisk, func(filename string, d fs.DirEntry, err error) error {
-			var linkTarget string
+		rootFiles, err := options.filesFromDisk(rootOnDisk, rootInArchive, nil)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rootFiles...)
+	}
+	return files, nil
+}
 
-			if err != nil {
-				return err
-			}
+// filesFromDisk returns the files in rootOnDisk as described by FilesFromDisk.
+// If skip is not nil, it is called for each file before it is added;
+// if it returns true, the file (or directory with its contents) is left out.
+func (options *FromDiskOptions) filesFromDisk(rootOnDisk, rootInArchive string, skip func(filename string, d fs.DirEntry) (bool, error)) ([]File, error) {
+	var files []File
+	walkErr := filepath.WalkDir(rootOnDisk, func(filename string, d fs.DirEntry, err error) error {
+		var linkTarget string
 
-			info, err := d.Info()
+		if err != nil {
+			return options.handleError(filename, d, err)
+		}
+
+		if skip != nil {
+			skipped, err := skip(filename, d)
 			if err != nil {
 				return err
 			}
-
-			nameInArchive := nameOnDiskToNameInArchive(filename, rootOnDisk, rootInArchive)
-			// is the root folder, add its contents to the rootInArchive target folder
-			if info.IsDir() && nameInArchive == "" {
+			if skipped {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
 				return nil
 			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return options.handleError(filename, d, err)
+		}
+
+		nameInArchive := nameOnDiskToNameInArchive(filename, rootOnDisk, rootInArchive)
+		// is the root folder, add its contents to the rootInArchive target folder
+		if info.IsDir() && nameInArchive == "" {
+			return nil
+		}
 
-			// handle symbolic links
-			if isSymlink(info) {
-				if options != nil && options.FollowSymboliclinks {
-					// dereference symlinks
-					filename, err = os.Readlink(filename)
-					if err != nil {
-						return fmt.Errorf("%s: readlink: %w", filename, err)
-					}
-
-					info, err = os.Stat(filename)
-					if err != nil {
-						return fmt.Errorf("%s: statting dereferenced symlink: %w", filename, err)
-					}
-				} else {
-					// preserve symlinks
-					linkTarget, err = os.Readlink(filename)
-					if err != nil {
-						return fmt.Errorf("%s: readlink: %w", filename, err)
-					}
+		// handle symbolic links
+		if isSymlink(info) {
+			if options != nil && options.FollowSymboliclinks {
+				// dereference symlinks
+				filename, err = os.Readlink(filename)
+				if err != nil {
+					return fmt.Errorf("%s: readlink: %w", filename, err)
 				}
-			}
 
-			// handle file attributes
-			if options != nil && options.ClearAttributes {
-				info = noAttrFileInfo{info}
+				info, err = os.Stat(filename)
+				if err != nil {
+					return fmt.Errorf("%s: statting dereferenced symlink: %w", filename, err)
+				}
+			} else {
+				// preserve symlinks
+				linkTarget, err = os.Readlink(filename)
+				if err != nil {
+					return fmt.Errorf("%s: readlink: %w", filename, err)
+				}
 			}
+		}
 
-			file := File{
-				FileInfo:   info,
-				FileName:   nameInArchive,
-				LinkTarget: linkTarget,
-				Open: func() (io.ReadCloser, error) {
-					return os.Open(filename)
-				},
-			}
+		// handle file attributes
+		if options != nil && options.ClearAttributes {
+			info = noAttrFileInfo{info}
+		}
 
-			files = append(files, file)
+		file := File{
+			FileInfo:   info,
+			FileName:   nameInArchive,
+			LinkTarget: linkTarget,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(filename)
+			},
+		}
+
+		files = append(files, file)
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	return files, nil
+}
+
+// FilesFromFS is like FilesFromDisk, but gathers the files from fsys, such as an embed.FS
+// or the ArchiveFS of another archive, instead of the disk.
+// The keys of names are slash-separated paths in fsys, optionally ending with a slash
+// to list only the contents of a directory; "." is the root of fsys.
+// Since fs.FS cannot read links, symbolic links are always added as what they point to,
+// and OnError is called for those that cannot be resolved.
+func FilesFromFS(fsys fs.FS, options *FromDiskOptions, names map[string]string) ([]File, error) {
+	var files []File
+	for root, rootInArchive := range names {
+		rootFiles, err := options.filesFromFS(fsys, root, rootInArchive)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rootFiles...)
+	}
+	return files, nil
+}
+
+// filesFromFS returns the files in root of fsys as described by FilesFromFS.
+func (options *FromDiskOptions) filesFromFS(fsys fs.FS, root, rootInArchive string) ([]File, error) {
+	var files []File
+	walkRoot := strings.TrimSuffix(root, "/")
+	if walkRoot == "" {
+		walkRoot = "."
+	}
+
+	walkErr := fs.WalkDir(fsys, walkRoot, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return options.handleError(name, d, err)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return options.handleError(name, d, err)
+		}
+
+		nameInArchive := nameInFSToNameInArchive(name, root, rootInArchive)
+		// is the root folder, add its contents to the rootInArchive target folder
+		if info.IsDir() && nameInArchive == "" {
 			return nil
-		})
-		if walkErr != nil {
-			return nil, walkErr
 		}
+
+		// fs.WalkDir does not follow links, so the contents of linked directories are not added
+		if isSymlink(info) {
+			info, err = fs.Stat(fsys, name)
+			if err != nil {
+				return options.handleError(name, d, fmt.Errorf("%s: statting dereferenced symlink: %w", name, err))
+			}
+		}
+
+		if options != nil && options.ClearAttributes {
+			info = noAttrFileInfo{info}
+		}
+
+		files = append(files, File{
+			FileInfo: info,
+			FileName: nameInArchive,
+			Open: func() (io.ReadCloser, error) {
+				return fsys.Open(name)
+			},
+		})
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
 	}
+
 	return files, nil
 }
 
+// FileFromReader returns a file named nameInArchive whose contents are read from r,
+// which allows archiving content that is not on disk, e.g. generated in memory.
+// size must be the number of bytes r yields, since some archive formats write it before the contents.
+// Since r cannot be rewound, the file can only be opened once.
+func FileFromReader(nameInArchive string, size int64, mode fs.FileMode, modTime time.Time, r io.Reader) File {
+	var opened int32
+	return File{
+		FileInfo: memFileInfo{name: path.Base(nameInArchive), size: size, mode: mode, modTime: modTime},
+		FileName: nameInArchive,
+		Open: func() (io.ReadCloser, error) {
+			if !atomic.CompareAndSwapInt32(&opened, 0, 1) {
+				return nil, fmt.Errorf("%s: contents were already read", nameInArchive)
+			}
+			return io.NopCloser(r), nil
+		},
+	}
+}
+
+// FilesFromBytes returns regular files with the given contents, keyed by their names in the archive,
+// sorted by name. Unlike the file returned by FileFromReader, they can be opened repeatedly.
+func FilesFromBytes(modTime time.Time, contents map[string][]byte) []File {
+	files := make([]File, 0, len(contents))
+	for name, data := range contents {
+		data := data
+		files = append(files, File{
+			FileInfo: memFileInfo{name: path.Base(name), size: int64(len(data)), mode: 0o644, modTime: modTime},
+			FileName: name,
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(data)), nil
+			},
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileName < files[j].FileName
+	})
+
+	return files
+}
+
+// handleError passes the error accessing the file at path to the OnError option, if any.
+// Skipped directories are not descended into.
+func (options *FromDiskOptions) handleError(path string, d fs.DirEntry, err error) error {
+	if options == nil || options.OnError == nil {
+		return err
+	}
+
+	if err := options.OnError(path, err); err != nil {
+		return err
+	}
+
+	if d != nil && d.IsDir() {
+		return fs.SkipDir
+	}
+
+	return nil
+}
+
 // trimTopDir removes the top or first directory from the path.
 // It expects a path with a forward slash.
 // For example, "a/b/c" => "b/c".
@@ -236,8 +1386,35 @@ func nameOnDiskToNameInArchive(nameOnDisk, rootOnDisk, rootInArchive string) str
 	return path.Join(rootInArchive, filepath.ToSlash(truncPath))
 }
 
+// nameInFSToNameInArchive is like nameOnDiskToNameInArchive for the slash-separated name of a file in an fs.FS,
+// which is in the root as given to FilesFromFS.
+func nameInFSToNameInArchive(name, root, rootInArchive string) string {
+	walkRoot := strings.TrimSuffix(root, "/")
+	if walkRoot == "" || walkRoot == "." {
+		// there is no name of the root to place its contents in
+		rel := name
+		if rel == "." {
+			rel = ""
+		}
+		return path.Join(rootInArchive, rel)
+	}
+
+	if strings.HasSuffix(root, "/") {
+		rootInArchive = trimTopDir(rootInArchive)
+	} else if rootInArchive == "" {
+		rootInArchive = path.Base(walkRoot)
+	}
+
+	if strings.HasSuffix(rootInArchive, "/") {
+		rootInArchive += path.Base(walkRoot)
+	}
+
+	return path.Join(rootInArchive, strings.TrimPrefix(strings.TrimPrefix(name, walkRoot), "/"))
+}
+
 // openAndCopyFile opens file for reading, copies its contents to w, then closes file.
-func openAndCopyFile(file File, w io.Writer) error {
+// The copy stops with the error of ctx once it is done, so that copying a large file can be interrupted.
+func openAndCopyFile(ctx context.Context, file File, w io.Writer) error {
 	fileReader, err := file.Open()
 	if err != nil {
 		return err
@@ -245,32 +1422,216 @@ func openAndCopyFile(file File, w io.Writer) error {
 
 	defer fileReader.Close()
 
-	_, err = io.Copy(w, fileReader)
+	_, err = copyContext(ctx, w, fileReader)
 	return err
 }
 
-// fileIsIncluded returns true if the filename is included in the filenameList,
-// i.e. it is in the list, its parent folder/path is in the list, or the list is nil.
-func fileIsIncluded(filenameList []string, filename string) bool {
-	// include all files if there is no specific list
-	if filenameList == nil {
-		return true
+// copyContext is like io.Copy, but checks ctx before reading each chunk of at most copyChunkSize bytes
+// and returns its error once it is done. A read that blocks is not interrupted.
+// Only the WriterTo of r is bypassed, since it would copy everything in one call;
+// the ReaderFrom of w is still used, reading the chunks through the check.
+// The buffer is taken from a pool, since archiving many small files would otherwise allocate one for each.
+func copyContext(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+
+	return io.CopyBuffer(w, chunkedContextReader{ctx, r}, *buf)
+}
+
+// transformedFile returns a copy of file whose contents are passed through transform when it is opened.
+func transformedFile(file File, transform func(name string, r io.Reader) (io.Reader, error)) File {
+	open := file.Open
+	file.Open = func() (io.ReadCloser, error) {
+		rc, err := open()
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := transform(file.FileName, rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, rc}, nil
 	}
 
-	for _, fn := range filenameList {
-		// exact matches are of course included
-		if filename == fn {
-			return true
+	return file
+}
+
+// bufferFile reads the contents of file into memory and returns a copy of file
+// that is opened from the buffer and reports the size of the buffered contents.
+func bufferFile(ctx context.Context, file File) (File, error) {
+	buf := new(bytes.Buffer)
+	if err := openAndCopyFile(ctx, file, buf); err != nil {
+		return file, err
+	}
+
+	file.FileInfo = sizedFileInfo{file.FileInfo, int64(buf.Len())}
+	file.Open = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+
+	return file, nil
+}
+
+// omitDirectories returns files without the directories among them.
+// If sentinel is not empty, directories without any entries in them are replaced
+// with an empty file of that name, so that they are preserved.
+func omitDirectories(files []File, sentinel string) []File {
+	nonEmpty := make(map[string]bool)
+	for _, file := range files {
+		for dir := path.Dir(strings.TrimSuffix(file.FileName, "/")); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			nonEmpty[dir] = true
 		}
+	}
+
+	result := make([]File, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			result = append(result, file)
+			continue
+		}
+
+		dir := strings.TrimSuffix(file.FileName, "/")
+		if sentinel == "" || nonEmpty[dir] {
+			continue
+		}
+
+		result = append(result, File{
+			FileInfo: sentinelFileInfo{file.FileInfo, sentinel},
+			FileName: path.Join(dir, sentinel),
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("")), nil
+			},
+		})
+	}
+
+	return result
+}
+
+// checkPathDepth returns an error if the path name in the archive has more than maxDepth components.
+// A maxDepth of 0 or less means no limit.
+func checkPathDepth(name string, maxDepth int) error {
+	if maxDepth <= 0 {
+		return nil
+	}
+
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return nil
+	}
+
+	if depth := strings.Count(name, "/") + 1; depth > maxDepth {
+		return fmt.Errorf("path depth of %d exceeds the maximum of %d", depth, maxDepth)
+	}
+
+	return nil
+}
+
+// totalSize returns the sum of the sizes of the regular files.
+func totalSize(files []File) int64 {
+	var total int64
+	for _, file := range files {
+		if file.FileInfo != nil && file.Mode().IsRegular() {
+			total += file.Size()
+		}
+	}
+
+	return total
+}
+
+// normalizeSeparators converts the backslashes that some archivers on Windows write
+// as path separators into the slashes that archive entry names are expected to use.
+func normalizeSeparators(name string) string {
+	return strings.ReplaceAll(name, `\`, "/")
+}
+
+// MinimizePaths returns the paths without those that are inside others, and without duplicates, sorted.
+// Passing the result to Extract as pathsInArchive includes the same files as passing paths,
+// while each file is checked against fewer paths. Trailing slashes are ignored when comparing paths.
+// A nil slice, which includes all files, is returned as it is.
+func MinimizePaths(paths []string) []string {
+	if paths == nil {
+		return nil
+	}
+
+	minimal := skipList{}
+	for _, p := range paths {
+		minimal.add(p)
+	}
+	sort.Strings(minimal)
+
+	return minimal
+}
+
+// newPathSet returns the set of the paths to extract, or nil, which includes all files, if paths is nil.
+func newPathSet(paths []string) *pathSet {
+	if paths == nil {
+		return nil
+	}
+
+	ps := &pathSet{
+		exact: make(map[string]struct{}, len(paths)),
+		dirs:  make(map[string]struct{}, len(paths)),
+	}
+	for _, p := range paths {
+		ps.exact[p] = struct{}{}
+		ps.dirs[strings.TrimSuffix(p, "/")] = struct{}{}
+	}
 
-		// also consider the file included if its parent folder/path is in the list
-		if strings.HasPrefix(filename, strings.TrimSuffix(fn, "/")+"/") {
+	return ps
+}
+
+// includes reports whether the file is included, i.e. it is one of the paths, one of its parent directories is,
+// or ps is nil. It looks up the name and the name of each parent directory.
+func (ps *pathSet) includes(filename string) bool {
+	if ps == nil {
+		return true
+	}
+
+	if _, ok := ps.exact[filename]; ok {
+		return true
+	}
+	for i := 0; i < len(filename); i++ {
+		if filename[i] != '/' {
+			continue
+		}
+		if _, ok := ps.dirs[filename[:i]]; ok {
 			return true
 		}
 	}
+
 	return false
 }
 
+func (info memFileInfo) Name() string {
+	return info.name
+}
+
+func (info memFileInfo) Size() int64 {
+	return info.size
+}
+
+func (info memFileInfo) Mode() fs.FileMode {
+	return info.mode
+}
+
+func (info memFileInfo) ModTime() time.Time {
+	return info.modTime
+}
+
+func (info memFileInfo) IsDir() bool {
+	return info.mode.IsDir()
+}
+
+func (memFileInfo) Sys() interface{} {
+	return nil
+}
+
 func isSymlink(info fs.FileInfo) bool {
 	return info.Mode()&os.ModeSymlink != 0
 }
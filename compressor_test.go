@@ -1,10 +1,24 @@
 package compressor
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestSkipList(t *testing.T) {
@@ -201,7 +215,7 @@ func TestNameOnDiskToNameInArchive(t *testing.T) {
 	}
 }
 
-func TestFileIsIncluded(t *testing.T) {
+func TestPathSetIncludes(t *testing.T) {
 	for i, tc := range []struct {
 		included  []string
 		candidate string
@@ -257,11 +271,976 @@ func TestFileIsIncluded(t *testing.T) {
 			candidate: "a/",
 			expect:    false,
 		},
+		{
+			included:  nil,
+			candidate: "a/b",
+			expect:    true,
+		},
+		{
+			included:  []string{},
+			candidate: "a",
+			expect:    false,
+		},
+		{
+			included:  []string{"a//"},
+			candidate: "a//b",
+			expect:    true,
+		},
+		{
+			included:  []string{"a//"},
+			candidate: "a/b",
+			expect:    false,
+		},
 	} {
-		actual := fileIsIncluded(tc.included, tc.candidate)
+		actual := newPathSet(tc.included).includes(tc.candidate)
 		if actual != tc.expect {
 			t.Errorf("Test %d (included=%v candidate=%v): expected %t but got %t",
 				i, tc.included, tc.candidate, tc.expect, actual)
 		}
 	}
 }
+
+func TestSerializeHandler(t *testing.T) {
+	var running, calls int32
+	handler := SerializeHandler(func(ctx context.Context, f File) error {
+		if n := atomic.AddInt32(&running, 1); n != 1 {
+			t.Errorf("expected a single invocation at a time but got %d", n)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&calls, 1)
+		atomic.AddInt32(&running, -1)
+		return nil
+	})
+
+	// call the handler the way concurrent extraction workers would
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := handler(context.Background(), File{FileName: fmt.Sprintf("%d/%d", i, j)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 40 {
+		t.Errorf("expected 40 calls but got %d", calls)
+	}
+}
+
+// openTrackingExtractor records whether any file passed to the handler was opened.
+type openTrackingExtractor struct {
+	Extractor
+	opened *int32
+}
+
+func (e openTrackingExtractor) Extract(ctx context.Context, src io.Reader, paths []string, handleFile FileHandler) error {
+	return e.Extractor.Extract(ctx, src, paths, func(ctx context.Context, f File) error {
+		open := f.Open
+		f.Open = func() (io.ReadCloser, error) {
+			atomic.AddInt32(e.opened, 1)
+			return open()
+		}
+		return handleFile(ctx, f)
+	})
+}
+
+func TestListEntries(t *testing.T) {
+	for _, tc := range []struct {
+		paths []string
+		want  []string
+	}{
+		{paths: nil, want: []string{"1/", "1/1", "2/", "2/1", "1/2"}},
+		{paths: []string{"1"}, want: []string{"1/", "1/1", "1/2"}},
+	} {
+		var opened int32
+		ex := openTrackingExtractor{Extractor: Zip{}, opened: &opened}
+		files, err := ListEntries(context.Background(), ex, bytes.NewReader(unorderZip), tc.paths)
+		checkErr(t, err, "listing entries")
+
+		var names []string
+		for _, f := range files {
+			names = append(names, f.FileName)
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("paths %v: expected %v but got %v", tc.paths, tc.want, names)
+		}
+		if opened != 0 {
+			t.Errorf("paths %v: expected no file to be opened but %d were", tc.paths, opened)
+		}
+	}
+}
+
+func TestOpenEntry(t *testing.T) {
+	ctx := context.Background()
+
+	rc, err := OpenEntry(ctx, Zip{}, bytes.NewReader(testZIP), "go.mod")
+	checkErr(t, err, "opening go.mod")
+	data, err := io.ReadAll(rc)
+	checkErr(t, err, "reading go.mod")
+	checkErr(t, rc.Close(), "closing go.mod")
+	if len(data) != 461 || !bytes.Contains(data, []byte("require (")) {
+		t.Errorf("expected the 461 bytes of go.mod but got %d bytes: %q", len(data), data)
+	}
+
+	if _, err := OpenEntry(ctx, Zip{}, bytes.NewReader(testZIP), "missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a missing file but got %v", err)
+	}
+
+	// the decompressor of a compressed tar archive is closed once extracting stops
+	contents := map[string][]byte{
+		"a.txt":     []byte("file a"),
+		"dir/b.txt": bytes.Repeat([]byte("file b\n"), 10000),
+		"z.txt":     []byte("file z"),
+	}
+	tarZst := CompressedArchive{Compression: Zstd{}, Archival: Tar{}}
+	var buf bytes.Buffer
+	checkErr(t, tarZst.Archive(ctx, &buf, FilesFromBytes(time.Now(), contents)), "archiving")
+
+	rc, err = OpenEntry(ctx, tarZst, bytes.NewReader(buf.Bytes()), "dir/b.txt")
+	checkErr(t, err, "opening dir/b.txt")
+	data, err = io.ReadAll(rc)
+	checkErr(t, err, "reading dir/b.txt")
+	checkErr(t, rc.Close(), "closing dir/b.txt")
+	if !bytes.Equal(data, contents["dir/b.txt"]) {
+		t.Errorf("expected the contents of dir/b.txt but got %d bytes", len(data))
+	}
+
+	if _, err := OpenEntry(ctx, tarZst, bytes.NewReader(buf.Bytes()), "dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a directory without an entry but got %v", err)
+	}
+}
+
+func TestTotalSize(t *testing.T) {
+	// the totals are the ones reported by unzip -l
+	for _, tc := range []struct {
+		name      string
+		archive   []byte
+		wantSize  int64
+		wantCount int
+	}{
+		{name: "test.zip", archive: testZIP, wantSize: 461, wantCount: 1},
+		{name: "unordered.zip", archive: unorderZip, wantSize: 0, wantCount: 5},
+		{name: "nodir.zip", archive: nodirZIP, wantSize: 20761, wantCount: 7},
+	} {
+		size, count, err := TotalSize(context.Background(), Zip{}, bytes.NewReader(tc.archive), nil)
+		checkErr(t, err, "%s: computing total size", tc.name)
+		if size != tc.wantSize || count != tc.wantCount {
+			t.Errorf("%s: expected %d bytes in %d entries but got %d bytes in %d entries",
+				tc.name, tc.wantSize, tc.wantCount, size, count)
+		}
+	}
+}
+
+func TestExtractRecursive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	var inner bytes.Buffer
+	err := Zip{}.Archive(ctx, &inner, FilesFromBytes(now, map[string][]byte{"file.txt": []byte("inner file")}))
+	checkErr(t, err, "archiving inner zip")
+
+	var outer bytes.Buffer
+	err = Tar{}.Archive(ctx, &outer, FilesFromBytes(now, map[string][]byte{
+		"dir/inner.zip": inner.Bytes(),
+		"notes.zip":     []byte("not a zip file"),
+		"top.txt":       []byte("top file"),
+	}))
+	checkErr(t, err, "archiving outer tar")
+
+	for _, tc := range []struct {
+		maxDepth int
+		want     map[string]string
+	}{
+		{
+			maxDepth: 1,
+			want: map[string]string{
+				"outer.tar/dir/inner.zip/file.txt": "inner file",
+				"outer.tar/notes.zip":              "not a zip file",
+				"outer.tar/top.txt":                "top file",
+			},
+		},
+		{
+			maxDepth: 0,
+			want: map[string]string{
+				"outer.tar/dir/inner.zip": inner.String(),
+				"outer.tar/notes.zip":     "not a zip file",
+				"outer.tar/top.txt":       "top file",
+			},
+		},
+	} {
+		got := make(map[string]string)
+		err := ExtractRecursive(ctx, Tar{}, "outer.tar", bytes.NewReader(outer.Bytes()), tc.maxDepth, func(ctx context.Context, f File) error {
+			data, err := f.ReadAll(1 << 20)
+			got[f.FileName] = string(data)
+			return err
+		})
+		checkErr(t, err, "max depth %d: extracting", tc.maxDepth)
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("max depth %d: expected %q but got %q", tc.maxDepth, tc.want, got)
+		}
+	}
+}
+
+func TestExtractToDiskLinks(t *testing.T) {
+	src := t.TempDir()
+	err := os.MkdirAll(filepath.Join(src, "dir"), 0o755)
+	checkErr(t, err, "creating directory")
+	err = os.WriteFile(filepath.Join(src, "dir", "target.txt"), []byte("target"), 0o644)
+	checkErr(t, err, "writing file")
+	err = os.Symlink("target.txt", filepath.Join(src, "dir", "link"))
+	if err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+
+	files, err := FilesFromDisk(nil, map[string]string{src + string(filepath.Separator): ""})
+	checkErr(t, err, "gathering files")
+
+	for _, format := range []interface {
+		Archiver
+		Extractor
+	}{Tar{}, Zip{}} {
+		var buf bytes.Buffer
+		err = format.Archive(context.Background(), &buf, files)
+		checkErr(t, err, "archiving")
+
+		dest := t.TempDir()
+		err = ExtractToDisk(context.Background(), format, bytes.NewReader(buf.Bytes()), nil, dest, nil)
+		checkErr(t, err, "extracting")
+
+		target, err := os.Readlink(filepath.Join(dest, "dir", "link"))
+		checkErr(t, err, "reading link")
+		if target != "target.txt" {
+			t.Errorf("%T: expected link to target.txt but got %s", format, target)
+		}
+		b, err := os.ReadFile(filepath.Join(dest, "dir", "link"))
+		checkErr(t, err, "reading through link")
+		if string(b) != "target" {
+			t.Errorf("%T: unexpected contents through link: %q", format, b)
+		}
+	}
+}
+
+func TestExtractToDiskHardLink(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Name: "a/file.txt", Mode: 0o644, Size: 4, Typeflag: tar.TypeReg})
+	checkErr(t, err, "writing header")
+	_, err = tw.Write([]byte("data"))
+	checkErr(t, err, "writing data")
+	err = tw.WriteHeader(&tar.Header{Name: "b/hardlink.txt", Linkname: "a/file.txt", Typeflag: tar.TypeLink})
+	checkErr(t, err, "writing link header")
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	dest := t.TempDir()
+	err = ExtractToDisk(context.Background(), Tar{}, &buf, nil, dest, nil)
+	checkErr(t, err, "extracting")
+
+	original, err := os.Stat(filepath.Join(dest, "a", "file.txt"))
+	checkErr(t, err, "stat file")
+	link, err := os.Stat(filepath.Join(dest, "b", "hardlink.txt"))
+	checkErr(t, err, "stat hard link")
+	if !os.SameFile(original, link) {
+		t.Errorf("expected b/hardlink.txt to be a hard link to a/file.txt")
+	}
+}
+
+func TestExtractToDiskRejectsEscapingPaths(t *testing.T) {
+	for _, hdr := range []*tar.Header{
+		{Name: "../escape.txt", Mode: 0o644, Typeflag: tar.TypeReg},
+		{Name: "dir/../../escape.txt", Mode: 0o644, Typeflag: tar.TypeReg},
+		{Name: "link", Linkname: "../escape.txt", Typeflag: tar.TypeSymlink},
+		{Name: "dir/link", Linkname: "../../escape.txt", Typeflag: tar.TypeSymlink},
+		{Name: "link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink},
+		{Name: "hardlink", Linkname: "../escape.txt", Typeflag: tar.TypeLink},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		checkErr(t, tw.WriteHeader(hdr), "writing header")
+		checkErr(t, tw.Close(), "closing tar writer")
+
+		dest := t.TempDir()
+		err := ExtractToDisk(context.Background(), Tar{}, &buf, nil, filepath.Join(dest, "out"), nil)
+		if err == nil {
+			t.Errorf("%s -> %s: expected an error", hdr.Name, hdr.Linkname)
+		}
+		if _, err := os.Lstat(filepath.Join(dest, "escape.txt")); err == nil {
+			t.Errorf("%s -> %s: file was written outside of the destination", hdr.Name, hdr.Linkname)
+		}
+	}
+}
+
+func TestExtractToDiskRejectsSymlinkChains(t *testing.T) {
+	// each link stays within the destination on its own, but b/ is the parent of the destination
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "b", Linkname: "a/..", Typeflag: tar.TypeSymlink},
+		{Name: "b/evil.txt", Mode: 0o644, Size: 4, Typeflag: tar.TypeReg},
+	} {
+		checkErr(t, tw.WriteHeader(hdr), "writing header")
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("evil"))
+			checkErr(t, err, "writing contents")
+		}
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	dest := t.TempDir()
+	err := ExtractToDisk(context.Background(), Tar{}, &buf, nil, filepath.Join(dest, "out"), nil)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "evil.txt")); err == nil {
+		t.Errorf("file was written outside of the destination")
+	}
+}
+
+func TestFileFromReader(t *testing.T) {
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := "rendered report"
+	files := []File{
+		FileFromReader("reports/report.txt", int64(len(report)), 0o600, modTime, strings.NewReader(report)),
+	}
+	files = append(files, FilesFromBytes(modTime, map[string][]byte{
+		"data/b.csv": []byte("b,2"),
+		"data/a.csv": []byte("a,1"),
+	})...)
+
+	var buf bytes.Buffer
+	err := Tar{}.Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	got := make(map[string]string)
+	err = Tar{}.Extract(context.Background(), &buf, nil, func(ctx context.Context, f File) error {
+		if !f.ModTime().Equal(modTime) {
+			t.Errorf("%s: expected modification time %s but got %s", f.FileName, modTime, f.ModTime())
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		got[f.FileName] = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+
+	want := map[string]string{"reports/report.txt": report, "data/a.csv": "a,1", "data/b.csv": "b,2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	if _, err := files[0].Open(); err == nil {
+		t.Errorf("expected an error opening the file from a reader a second time")
+	}
+	if files[1].FileName != "data/a.csv" || files[2].FileName != "data/b.csv" {
+		t.Errorf("expected files sorted by name but got %s, %s", files[1].FileName, files[2].FileName)
+	}
+}
+
+func TestExtractToDiskOverwritePolicy(t *testing.T) {
+	modTime := time.Now()
+	files := append([]File{
+		{FileInfo: memFileInfo{name: "dir", mode: fs.ModeDir | 0o755, modTime: modTime}, FileName: "dir"},
+	}, FilesFromBytes(modTime, map[string][]byte{
+		"dir/a.txt": []byte("new"),
+		"dir/b.txt": []byte("b"),
+	})...)
+	var buf bytes.Buffer
+	err := Tar{}.Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	for _, tc := range []struct {
+		policy  OverwritePolicy
+		wantErr bool
+		want    map[string]string
+	}{
+		{
+			policy:  OverwriteError,
+			wantErr: true,
+		},
+		{
+			policy: OverwriteAlways,
+			want:   map[string]string{"a.txt": "new", "b.txt": "b"},
+		},
+		{
+			policy: OverwriteSkip,
+			want:   map[string]string{"a.txt": "old", "b.txt": "b"},
+		},
+		{
+			policy: OverwriteRenameWithSuffix,
+			want:   map[string]string{"a.txt": "old", "a (1).txt": "old (1)", "a (2).txt": "new", "b.txt": "b"},
+		},
+	} {
+		dest := t.TempDir()
+		err := os.MkdirAll(filepath.Join(dest, "dir"), 0o755)
+		checkErr(t, err, "creating directory")
+		err = os.WriteFile(filepath.Join(dest, "dir", "a.txt"), []byte("old"), 0o644)
+		checkErr(t, err, "writing file")
+		if tc.policy == OverwriteRenameWithSuffix {
+			err = os.WriteFile(filepath.Join(dest, "dir", "a (1).txt"), []byte("old (1)"), 0o644)
+			checkErr(t, err, "writing file")
+		}
+
+		err = ExtractToDisk(context.Background(), Tar{}, bytes.NewReader(buf.Bytes()), nil, dest, &ToDiskOptions{Overwrite: tc.policy})
+		if tc.wantErr {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("policy %d: expected fs.ErrExist but got %v", tc.policy, err)
+			}
+			continue
+		}
+		checkErr(t, err, "policy %d: extracting", tc.policy)
+
+		entries, err := os.ReadDir(filepath.Join(dest, "dir"))
+		checkErr(t, err, "reading directory")
+		got := make(map[string]string)
+		for _, entry := range entries {
+			b, err := os.ReadFile(filepath.Join(dest, "dir", entry.Name()))
+			checkErr(t, err, "reading file")
+			got[entry.Name()] = string(b)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("policy %d: expected %v but got %v", tc.policy, tc.want, got)
+		}
+	}
+}
+
+func TestFilesFromDiskOnError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not enforced by mode bits on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	root := t.TempDir()
+	for _, dir := range []string{"readable", "unreadable"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+		checkErr(t, err, "creating directory")
+		err = os.WriteFile(filepath.Join(root, dir, "file.txt"), []byte(dir), 0o644)
+		checkErr(t, err, "writing file")
+	}
+	unreadable := filepath.Join(root, "unreadable")
+	checkErr(t, os.Chmod(unreadable, 0), "making directory unreadable")
+	t.Cleanup(func() {
+		os.Chmod(unreadable, 0o755)
+	})
+
+	_, err := FilesFromDisk(nil, map[string]string{root: "root"})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error without OnError but got %v", err)
+	}
+
+	var skipped []string
+	files, err := FilesFromDisk(&FromDiskOptions{
+		OnError: func(path string, err error) error {
+			skipped = append(skipped, path)
+			return nil
+		},
+	}, map[string]string{root: "root"})
+	checkErr(t, err, "gathering files with OnError")
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.FileName)
+	}
+	if !reflect.DeepEqual(skipped, []string{unreadable}) {
+		t.Errorf("expected %s to be skipped but got %v", unreadable, skipped)
+	}
+	for _, want := range []string{"root/readable", "root/readable/file.txt"} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("expected %s to be gathered, got %v", want, names)
+		}
+	}
+}
+
+func TestFilesFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a.txt":     {Data: []byte("a"), Mode: 0o644},
+		"dir/sub/b.txt": {Data: []byte("b"), Mode: 0o600},
+		"other.txt":     {Data: []byte("other"), Mode: 0o644},
+	}
+
+	for _, tc := range []struct {
+		names map[string]string
+		want  []string
+	}{
+		{
+			names: map[string]string{"dir": "out", "other.txt": ""},
+			want:  []string{"other.txt", "out", "out/a.txt", "out/sub", "out/sub/b.txt"},
+		},
+		{
+			names: map[string]string{"dir/": ""},
+			want:  []string{"a.txt", "sub", "sub/b.txt"},
+		},
+		{
+			names: map[string]string{".": ""},
+			want:  []string{"dir", "dir/a.txt", "dir/sub", "dir/sub/b.txt", "other.txt"},
+		},
+	} {
+		files, err := FilesFromFS(fsys, nil, tc.names)
+		checkErr(t, err, "gathering files of %v", tc.names)
+
+		var got []string
+		for _, f := range files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: expected files %v but got %v", tc.names, tc.want, got)
+		}
+	}
+
+	files, err := FilesFromFS(fsys, nil, map[string]string{".": ""})
+	checkErr(t, err, "gathering files")
+
+	var buf bytes.Buffer
+	checkErr(t, Zip{}.Archive(context.Background(), &buf, files), "archiving")
+
+	got := make(map[string]string)
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		if f.IsDir() {
+			return nil
+		}
+		if f.Mode() != fsys[f.FileName].Mode {
+			t.Errorf("%s: expected mode %v but got %v", f.FileName, fsys[f.FileName].Mode, f.Mode())
+		}
+		data, err := f.ReadAll(1 << 10)
+		got[f.FileName] = string(data)
+		return err
+	})
+	checkErr(t, err, "extracting")
+
+	want := map[string]string{"dir/a.txt": "a", "dir/sub/b.txt": "b", "other.txt": "other"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected contents %v but got %v", want, got)
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	errOpen := errors.New("cannot open")
+	files := append(FilesFromBytes(time.Now(), map[string][]byte{
+		"a.txt": []byte("a"),
+		"c.txt": []byte("c"),
+	}), File{
+		FileInfo: memFileInfo{name: "b.txt", size: 1, mode: 0o644},
+		FileName: "b.txt",
+		Open: func() (io.ReadCloser, error) {
+			return nil, errOpen
+		},
+	})
+
+	for _, format := range []Archiver{
+		&Tar{ContinueOnError: true},
+		&Zip{ContinueOnError: true},
+	} {
+		err := format.Archive(context.Background(), io.Discard, files)
+
+		var me *MultiError
+		if !errors.As(err, &me) {
+			t.Fatalf("%T: expected a MultiError but got %v", format, err)
+		}
+		if len(me.Errors) != 1 || !strings.Contains(err.Error(), "b.txt") || !errors.Is(err, errOpen) {
+			t.Errorf("%T: expected the error to name b.txt, got %v", format, err)
+		}
+
+		SetContinueOnError(format.(Format), false)
+		if err := format.Archive(context.Background(), io.Discard, files); !errors.Is(err, errOpen) || errors.As(err, &me) {
+			t.Errorf("%T: expected the plain error without ContinueOnError, got %v", format, err)
+		}
+	}
+}
+
+func TestErrorMode(t *testing.T) {
+	errOpen := errors.New("cannot open")
+	failing := func(name string) File {
+		return File{
+			FileInfo: memFileInfo{name: name, size: 1, mode: 0o644},
+			FileName: name,
+			Open: func() (io.ReadCloser, error) {
+				return nil, fmt.Errorf("%s: %w", name, errOpen)
+			},
+		}
+	}
+	files := append(FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("a")}), failing("b.txt"), failing("c.txt"))
+
+	for _, tc := range []struct {
+		mode   ErrorMode
+		errors int // -1 for a plain error
+	}{
+		{mode: FailFast, errors: -1},
+		{mode: ContinueSilent, errors: 0},
+		{mode: ContinueCollect, errors: 2},
+	} {
+		for _, format := range []Archiver{Tar{ErrorMode: tc.mode}, Zip{ErrorMode: tc.mode}} {
+			err := format.Archive(context.Background(), io.Discard, files)
+
+			var me *MultiError
+			switch {
+			case tc.errors < 0:
+				if !errors.Is(err, errOpen) || errors.As(err, &me) || !strings.Contains(err.Error(), "b.txt") {
+					t.Errorf("%T, mode %d: expected the plain error of b.txt, got %v", format, tc.mode, err)
+				}
+			case tc.errors == 0:
+				if err != nil {
+					t.Errorf("%T, mode %d: expected no error, got %v", format, tc.mode, err)
+				}
+			default:
+				if !errors.As(err, &me) || len(me.Errors) != tc.errors {
+					t.Fatalf("%T, mode %d: expected a MultiError with %d errors but got %v", format, tc.mode, tc.errors, err)
+				}
+				if !strings.Contains(me.Errors[0].Error(), "b.txt") || !strings.Contains(me.Errors[1].Error(), "c.txt") {
+					t.Errorf("%T, mode %d: expected the errors of b.txt and c.txt, got %v", format, tc.mode, err)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractToDiskStripComponents(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "project/", Mode: 0o755, Typeflag: tar.TypeDir},
+		{Name: "project/README", Mode: 0o644, Size: 6, Typeflag: tar.TypeReg},
+		{Name: "project/src/", Mode: 0o755, Typeflag: tar.TypeDir},
+		{Name: "project/src/main.go", Mode: 0o644, Size: 6, Typeflag: tar.TypeReg},
+		{Name: "project/src/link.go", Linkname: "project/src/main.go", Typeflag: tar.TypeLink},
+		{Name: "toplevel.txt", Mode: 0o644, Size: 6, Typeflag: tar.TypeReg},
+	} {
+		checkErr(t, tw.WriteHeader(hdr), "writing header of %s", hdr.Name)
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("data\n\n"))
+			checkErr(t, err, "writing %s", hdr.Name)
+		}
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	dest := t.TempDir()
+	err := ExtractToDisk(context.Background(), Tar{}, bytes.NewReader(buf.Bytes()), nil, dest, &ToDiskOptions{StripComponents: 1})
+	checkErr(t, err, "extracting")
+
+	var got []string
+	err = filepath.WalkDir(dest, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == dest {
+			return err
+		}
+		rel, err := filepath.Rel(dest, name)
+		got = append(got, filepath.ToSlash(rel))
+		return err
+	})
+	checkErr(t, err, "walking destination")
+
+	// toplevel.txt has no elements left after stripping one
+	want := []string{"README", "src", "src/link.go", "src/main.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	original, err := os.Stat(filepath.Join(dest, "src", "main.go"))
+	checkErr(t, err, "stat file")
+	link, err := os.Stat(filepath.Join(dest, "src", "link.go"))
+	checkErr(t, err, "stat hard link")
+	if !os.SameFile(original, link) {
+		t.Errorf("expected src/link.go to be a hard link to src/main.go")
+	}
+}
+
+func TestExtractToDiskLimits(t *testing.T) {
+	// 8 MiB of zeros in each file, which compress to a few KiB
+	zeros := make([]byte, 8<<20)
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.img": zeros, "b.img": zeros})
+
+	archive := func(format Archiver) []byte {
+		var buf bytes.Buffer
+		err := format.Archive(context.Background(), &buf, files)
+		checkErr(t, err, "archiving")
+		return buf.Bytes()
+	}
+	tarGz := CompressedArchive{Compression: Gz{}, Archival: Tar{}}
+	tarGzData, zipData := archive(tarGz), archive(Zip{})
+	if len(tarGzData) > 1<<20 {
+		t.Fatalf("expected a high compression ratio but the archive has %d bytes", len(tarGzData))
+	}
+
+	for i, tc := range []struct {
+		format  Extractor
+		data    []byte
+		options ToDiskOptions
+		fail    bool
+	}{
+		{format: tarGz, data: tarGzData, options: ToDiskOptions{MaxDecompressedBytes: 16 << 20, MaxEntries: 2}},
+		{format: tarGz, data: tarGzData, options: ToDiskOptions{MaxDecompressedBytes: 1 << 20}, fail: true},
+		{format: tarGz, data: tarGzData, options: ToDiskOptions{MaxDecompressedBytes: 12 << 20}, fail: true},
+		{format: tarGz, data: tarGzData, options: ToDiskOptions{MaxEntries: 1}, fail: true},
+		{format: tarGz, data: tarGzData, options: ToDiskOptions{MaxRatio: 10}}, // the compressed sizes are unknown
+		{format: Zip{}, data: zipData, options: ToDiskOptions{MaxRatio: 10000}},
+		{format: Zip{}, data: zipData, options: ToDiskOptions{MaxRatio: 10}, fail: true},
+	} {
+		err := ExtractToDisk(context.Background(), tc.format, bytes.NewReader(tc.data), nil, t.TempDir(), &tc.options)
+		if tc.fail && !errors.Is(err, ErrDecompressionLimit) {
+			t.Errorf("test %d: expected ErrDecompressionLimit but got %v", i, err)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("test %d: expected no error but got %v", i, err)
+		}
+	}
+}
+
+func TestArchiveAtomic(t *testing.T) {
+	dir := t.TempDir()
+	finalPath := filepath.Join(dir, "out.tar")
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("file a"), "c.txt": []byte("file c")})
+	failing := File{
+		FileInfo: memFileInfo{name: "b.txt", size: 6, mode: 0o644},
+		FileName: "b.txt",
+		Open: func() (io.ReadCloser, error) {
+			return nil, errors.New("cannot open")
+		},
+	}
+
+	err := ArchiveAtomic(context.Background(), Tar{}, finalPath, []File{files[0], failing, files[1]})
+	if err == nil {
+		t.Fatal("expected archiving to fail")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected neither the archive nor the temporary file to be left, got %v (%v)", entries, err)
+	}
+
+	err = ArchiveAtomic(context.Background(), Tar{}, finalPath, files)
+	checkErr(t, err, "archiving")
+	previous, err := os.ReadFile(finalPath)
+	checkErr(t, err, "reading archive")
+
+	var names []string
+	err = Tar{}.Extract(context.Background(), bytes.NewReader(previous), nil, func(ctx context.Context, f File) error {
+		names = append(names, f.FileName)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"a.txt", "c.txt"}) {
+		t.Errorf("expected a.txt and c.txt in the archive but got %v", names)
+	}
+
+	// a file that happens to have the name of a temporary file is none of ours
+	unrelated := filepath.Join(dir, "out.tar.tmp")
+	err = os.WriteFile(unrelated, []byte("unrelated"), 0o644)
+	checkErr(t, err, "writing unrelated file")
+
+	// a failure leaves the existing archive as it was
+	err = ArchiveAtomic(context.Background(), Tar{}, finalPath, []File{failing})
+	if err == nil {
+		t.Fatal("expected archiving to fail")
+	}
+	current, err := os.ReadFile(finalPath)
+	checkErr(t, err, "reading archive")
+	if !bytes.Equal(current, previous) {
+		t.Error("expected the existing archive to be left as it was")
+	}
+	entries, err := os.ReadDir(dir)
+	checkErr(t, err, "reading directory")
+	if len(entries) != 2 {
+		t.Errorf("expected the temporary file to be removed, got %v", entries)
+	}
+
+	err = ArchiveAtomic(context.Background(), Tar{}, finalPath, files)
+	checkErr(t, err, "archiving next to an unrelated file")
+	got, err := os.ReadFile(unrelated)
+	checkErr(t, err, "reading unrelated file")
+	if string(got) != "unrelated" {
+		t.Errorf("expected the unrelated file to be left alone, got %q", got)
+	}
+}
+
+// endlessReader returns zeros forever, pausing before each read.
+type endlessReader struct{ delay time.Duration }
+
+func (r endlessReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestArchiveCancelDuringCopy(t *testing.T) {
+	huge := File{
+		FileInfo: memFileInfo{name: "huge.bin", size: 1 << 40, mode: 0o644},
+		FileName: "huge.bin",
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(endlessReader{time.Millisecond}), nil
+		},
+	}
+
+	for _, archiver := range []Archiver{Tar{}, Zip{}} {
+		archiver := archiver
+		t.Run(archiver.(Format).Name(), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- archiver.Archive(ctx, io.Discard, []File{huge})
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("expected the context error but got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("archiving was not interrupted by the cancellation")
+			}
+		})
+	}
+}
+
+func TestFileReadAll(t *testing.T) {
+	files := FilesFromBytes(time.Now(), map[string][]byte{
+		"small.txt": []byte("hello"),
+		"large.txt": bytes.Repeat([]byte("x"), 1000),
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].FileName > files[j].FileName })
+	small, large := files[0], files[1]
+
+	for _, maxBytes := range []int64{5, 100} {
+		data, err := small.ReadAll(maxBytes)
+		checkErr(t, err, "reading with a limit of %d", maxBytes)
+		if string(data) != "hello" {
+			t.Errorf("limit %d: expected the whole contents but got %q", maxBytes, data)
+		}
+	}
+
+	if _, err := large.ReadAll(999); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded but got %v", err)
+	}
+	if _, err := small.ReadAll(4); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded for a file one byte too large but got %v", err)
+	}
+}
+
+func TestMinimizePaths(t *testing.T) {
+	for i, tc := range []struct {
+		paths  []string
+		expect []string
+	}{
+		{paths: []string{"a", "a/b", "c"}, expect: []string{"a", "c"}},
+		{paths: []string{"a/b/c", "c", "a/b/", "a/bc"}, expect: []string{"a/b/", "a/bc", "c"}},
+		{paths: []string{"a/", "a", "a/b"}, expect: []string{"a/"}},
+		{paths: []string{}, expect: []string{}},
+		{paths: nil, expect: nil},
+	} {
+		got := MinimizePaths(tc.paths)
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("test %d: expected %q but got %q", i, tc.expect, got)
+		}
+	}
+}
+
+func TestExtractToDiskCaseCollisions(t *testing.T) {
+	var archived bytes.Buffer
+	files := []File{
+		FilesFromBytes(time.Now(), map[string][]byte{"docs/File.txt": []byte("upper")})[0],
+		FilesFromBytes(time.Now(), map[string][]byte{"Docs/file.txt": []byte("lower")})[0],
+	}
+	err := Tar{}.Archive(context.Background(), &archived, files)
+	checkErr(t, err, "archiving")
+
+	for _, tc := range []struct {
+		policy CaseCollisionPolicy
+		want   map[string]string // by the names relative to the destination
+	}{
+		{policy: CaseCollisionError},
+		{policy: CaseCollisionRename, want: map[string]string{"docs/File.txt": "upper", "Docs/file (1).txt": "lower"}},
+		{policy: CaseCollisionOverwrite, want: map[string]string{"Docs/file.txt": "lower"}},
+	} {
+		dest := t.TempDir()
+		opts := &ToDiskOptions{CaseInsensitiveCollisionPolicy: tc.policy}
+		err := ExtractToDisk(context.Background(), Tar{}, bytes.NewReader(archived.Bytes()), nil, dest, opts)
+		if tc.want == nil {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("policy %d: expected fs.ErrExist but got %v", tc.policy, err)
+			}
+			continue
+		}
+		checkErr(t, err, "policy %d: extracting", tc.policy)
+
+		got := make(map[string]string)
+		err = filepath.WalkDir(dest, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			content, err := os.ReadFile(name)
+			rel, _ := filepath.Rel(dest, name)
+			got[filepath.ToSlash(rel)] = string(content)
+			return err
+		})
+		checkErr(t, err, "policy %d: walking", tc.policy)
+
+		// on case-insensitive file systems, the directories are one, named by the first entry,
+		// so the names are compared in lower case, after checking that the wanted ones can be found
+		want := make(map[string]string, len(tc.want))
+		for name, content := range tc.want {
+			if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+				t.Errorf("policy %d: expected %s: %v", tc.policy, name, err)
+			}
+			want[strings.ToLower(name)] = content
+		}
+		lowered := make(map[string]string, len(got))
+		for name, content := range got {
+			lowered[strings.ToLower(name)] = content
+		}
+		if !reflect.DeepEqual(lowered, want) {
+			t.Errorf("policy %d: expected files %v but got %v", tc.policy, want, got)
+		}
+	}
+}
+
+// BenchmarkExtractPaths extracts a few files from an archive of many, selected by a long list of paths.
+func BenchmarkExtractPaths(b *testing.B) {
+	contents := make(map[string][]byte, 10000)
+	paths := make([]string, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("dir%d/file%d.txt", i%100, i)
+		contents[name] = nil
+		paths = append(paths, fmt.Sprintf("other%d/file%d.txt", i%100, i))
+	}
+	paths[len(paths)-1] = "dir7/"
+
+	var buf bytes.Buffer
+	if err := (Tar{}).Archive(context.Background(), &buf, FilesFromBytes(time.Now(), contents)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		err := Tar{}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), paths, func(ctx context.Context, f File) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != 100 {
+			b.Fatalf("expected 100 files but got %d", n)
+		}
+	}
+}
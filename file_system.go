@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -67,6 +68,7 @@ type dirFileInfo struct {
 type compressedFile struct {
 	*os.File
 	decomp io.ReadCloser
+	name   string // if not empty, the name reported by Stat
 }
 
 // ArchiveFS allows accessing an archive (or a compressed archive) using a consistent file system interface.
@@ -84,6 +86,12 @@ type compressedFile struct {
 // performance tends to O(n^2) as the entire archive is walked for each folder that is enumerated (WalkDir calls ReadDir recursively).
 // If you don't want the contents of each directory to be viewed in order, prefer to call Extract() from the archive type directly,
 // this will do an O(n) view of the contents in archive order, rather than the slower directory tree order.
+// To mitigate this, the values returned by NewCachedArchiveFS (and FileSystem) make the listing of the archive
+// (without file contents) once and cache it for subsequent Stat and ReadDir calls,
+// so only opening a regular file needs another pass over the archive.
+// Set DisableCache or call InvalidateCache if the archive can change between calls.
+// Zip streams are the exception: since they allow random access, the central directory is read instead,
+// and with a cache, the resulting index is reused for all subsequent calls.
 type ArchiveFS struct {
 	// set one of these:
 	Path   string            // path to the archive file on disk
@@ -92,6 +100,21 @@ type ArchiveFS struct {
 	Format  Archival        // the archive format
 	Prefix  string          // optional subdirectory in which to root the fs
 	Context context.Context // optional
+
+	DisableCache bool // if true, the listing of the archive is not kept between calls
+
+	// If greater than 0, listings of archives with more entries than this are not kept between calls,
+	// which bounds the memory used by the cache at the cost of reading such archives on each call.
+	MaxIndexEntries int
+
+	cache *archiveFSCache // shared by copies of the value, nil if nothing is cached
+}
+
+// archiveFSCache holds what an ArchiveFS keeps between calls.
+type archiveFSCache struct {
+	mu        sync.Mutex
+	files     []File      // listing of the archive, see index
+	zipReader *zip.Reader // reader of a zip Stream, created on first use
 }
 
 // FileFS allows accessing a file on disk using a consistent file system interface.
@@ -99,10 +122,16 @@ type ArchiveFS struct {
 // be the only entry in the file system and will be at the root of the file system.
 // It can be accessed in the file system by the name of "." or by file name.
 // If the file is compressed, set the Compression field to read from
-// the file transparently decompressed.
+// the file transparently decompressed. The file can then also be accessed
+// by its name without the extension of the compression format, e.g. "data.json" for "data.json.gz".
 type FileFS struct {
 	Path        string       // path to the file on disk
 	Compression Decompressor // if file is compressed, setting this field will transparently decompress reads
+
+	// If true and Compression is set, the file is presented as its decompressed content would be:
+	// it is listed and stat'ed by its name without the extension of the compression format.
+	// Its size is still that of the compressed file, since the decompressed size is not known without decompressing it.
+	DecompressedName bool
 }
 
 // Interface guards
@@ -117,6 +146,11 @@ var (
 	_ fs.ReadDirFS = (*ArchiveFS)(nil)
 	_ fs.StatFS    = (*ArchiveFS)(nil)
 	_ fs.SubFS     = (*ArchiveFS)(nil)
+	_ fs.ReadDirFS = ArchiveFS{}
+	_ fs.StatFS    = ArchiveFS{}
+
+	// the readers of streams passed to Extract, see streamReader
+	_ seekReaderAt = (*io.SectionReader)(nil)
 )
 
 // Open opens the named file.
@@ -273,6 +307,14 @@ func (dirFileInfo) IsDir() bool {
 	return true
 }
 
+// NewCachedArchiveFS returns fsys set up to keep the listing of the archive between calls,
+// so that Stat and ReadDir do not read the archive again. The returned value and copies of it,
+// including the file systems returned by Sub, share the cache; see also DisableCache and MaxIndexEntries.
+func NewCachedArchiveFS(fsys ArchiveFS) ArchiveFS {
+	fsys.cache = new(archiveFSCache)
+	return fsys
+}
+
 // context always returns context, preferring f.Context if not nil.
 func (f ArchiveFS) context() context.Context {
 	if f.Context != nil {
@@ -284,24 +326,36 @@ func (f ArchiveFS) context() context.Context {
 
 // Open opens the named file from the archive. If name is ".",
 // the archive file itself will be opened as a directory file.
-func (f ArchiveFS) Open(name string) (archiveFile fs.File, err error) {
-	var files []File
+func (f ArchiveFS) Open(name string) (fs.File, error) {
 	var found bool
-	var inputStream io.Reader = archiveFile
+	var keepArchive bool
+	var archiveFile fs.File
+	var inputStream io.Reader
 
 	if !fs.ValidPath(name) {
 		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
 	}
 
+	zr, err := f.zipFS()
+	if err != nil {
+		return nil, err
+	}
+	if zr != nil {
+		return zr.Open(path.Join(f.Prefix, name))
+	}
+
 	if f.Path != "" {
-		archiveFile, err = os.Open(f.Path)
+		file, err := os.Open(f.Path)
 		if err != nil {
 			return nil, err
 		}
+		archiveFile = file
+		inputStream = file
 		defer func() {
-			// close the archive file if the extraction fails
-			if err != nil {
-				archiveFile.Close()
+			// only regular files are read from the archive after returning,
+			// they close it along with themselves
+			if !keepArchive {
+				file.Close()
 			}
 		}()
 	} else if f.Stream != nil {
@@ -334,19 +388,43 @@ func (f ArchiveFS) Open(name string) (archiveFile fs.File, err error) {
 		}, nil
 	}
 
+	// with a cache, entries without content are served from the listing,
+	// only regular files need another pass over the archive to be read
+	if f.cached() {
+		index, err := f.index()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := search(name, index)
+		if entry == nil {
+			return nil, fs.ErrNotExist
+		}
+
+		if entry.IsDir() {
+			return &dirFile{extractedFile: extractedFile{File: *entry}, entries: openReadDir(name, index)}, nil
+		}
+
+		// if named file is not a regular file, it can't be opened
+		if !entry.Mode().IsRegular() {
+			return extractedFile{File: *entry}, nil
+		}
+	}
+
 	// collect them all or stop at exact file match, note we don't stop at folder match
+	var files []File
 	handler := func(_ context.Context, file File) error {
 		file.FileName = strings.Trim(file.FileName, "/")
 		files = append(files, file)
 		if file.FileName == name && !file.IsDir() {
 			found = true
-			return errors.New("stop walk")
+			return ErrStopWalk
 		}
 		return nil
 	}
 
 	if f.Stream != nil {
-		inputStream = io.NewSectionReader(f.Stream, 0, f.Stream.Size())
+		inputStream = f.streamReader()
 	}
 
 	err = f.Format.Extract(f.context(), inputStream, []string{name}, handler)
@@ -357,16 +435,8 @@ func (f ArchiveFS) Open(name string) (archiveFile fs.File, err error) {
 		return nil, err
 	}
 
-	if len(files) == 0 {
-		return nil, fs.ErrNotExist
-	}
-
-	// exactly one or exact file found, test name match to detect implicit dir name https://github.com/mholt/archiver/issues/340
-	if (len(files) == 1 && files[0].FileName == name) || found {
+	if found {
 		file := files[len(files)-1]
-		if file.IsDir() {
-			return &dirFile{extractedFile: extractedFile{File: file}}, nil
-		}
 
 		// if named file is not a regular file, it can't be opened
 		if !file.Mode().IsRegular() {
@@ -378,89 +448,43 @@ func (f ArchiveFS) Open(name string) (archiveFile fs.File, err error) {
 		if err != nil {
 			return nil, err
 		}
+		keepArchive = true
 		return extractedFile{File: file, ReadCloser: rc, parentArchive: archiveFile}, nil
 	}
 
-	// implicit files
+	// directories, including implicit ones
 	files = fillImplicit(files)
 	file := search(name, files)
-	if file == nil {
+	if file == nil || !file.IsDir() {
 		return nil, fs.ErrNotExist
 	}
 
-	if file.IsDir() {
-		return &dirFile{extractedFile: extractedFile{File: *file}, entries: openReadDir(name, files)}, nil
-	}
-
-	// if named file is not a regular file, it can't be opened
-	if !file.Mode().IsRegular() {
-		return extractedFile{File: *file}, nil
-	}
-
-	// regular files can be read, so open it for reading
-	rc, err := file.Open()
-	if err != nil {
-		return nil, err
-	}
-
-	return extractedFile{File: *file, ReadCloser: rc, parentArchive: archiveFile}, nil
+	return &dirFile{extractedFile: extractedFile{File: *file}, entries: openReadDir(name, files)}, nil
 }
 
 // ReadDir reads the named directory from within the archive.
 func (f ArchiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
-	var inputStream io.Reader
-	var archiveFile *os.File
-	var filter []string
-	var foundFile bool
-	var files []File
-	var err error
-
 	if !fs.ValidPath(name) {
 		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
 	}
 
-	if f.Stream == nil {
-		archiveFile, err = os.Open(f.Path)
-		if err != nil {
-			return nil, err
-		}
-		defer archiveFile.Close()
-	}
-
-	// apply prefix if fs is rooted in a subtree
-	name = path.Join(f.Prefix, name)
-
-	handler := func(_ context.Context, file File) error {
-		file.FileName = strings.Trim(file.FileName, "/")
-		files = append(files, file)
-		if file.FileName == name && !file.IsDir() {
-			foundFile = true
-			return errors.New("stop walk")
-		}
-		return nil
+	zr, err := f.zipFS()
+	if err != nil {
+		return nil, err
 	}
-
-	// handle special case of reading from root of archive
-	if name != "." {
-		filter = []string{name}
+	if zr != nil {
+		return fs.ReadDir(zr, path.Join(f.Prefix, name))
 	}
 
-	inputStream = archiveFile
-	if f.Stream != nil {
-		inputStream = io.NewSectionReader(f.Stream, 0, f.Stream.Size())
-	}
-
-	err = f.Format.Extract(f.context(), inputStream, filter, handler)
-	if foundFile {
-		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a dir")}
-	}
+	files, err := f.index()
 	if err != nil {
 		return nil, err
 	}
 
-	// always find all implicit directories
-	files = fillImplicit(files)
-	// and return early for dot file
+	// apply prefix if fs is rooted in a subtree
+	name = path.Join(f.Prefix, name)
+
+	// return early for dot file
 	if name == "." {
 		return openReadDir(name, files), nil
 	}
@@ -480,16 +504,18 @@ func (f ArchiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
 // Stat stats the named file from within the archive.
 // If name is "." then the archive file itself is statted and treated as a directory file.
 func (f ArchiveFS) Stat(name string) (fs.FileInfo, error) {
-	var inputStream io.Reader
-	var archiveFile *os.File
-	var err error
-	var files []File
-	var found bool
-
 	if !fs.ValidPath(name) {
 		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
 	}
 
+	zr, err := f.zipFS()
+	if err != nil {
+		return nil, err
+	}
+	if zr != nil {
+		return fs.Stat(zr, path.Join(f.Prefix, name))
+	}
+
 	// apply prefix if fs is rooted in a subtree
 	name = path.Join(f.Prefix, name)
 
@@ -505,30 +531,57 @@ func (f ArchiveFS) Stat(name string) (fs.FileInfo, error) {
 		}
 	}
 
-	if f.Stream == nil {
-		archiveFile, err = os.Open(f.Path)
+	var files []File
+	if f.cached() {
+		index, err := f.index()
+		if err != nil {
+			return nil, err
+		}
+		files = index
+	} else {
+		var err error
+		if files, err = f.statPass(name); err != nil {
+			return nil, err
+		}
+	}
+
+	file := search(name, files)
+	if file == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	return file.FileInfo, nil
+}
+
+// statPass reads the archive until it finds the named entry, returning the entries read
+// within name along with the implicit directories, which include name if it is one.
+func (f ArchiveFS) statPass(name string) ([]File, error) {
+	var inputStream io.Reader
+	if f.Stream != nil {
+		inputStream = f.streamReader()
+	} else {
+		archiveFile, err := os.Open(f.Path)
 		if err != nil {
 			return nil, err
 		}
 		defer archiveFile.Close()
+
+		inputStream = archiveFile
 	}
 
+	var files []File
+	var found bool
 	handler := func(_ context.Context, file File) error {
 		file.FileName = strings.Trim(file.FileName, "/")
 		files = append(files, file)
 		if file.FileName == name {
 			found = true
-			return errors.New("stop walk")
+			return ErrStopWalk
 		}
 		return nil
 	}
 
-	inputStream = archiveFile
-	if f.Stream != nil {
-		inputStream = io.NewSectionReader(f.Stream, 0, f.Stream.Size())
-	}
-
-	err = f.Format.Extract(f.context(), inputStream, []string{name}, handler)
+	err := f.Format.Extract(f.context(), inputStream, []string{name}, handler)
 	if found {
 		err = nil
 	}
@@ -536,17 +589,7 @@ func (f ArchiveFS) Stat(name string) (fs.FileInfo, error) {
 		return nil, err
 	}
 
-	if (len(files) == 0 && files[0].FileName == name) || found {
-		return files[len(files)-1].FileInfo, nil
-	}
-
-	files = fillImplicit(files)
-	file := search(name, files)
-	if file == nil {
-		return nil, fs.ErrNotExist
-	}
-
-	return file.FileInfo, nil
+	return fillImplicit(files), nil
 }
 
 // Sub returns an FS corresponding to the subtree rooted at dir.
@@ -564,16 +607,174 @@ func (f *ArchiveFS) Sub(dir string) (fs.FS, error) {
 		return nil, fmt.Errorf("%s is not a directory", dir)
 	}
 
-	result := f
-	result.Prefix = dir
+	result := &ArchiveFS{
+		Path:            f.Path,
+		Stream:          f.Stream,
+		Format:          f.Format,
+		Prefix:          path.Join(f.Prefix, dir),
+		Context:         f.Context,
+		DisableCache:    f.DisableCache,
+		MaxIndexEntries: f.MaxIndexEntries,
+		cache:           f.cache,
+	}
 
 	return result, nil
 }
 
+// zipFS returns a reader of the Stream if the format is zip, and nil otherwise.
+// The reader is created once and then reused, because it keeps an index of the archive contents,
+// which makes lookups cheap instead of walking the whole archive for every call.
+func (f ArchiveFS) zipFS() (*zip.Reader, error) {
+	var z Zip
+	switch ff := f.Format.(type) {
+	case Zip:
+		z = ff
+	case *Zip:
+		z = *ff
+	default:
+		return nil, nil
+	}
+
+	// archive/zip cannot decrypt entries, so those go through Extract
+	if f.Stream == nil || z.Password != "" {
+		return nil, nil
+	}
+
+	if f.cache != nil {
+		f.cache.mu.Lock()
+		defer f.cache.mu.Unlock()
+
+		if f.cache.zipReader != nil && !f.DisableCache {
+			return f.cache.zipReader, nil
+		}
+	}
+
+	zr, err := z.newReader(f.Stream, f.Stream.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	// the index is built on the first Open, so decode the names before that
+	for _, file := range zr.File {
+		z.decodeText(&file.FileHeader)
+	}
+
+	if f.cacheable(len(zr.File)) {
+		f.cache.zipReader = zr
+	}
+
+	return zr, nil
+}
+
+// streamReader returns a new reader of the whole Stream for a pass over the archive.
+// Unlike ReadAt, Read and Seek move the offset of a SectionReader, so each pass gets its own
+// to allow concurrent calls, while the reads all go to the same underlying io.ReaderAt.
+// Besides io.Reader, it satisfies seekReaderAt, which formats like Zip and SevenZip require of their input.
+func (f ArchiveFS) streamReader() *io.SectionReader {
+	return io.NewSectionReader(f.Stream, 0, f.Stream.Size())
+}
+
+// index returns the listing of all entries in the archive, including implicit directories,
+// sorted as expected by search and openReadDir. The listing is made with a single pass over the archive
+// and is cached unless DisableCache is set. The files in the listing cannot be opened.
+func (f ArchiveFS) index() ([]File, error) {
+	var inputStream io.Reader
+	var files []File
+
+	if f.cache != nil {
+		f.cache.mu.Lock()
+		defer f.cache.mu.Unlock()
+
+		if f.cache.files != nil && !f.DisableCache {
+			return f.cache.files, nil
+		}
+	}
+
+	if f.Stream != nil {
+		inputStream = f.streamReader()
+	} else {
+		archiveFile, err := os.Open(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer archiveFile.Close()
+
+		inputStream = archiveFile
+	}
+
+	handler := func(_ context.Context, file File) error {
+		file.FileName = strings.Trim(file.FileName, "/")
+		file.Open = nil // contents can only be read during the pass
+		files = append(files, file)
+		return nil
+	}
+
+	if err := f.Format.Extract(f.context(), inputStream, nil, handler); err != nil {
+		return nil, err
+	}
+
+	files = fillImplicit(files)
+	if f.cacheable(len(files)) {
+		f.cache.files = files
+	}
+
+	return files, nil
+}
+
+// cached reports whether the listing of the archive is kept between calls, see index.
+func (f ArchiveFS) cached() bool {
+	return f.cache != nil && !f.DisableCache
+}
+
+// cacheable reports whether a listing of n entries may be cached.
+func (f ArchiveFS) cacheable(n int) bool {
+	return f.cache != nil && !f.DisableCache && (f.MaxIndexEntries <= 0 || n <= f.MaxIndexEntries)
+}
+
+// IndexSize returns the number of entries in the cached listing of the archive,
+// including implicit directories, or 0 if nothing is cached.
+func (f ArchiveFS) IndexSize() int {
+	if f.cache == nil {
+		return 0
+	}
+
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	if f.cache.zipReader != nil {
+		return len(f.cache.zipReader.File)
+	}
+
+	return len(f.cache.files)
+}
+
+// InvalidateCache discards the cached listing of the archive,
+// so that it is read again on the next call.
+func (f ArchiveFS) InvalidateCache() {
+	if f.cache == nil {
+		return
+	}
+
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	f.cache.files = nil
+	f.cache.zipReader = nil
+}
+
 func (cf compressedFile) Read(p []byte) (int, error) {
 	return cf.decomp.Read(p)
 }
 
+func (cf compressedFile) Stat() (fs.FileInfo, error) {
+	info, err := cf.File.Stat()
+	if err != nil || cf.name == "" {
+		return info, err
+	}
+
+	return renamedFileInfo{info, cf.name}, nil
+}
+
 func (cf compressedFile) Close() (err error) {
 	err = cf.File.Close()
 	if err == nil {
@@ -605,7 +806,12 @@ func (f FileFS) Open(name string) (fs.File, error) {
 		return nil, err
 	}
 
-	return compressedFile{file, r}, nil
+	cf := compressedFile{File: file, decomp: r}
+	if f.DecompressedName {
+		cf.name = f.decompressedName()
+	}
+
+	return cf, nil
 }
 
 // ReadDir returns a directory listing with the file as the singular entry.
@@ -628,19 +834,46 @@ func (f FileFS) Stat(name string) (fs.FileInfo, error) {
 		return nil, err
 	}
 
-	return os.Stat(f.Path)
+	info, err := os.Stat(f.Path)
+	if err != nil || !f.DecompressedName || f.Compression == nil {
+		return info, err
+	}
+
+	return renamedFileInfo{info, f.decompressedName()}, nil
 }
 
+// checkName returns an error if name is neither "." nor the name of the file,
+// which may also be its name without the extension of the compression format.
 func (f FileFS) checkName(name, op string) error {
 	if !fs.ValidPath(name) {
 		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
 	}
 
-	if name != "." && name != path.Base(f.Path) {
-		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	if name == "." || name == path.Base(f.Path) {
+		return nil
+	}
+	if f.Compression != nil && name == f.decompressedName() {
+		return nil
 	}
 
-	return nil
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// decompressedName returns the name of the file without the extension of its compression format,
+// or the name of the file if it does not have it.
+func (f FileFS) decompressedName() string {
+	name := path.Base(filepath.ToSlash(f.Path))
+	format, ok := f.Compression.(Format)
+	if !ok {
+		return name
+	}
+
+	ext := format.Name()
+	if len(name) > len(ext) && strings.EqualFold(name[len(name)-len(ext):], ext) {
+		return name[:len(name)-len(ext)]
+	}
+
+	return name
 }
 
 // FileSystem opens a file in the root as a read-only file system.
@@ -693,7 +926,12 @@ func FileSystem(ctx context.Context, root string) (fs.FS, error) {
 
 			return zip.NewReader(file, info.Size())
 		case Archival:
-			return ArchiveFS{Path: root, Format: ff, Context: ctx}, nil
+			// the following volumes of a multi-volume RAR archive are found by the name of the first one
+			if r, ok := ff.(Rar); ok {
+				r.MultiVolumePath = root
+				ff = r
+			}
+			return ArchiveFS{Path: root, Format: ff, Context: ctx, cache: new(archiveFSCache)}, nil
 		case Compression:
 			return FileFS{Path: root, Compression: ff}, nil
 		}
@@ -703,6 +941,31 @@ func FileSystem(ctx context.Context, root string) (fs.FS, error) {
 	return FileFS{Path: root}, nil
 }
 
+// CompressedFileFS returns a FileFS for the compressed file at path that transparently decompresses it,
+// with the compression format identified from the file. It returns an error if the file is not compressed,
+// or if it is an archive, compressed or not, which ArchiveFS or FileSystem are for.
+func CompressedFileFS(path string) (fs.FS, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	format, _, err := Identify(filepath.Base(path), file)
+	if err != nil {
+		return nil, fmt.Errorf("identifying compression of %s: %w", path, err)
+	}
+
+	switch ff := format.(type) {
+	case Archival:
+		return nil, fmt.Errorf("%s is a %s archive, not a compressed file", path, format.Name())
+	case Compression:
+		return FileFS{Path: path, Compression: ff}, nil
+	default:
+		return nil, fmt.Errorf("%s is not a compressed file", path)
+	}
+}
+
 // TopDirOpen is a special Open() function, which can be useful if the file system root was created when the archive was extracted.
 // It first tries the file name as given, but if this returns an error, it tries the name without the first path element.
 // In other words, if "a/b/c" returns an error, it will try "b/c" instead.
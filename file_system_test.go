@@ -1,16 +1,24 @@
 package compressor
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math/rand"
 	"net/http"
+	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/pchchv/golog"
 )
@@ -177,3 +185,539 @@ func TestArchiveFS_ReadDir(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkArchiveFS_WalkDir(b *testing.B) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for i := 0; i < 1000; i++ {
+		w, err := zw.Create(fmt.Sprintf("dir%d/sub%d/file%d.txt", i%10, i%100, i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write([]byte("content")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, bc := range []struct {
+		name   string
+		format Archival
+		cached bool
+	}{
+		// hiding the Zip type disables the index and walks the archive on every call
+		{name: "Extract", format: struct{ Zip }{}},
+		{name: "Index", format: Zip{}, cached: true},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fsys := ArchiveFS{
+					Stream: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+					Format: bc.format,
+				}
+				if bc.cached {
+					fsys = NewCachedArchiveFS(fsys)
+				}
+				err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// countingReaderAt counts the bytes read from the underlying reader.
+type countingReaderAt struct {
+	io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.ReaderAt.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestArchiveFS_Cache(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"a/1.txt", "a/2.txt", "b/3.txt"} {
+		content := []byte("content of " + name)
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		checkErr(t, err, "writing header")
+		_, err = tw.Write(content)
+		checkErr(t, err, "writing content")
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	counter := &countingReaderAt{ReaderAt: bytes.NewReader(buf.Bytes())}
+	fsys := NewCachedArchiveFS(ArchiveFS{
+		Stream: io.NewSectionReader(counter, 0, int64(buf.Len())),
+		Format: Tar{},
+	})
+
+	_, err := fsys.ReadDir("a")
+	checkErr(t, err, "first ReadDir")
+	read := counter.n
+	if read == 0 {
+		t.Fatalf("expected the archive to be read")
+	}
+
+	entries, err := fsys.ReadDir("a")
+	checkErr(t, err, "second ReadDir")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries but got %d", len(entries))
+	}
+	_, err = fsys.Stat("b/3.txt")
+	checkErr(t, err, "Stat")
+	if counter.n != read {
+		t.Fatalf("expected the listing to be cached, but %d more bytes were read", counter.n-read)
+	}
+
+	fsys.InvalidateCache()
+	_, err = fsys.ReadDir("a")
+	checkErr(t, err, "ReadDir after invalidation")
+	if counter.n == read {
+		t.Fatalf("expected the archive to be read again after invalidation")
+	}
+
+	fsys.DisableCache = true
+	for i := 0; i < 2; i++ {
+		read = counter.n
+		_, err = fsys.ReadDir("b")
+		checkErr(t, err, "ReadDir with disabled cache")
+		if counter.n == read {
+			t.Fatalf("expected the archive to be read on each call with disabled cache")
+		}
+	}
+}
+
+func TestArchiveFS_UncachedStopsEarly(t *testing.T) {
+	// incompressible content makes skipping the last entry cost its full size
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+
+	format := CompressedArchive{Compression: Gz{}, Archival: Tar{}}
+	buf := new(bytes.Buffer)
+	err := format.Archive(context.Background(), buf, FilesFromBytes(time.Now(), map[string][]byte{
+		"a/1.txt":   []byte("content of a/1.txt"),
+		"b/2.txt":   []byte("content of b/2.txt"),
+		"c/big.bin": big,
+	}))
+	checkErr(t, err, "archiving")
+
+	counter := &countingReaderAt{ReaderAt: bytes.NewReader(buf.Bytes())}
+	fsys := ArchiveFS{
+		Stream: io.NewSectionReader(counter, 0, int64(buf.Len())),
+		Format: format,
+	}
+
+	for _, name := range []string{"a/1.txt", "b/2.txt"} {
+		read := counter.n
+		_, err := fsys.Stat(name)
+		checkErr(t, err, "stat %s", name)
+		if counter.n-read >= int64(len(big)) {
+			t.Errorf("stat %s: expected to stop before the last entry, but read %d bytes", name, counter.n-read)
+		}
+
+		read = counter.n
+		f, err := fsys.Open(name)
+		checkErr(t, err, "opening %s", name)
+		checkErr(t, f.Close(), "closing %s", name)
+		if counter.n-read >= int64(len(big)) {
+			t.Errorf("open %s: expected to stop before the last entry, but read %d bytes", name, counter.n-read)
+		}
+	}
+
+	// implicit directories are only known after reading the whole archive
+	info, err := fsys.Stat("c")
+	checkErr(t, err, "stat c")
+	if !info.IsDir() {
+		t.Errorf("expected c to be a directory")
+	}
+}
+
+// openFileDescriptors returns the number of file descriptors open in this process.
+func openFileDescriptors(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open file descriptors: %v", err)
+	}
+	return len(entries)
+}
+
+func TestArchiveFS_OpenDirectoryClosesArchive(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "unordered.zip")
+	err := os.WriteFile(archivePath, unorderZip, 0o644)
+	checkErr(t, err, "writing archive")
+
+	fsys := &ArchiveFS{Path: archivePath, Format: Zip{}}
+
+	before := openFileDescriptors(t)
+	for _, name := range []string{"1", "2", "1"} {
+		f, err := fsys.Open(name)
+		checkErr(t, err, "opening %s", name)
+		info, err := f.Stat()
+		checkErr(t, err, "stat %s", name)
+		if !info.IsDir() {
+			t.Fatalf("%s: expected a directory", name)
+		}
+	}
+
+	if after := openFileDescriptors(t); after != before {
+		t.Errorf("expected %d open file descriptors after opening directories but got %d", before, after)
+	}
+}
+
+func TestArchiveFS_OpenImplicitDirectoriesDoesNotLeak(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "nodir.zip")
+	err := os.WriteFile(archivePath, nodirZIP, 0o644)
+	checkErr(t, err, "writing archive")
+
+	fsys := &ArchiveFS{Path: archivePath, Format: Zip{}}
+
+	before := openFileDescriptors(t)
+	for i := 0; i < 100; i++ {
+		// test/nodir.zip has no directory entries, so all of these are implicit
+		for _, name := range []string{".", ".github", ".github/workflows", "cmd", "cmd/arc"} {
+			f, err := fsys.Open(name)
+			checkErr(t, err, "opening %s", name)
+			f.Close()
+		}
+	}
+
+	if after := openFileDescriptors(t); after != before {
+		t.Errorf("expected %d open file descriptors after opening directories but got %d", before, after)
+	}
+}
+
+func TestCompressedFileFS(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("decompressed content")
+
+	gzPath := filepath.Join(dir, "file.txt.gz")
+	err := os.WriteFile(gzPath, compress(t, ".gz", content, Gz{}.OpenWriter), 0o644)
+	checkErr(t, err, "writing compressed file")
+
+	fsys, err := CompressedFileFS(gzPath)
+	checkErr(t, err, "creating file system")
+	got, err := fs.ReadFile(fsys, "file.txt.gz")
+	checkErr(t, err, "reading file")
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected %q but got %q", content, got)
+	}
+
+	zipPath := filepath.Join(dir, "test.zip")
+	err = os.WriteFile(zipPath, testZIP, 0o644)
+	checkErr(t, err, "writing archive")
+	if _, err := CompressedFileFS(zipPath); err == nil {
+		t.Errorf("expected an error for an archive")
+	}
+
+	plainPath := filepath.Join(dir, "plain.txt")
+	err = os.WriteFile(plainPath, content, 0o644)
+	checkErr(t, err, "writing plain file")
+	if _, err := CompressedFileFS(plainPath); err == nil {
+		t.Errorf("expected an error for an uncompressed file")
+	}
+}
+
+func TestArchiveFS_IndexSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := Tar{}.Archive(context.Background(), buf, FilesFromBytes(time.Now(), map[string][]byte{
+		"a/1.txt": []byte("1"),
+		"a/2.txt": []byte("2"),
+		"b/3.txt": []byte("3"),
+	}))
+	checkErr(t, err, "archiving")
+
+	for _, tc := range []struct {
+		maxEntries int
+		cached     bool
+	}{
+		{maxEntries: 0, cached: true},
+		{maxEntries: 5, cached: true},
+		{maxEntries: 4, cached: false},
+	} {
+		fsys := NewCachedArchiveFS(ArchiveFS{
+			Stream:          io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())),
+			Format:          Tar{},
+			MaxIndexEntries: tc.maxEntries,
+		})
+		if size := fsys.IndexSize(); size != 0 {
+			t.Fatalf("expected an empty index before use but got %d entries", size)
+		}
+
+		var walked int
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != "." {
+				walked++
+			}
+			return nil
+		})
+		checkErr(t, err, "walking")
+		if walked != 5 {
+			t.Fatalf("expected to walk 3 files and 2 directories but got %d entries", walked)
+		}
+
+		want := 0
+		if tc.cached {
+			want = walked
+		}
+		if size := fsys.IndexSize(); size != want {
+			t.Errorf("MaxIndexEntries=%d: expected an index of %d entries but got %d", tc.maxEntries, want, size)
+		}
+
+		// the limit also applies to the sub file systems
+		fsys.InvalidateCache()
+		subFS, err := fsys.Sub("a")
+		checkErr(t, err, "sub")
+		_, err = fs.ReadDir(subFS, ".")
+		checkErr(t, err, "reading sub directory")
+		if size := subFS.(*ArchiveFS).IndexSize(); size != want {
+			t.Errorf("MaxIndexEntries=%d: expected an index of %d entries after Sub but got %d", tc.maxEntries, want, size)
+		}
+	}
+}
+
+func TestArchiveFS_BackslashSeparators(t *testing.T) {
+	// archives written on Windows, whose entries are separated by backslashes
+	names := []string{`dir\`, `dir\sub\a.txt`, `dir\b.txt`}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(name))}
+		if name == `dir\` {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}
+		}
+		checkErr(t, tw.WriteHeader(hdr), "writing tar header")
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := io.WriteString(tw, name)
+			checkErr(t, err, "writing tar entry")
+		}
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		checkErr(t, err, "creating zip entry")
+		if name != `dir\` {
+			_, err = io.WriteString(w, name)
+			checkErr(t, err, "writing zip entry")
+		}
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	want := []string{"dir/", "dir/sub/a.txt", "dir/b.txt"}
+	for _, tc := range []struct {
+		format Extractor
+		data   []byte
+	}{
+		{format: Tar{}, data: tarBuf.Bytes()},
+		{format: Zip{}, data: zipBuf.Bytes()},
+	} {
+		var got []string
+		err := tc.format.Extract(context.Background(), bytes.NewReader(tc.data), []string{"dir"}, func(ctx context.Context, f File) error {
+			got = append(got, f.FileName)
+			if f.FileName == "dir/" && !f.IsDir() {
+				t.Errorf("%T: expected %s to be a directory", tc.format, f.FileName)
+			}
+			return nil
+		})
+		checkErr(t, err, "%T: extracting", tc.format)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: expected %v but got %v", tc.format, want, got)
+		}
+	}
+
+	fsys := &ArchiveFS{Stream: io.NewSectionReader(bytes.NewReader(tarBuf.Bytes()), 0, int64(tarBuf.Len())), Format: Tar{}}
+	for _, tc := range []struct {
+		dir  string
+		want []string
+	}{
+		{dir: ".", want: []string{"dir"}},
+		{dir: "dir", want: []string{"b.txt", "sub"}},
+		{dir: "dir/sub", want: []string{"a.txt"}},
+	} {
+		entries, err := fsys.ReadDir(tc.dir)
+		checkErr(t, err, "reading directory %s", tc.dir)
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Name())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected entries %v but got %v", tc.dir, tc.want, got)
+		}
+	}
+}
+
+func TestArchiveFS_OpenFromStream(t *testing.T) {
+	// encrypted entries are read with Extract instead of archive/zip's file system,
+	// which requires the stream to be an io.ReaderAt and io.Seeker
+	stream := io.NewSectionReader(bytes.NewReader(testAESZip), 0, int64(len(testAESZip)))
+	fsys := &ArchiveFS{Stream: stream, Format: Zip{Password: "golang"}}
+
+	for name, want := range map[string]string{"hello.txt": "hello", "world.txt": "world"} {
+		// twice, since the stream is shared by the passes over the archive
+		for i := 0; i < 2; i++ {
+			b, err := fs.ReadFile(fsys, name)
+			checkErr(t, err, "reading %s", name)
+			if string(b) != want {
+				t.Errorf("%s: expected %q but got %q", name, want, b)
+			}
+		}
+	}
+
+	info, err := fs.Stat(fsys, "world.txt")
+	checkErr(t, err, "stat world.txt")
+	if info.Size() != int64(len("world")) {
+		t.Errorf("expected size %d but got %d", len("world"), info.Size())
+	}
+}
+
+func TestArchiveFS_OpenFromPath(t *testing.T) {
+	// without a Stream, the archive opened from Path is what gets extracted
+	fsys := &ArchiveFS{Path: "test/test.zip", Format: Zip{}}
+
+	b, err := fs.ReadFile(fsys, "go.mod")
+	checkErr(t, err, "reading go.mod")
+	if len(b) == 0 {
+		t.Error("expected go.mod to have contents")
+	}
+}
+
+func TestArchiveFS_StatSize(t *testing.T) {
+	// a tar.gz written to disk, since the fixtures have no tarball
+	tarGzPath := filepath.Join(t.TempDir(), "test.tar.gz")
+	tarGzFile, err := os.Create(tarGzPath)
+	checkErr(t, err, "creating tar.gz")
+	tarGz := CompressedArchive{Compression: Gz{}, Archival: Tar{}}
+	err = tarGz.Archive(context.Background(), tarGzFile, FilesFromBytes(time.Now(), map[string][]byte{
+		"dir/data.txt": bytes.Repeat([]byte("0123456789"), 1000),
+	}))
+	checkErr(t, err, "archiving tar.gz")
+	checkErr(t, tarGzFile.Close(), "closing tar.gz")
+
+	zipData, err := os.ReadFile("test/test.zip")
+	checkErr(t, err, "reading zip")
+
+	for _, tc := range []struct {
+		name string
+		fsys *ArchiveFS
+		file string
+		size int64
+	}{
+		{name: "zip", fsys: &ArchiveFS{Path: "test/test.zip", Format: Zip{}}, file: "go.mod", size: 461},
+		{name: "zip stream", fsys: &ArchiveFS{Stream: io.NewSectionReader(bytes.NewReader(zipData), 0, int64(len(zipData))), Format: Zip{}}, file: "go.mod", size: 461},
+		{name: "tar.gz", fsys: &ArchiveFS{Path: tarGzPath, Format: tarGz}, file: "dir/data.txt", size: 10000},
+		{name: "7z", fsys: &ArchiveFS{Path: "test/test.7z", Format: SevenZip{}}, file: "foo", size: 4},
+	} {
+		f, err := tc.fsys.Open(tc.file)
+		checkErr(t, err, "%s: opening %s", tc.name, tc.file)
+
+		info, err := f.Stat()
+		checkErr(t, err, "%s: stat %s", tc.name, tc.file)
+		if info.Size() != tc.size {
+			t.Errorf("%s: expected size %d but got %d", tc.name, tc.size, info.Size())
+		}
+
+		b, err := io.ReadAll(f)
+		checkErr(t, err, "%s: reading %s", tc.name, tc.file)
+		if int64(len(b)) != info.Size() {
+			t.Errorf("%s: read %d bytes but the size is %d", tc.name, len(b), info.Size())
+		}
+		checkErr(t, f.Close(), "%s: closing %s", tc.name, tc.file)
+	}
+}
+
+func TestFileFS_DecompressedName(t *testing.T) {
+	const want = `{"name":"gopher","tags":["go","archive"]}` + "\n"
+
+	fsys := FileFS{Path: filepath.Join("test", "data.json.gz"), Compression: Gz{}, DecompressedName: true}
+
+	entries, err := fsys.ReadDir(".")
+	checkErr(t, err, "reading directory")
+	if len(entries) != 1 || entries[0].Name() != "data.json" {
+		t.Fatalf("expected data.json to be the only entry but got %v", entries)
+	}
+
+	// both the decompressed and the compressed name refer to the decompressed content
+	for _, name := range []string{"data.json", "data.json.gz", "."} {
+		if name != "." {
+			got, err := fs.ReadFile(fsys, name)
+			checkErr(t, err, "reading %s", name)
+			if string(got) != want {
+				t.Errorf("%s: expected %q but got %q", name, want, got)
+			}
+		}
+
+		info, err := fsys.Stat(name)
+		checkErr(t, err, "stat %s", name)
+		if info.Name() != "data.json" {
+			t.Errorf("%s: expected the name data.json but got %s", name, info.Name())
+		}
+	}
+
+	f, err := fsys.Open("data.json")
+	checkErr(t, err, "opening")
+	defer f.Close()
+	info, err := f.Stat()
+	checkErr(t, err, "stat of opened file")
+	if info.Name() != "data.json" {
+		t.Errorf("expected the opened file to be named data.json but got %s", info.Name())
+	}
+
+	if _, err := fsys.Open("data"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for another name but got %v", err)
+	}
+
+	// without the option, the file keeps its name, but can still be opened by the decompressed one
+	fsys.DecompressedName = false
+	info, err = fsys.Stat(".")
+	checkErr(t, err, "stat")
+	if info.Name() != "data.json.gz" {
+		t.Errorf("expected the name data.json.gz but got %s", info.Name())
+	}
+	got, err := fs.ReadFile(fsys, "data.json")
+	checkErr(t, err, "reading data.json")
+	if string(got) != want {
+		t.Errorf("expected %q but got %q", want, got)
+	}
+}
+
+func TestArchiveFS_OpenSingleEntry(t *testing.T) {
+	contents := map[string][]byte{
+		"a.txt":     []byte("file a"),
+		"dir/b.txt": []byte("file b"),
+		"z.txt":     []byte("file z"),
+	}
+
+	for _, format := range []Archival{Tar{}, Zip{}} {
+		var buf bytes.Buffer
+		err := format.Archive(context.Background(), &buf, FilesFromBytes(time.Now(), contents))
+		checkErr(t, err, "%s: archiving", format.Name())
+
+		fsys := &ArchiveFS{Stream: io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), Format: format}
+		for name, want := range contents {
+			got, err := fs.ReadFile(fsys, name)
+			checkErr(t, err, "%s: reading %s", format.Name(), name)
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: expected %q in %s but got %q", format.Name(), want, name, got)
+			}
+		}
+	}
+}
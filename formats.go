@@ -6,7 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // MatchResult returns true if the format was found either by name, by stream, or by both parameters.
@@ -19,6 +27,33 @@ type MatchResult struct {
 	ByStream bool
 }
 
+// Kind is the kind of format identified by IdentifyKind.
+type Kind int
+
+const (
+	// KindUnknown means that no format matched.
+	KindUnknown Kind = iota
+	// KindCompression is a compression format, such as Gz.
+	KindCompression
+	// KindArchive is an archive format, such as Tar.
+	KindArchive
+	// KindCompressedArchive is a CompressedArchive, such as a tar.gz.
+	KindCompressedArchive
+)
+
+// IdentifyOptions are hints for identifying the format of a stream.
+type IdentifyOptions struct {
+	// Name of the file, whose extension is matched.
+	Filename string
+
+	// MIME type of the stream, e.g. the Content-Type of an HTTP response.
+	MimeType string
+}
+
+// sfxSearchLimit is the number of leading bytes that are searched for an archive signature
+// when self-extracting archives are allowed. Executable stubs are usually much smaller than this.
+const sfxSearchLimit = 1 << 20
+
 // rewindReader is a reader that can be rewound (reset) to re-read what has already been read
 // and then continue reading further from the main stream. When rewind is no longer needed,
 // call reader() to get a new reader that first reads the buffered bytes and then continues reading from the stream.
@@ -29,6 +64,31 @@ type rewindReader struct {
 	bufReader io.Reader
 }
 
+// cancelableReader reads from r in another goroutine, so that a read blocking on a slow stream
+// can be given up once ctx is done. After that, r may still be read from until the read returns.
+type cancelableReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// readResult is the outcome of a call to Read.
+type readResult struct {
+	n   int
+	err error
+}
+
+// identifyStream is a stream that the formats are matched against one after the other,
+// which is rewound after each of them.
+type identifyStream interface {
+	io.Reader
+	rewind()
+}
+
+// sectionStream is an identifyStream that reads a file with ReadAt, which needs no buffering to be rewound.
+type sectionStream struct {
+	*io.SectionReader
+}
+
 // CompressedArchive combines a compression format on top of an archive format (e.g. "tar.gz")
 // and provides both functionalities in a single type.
 // This ensures that archive functions are wrapped by compressors and decompressors.
@@ -40,11 +100,91 @@ type rewindReader struct {
 type CompressedArchive struct {
 	Compression
 	Archival
+
+	// If true, Extract checks whether the input can actually be decompressed,
+	// and if not, but the archive format matches the raw input (e.g. an
+	// uncompressed tarball named .tar.gz), extracts it without decompression.
+	AutoDetectCompression bool
+
+	// If greater than 0, Archive flushes the compressor this often while the archive is being written,
+	// along with output if it has a Flush method, like http.ResponseWriter and bufio.Writer do.
+	// This way a streamed archive, e.g. an HTTP response with chunked transfer encoding,
+	// reaches the reader in pieces instead of once the compressor's buffers are full,
+	// at the cost of some compression. Compressors without a Flush method are not flushed.
+	FlushInterval time.Duration
+
+	// If true, Archive flushes the compressor, and output like with FlushInterval, after each file,
+	// so that a reader of the streamed archive gets every file as soon as it is written,
+	// at the cost of some compression. It requires an archive format that implements ArchiverAsync,
+	// like Tar and Zip, which tells when a file is done by taking the next one; other formats are not flushed.
+	FlushEachFile bool
+}
+
+// periodicFlusher writes to a compressor and flushes it, and the output it writes to,
+// at regular intervals if anything was written since the last flush.
+type periodicFlusher struct {
+	mu      sync.Mutex
+	w       io.Writer // the compressor
+	output  io.Writer
+	pending bool // whether anything was written since the last flush
+	err     error
+	quit    chan struct{}
+	done    chan struct{}
 }
 
 var (
 	// Registered formats.
 	formats = make(map[string]Format)
+	// Names of the registered formats by descending priority and then in the order they were registered,
+	// which is the order in which Identify tries them.
+	formatNames      []string
+	formatPriorities = make(map[string]int)
+
+	errNoFormatsMatched = errors.New("no formats matched")
+
+	// MIME types and the names of the formats they stand for;
+	// compressed archives stand for both of their formats.
+	mimeTypes = map[string][]string{
+		"application/gzip":                  {".gz"},
+		"application/x-gzip":                {".gz"},
+		"application/x-bzip2":               {".bz2"},
+		"application/x-xz":                  {".xz"},
+		"application/zstd":                  {".zst"},
+		"application/x-lz4":                 {".lz4"},
+		"application/x-lzma":                {".lzma"},
+		"application/x-compress":            {".Z"},
+		"application/zlib":                  {".zz"},
+		"application/x-snappy-framed":       {".sz"},
+		"application/x-brotli":              {".br"},
+		"application/x-tar":                 {".tar"},
+		"application/zip":                   {".zip"},
+		"application/x-zip-compressed":      {".zip"},
+		"application/x-7z-compressed":       {".7z"},
+		"application/vnd.rar":               {".rar"},
+		"application/x-rar-compressed":      {".rar"},
+		"application/x-compressed-tar":      {".gz", ".tar"},
+		"application/x-bzip-compressed-tar": {".bz2", ".tar"},
+		"application/x-xz-compressed-tar":   {".xz", ".tar"},
+		"application/x-zstd-compressed-tar": {".zst", ".tar"},
+	}
+
+	// the MIME types MimeType returns for the formats, by name
+	formatMimeTypes = map[string]string{
+		".gz":   "application/gzip",
+		".bz2":  "application/x-bzip2",
+		".xz":   "application/x-xz",
+		".zst":  "application/zstd",
+		".lz4":  "application/x-lz4",
+		".lzma": "application/x-lzma",
+		".Z":    "application/x-compress",
+		".zz":   "application/zlib",
+		".sz":   "application/x-snappy-framed",
+		".br":   "application/x-brotli",
+		".tar":  "application/x-tar",
+		".zip":  "application/zip",
+		".7z":   "application/x-7z-compressed",
+		".rar":  "application/vnd.rar",
+	}
 
 	// Interface guards
 	_ Format    = (*CompressedArchive)(nil)
@@ -115,6 +255,45 @@ func (rr *rewindReader) reader() io.Reader {
 	return io.MultiReader(bytes.NewReader(rr.buf.Bytes()), rr.Reader)
 }
 
+func (cr *cancelableReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// the goroutine reads into its own buffer, since it may outlive this call
+	buf := make([]byte, len(p))
+	results := make(chan readResult, 1)
+	go func() {
+		n, err := cr.r.Read(buf)
+		results <- readResult{n, err}
+	}()
+
+	select {
+	case res := <-results:
+		return copy(p, buf[:res.n]), res.err
+	case <-cr.ctx.Done():
+		return 0, cr.ctx.Err()
+	}
+}
+
+func (s sectionStream) rewind() {
+	s.Seek(0, io.SeekStart)
+}
+
+// NewCompressedArchive returns a CompressedArchive of the archive format a compressed with c,
+// or an error if either of them is missing, instead of the errors and panics of the methods of an incomplete one.
+// Since Archival includes Extractor, the result can always be used for extraction as well.
+func NewCompressedArchive(c Compression, a Archival) (CompressedArchive, error) {
+	if c == nil {
+		return CompressedArchive{}, errors.New("compressed archive: missing compression format")
+	}
+	if a == nil {
+		return CompressedArchive{}, errors.New("compressed archive: missing archive format")
+	}
+
+	return CompressedArchive{Compression: c, Archival: a}, nil
+}
+
 // Name returns a concatenation of the archive format name and the compression format name.
 func (caf CompressedArchive) Name() string {
 	var name string
@@ -134,6 +313,19 @@ func (caf CompressedArchive) Name() string {
 	return name
 }
 
+// CompressionFormat returns the compression format of the archive, e.g. Gz for a .tar.gz file,
+// or nil if it is not compressed. It is the same as the embedded Compression,
+// but does not require the caller to know that the format is a CompressedArchive.
+func (caf CompressedArchive) CompressionFormat() Compression {
+	return caf.Compression
+}
+
+// ArchiveFormat returns the archive format of the archive, e.g. Tar for a .tar.gz file,
+// or nil if it is only compressed. It is the same as the embedded Archival.
+func (caf CompressedArchive) ArchiveFormat() Archival {
+	return caf.Archival
+}
+
 // Match matches if the input matches both the compression and archive format.
 func (caf CompressedArchive) Match(filename string, stream io.Reader) (MatchResult, error) {
 	var conglomerate MatchResult
@@ -178,43 +370,357 @@ func (caf CompressedArchive) Match(filename string, stream io.Reader) (MatchResu
 }
 
 // Archive adds files to the output archive while compressing the result.
-func (caf CompressedArchive) Archive(ctx context.Context, output io.Writer, files []File) error {
+// The error of closing the compressor, which may fail to write the rest of the output, is returned
+// unless archiving failed.
+func (caf CompressedArchive) Archive(ctx context.Context, output io.Writer, files []File) (err error) {
 	if caf.Compression != nil {
-		wc, err := caf.Compression.OpenWriter(output)
-		if err != nil {
-			return err
+		wc, openErr := caf.Compression.OpenWriter(output)
+		if openErr != nil {
+			return openErr
 		}
 
-		defer wc.Close()
-		output = wc
+		defer closeAndKeepError(wc, &err)
+
+		if caf.FlushInterval > 0 || caf.FlushEachFile {
+			pf := newPeriodicFlusher(wc, output, caf.FlushInterval)
+			defer pf.stop() // before closing the compressor
+			output = pf
+
+			if aa, ok := caf.Archival.(ArchiverAsync); ok && caf.FlushEachFile {
+				return archiveFlushingEachFile(ctx, aa, pf, files)
+			}
+		} else {
+			output = wc
+		}
 	}
 	return caf.Archival.Archive(ctx, output, files)
 }
 
+// closeAndKeepError closes c and sets *err to the error of closing it if *err is nil.
+func closeAndKeepError(c io.Closer, err *error) {
+	if closeErr := c.Close(); *err == nil {
+		*err = closeErr
+	}
+}
+
+// archiveFlushingEachFile archives files to pf with the ArchiveAsync method of archiver, passing them
+// over an unbuffered channel, so that once the archiver takes a file, the previous one is written and pf is flushed.
+// The flush may happen while the archiver writes the next file, which the lock of pf takes care of.
+func archiveFlushingEachFile(ctx context.Context, archiver ArchiverAsync, pf *periodicFlusher, files []File) error {
+	filesChan := make(chan File)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- archiver.ArchiveAsync(ctx, pf, filesChan)
+	}()
+
+	for _, file := range files {
+		select {
+		case filesChan <- file:
+			pf.flush()
+		case err := <-errChan:
+			// the archiver stopped before taking all of the files
+			close(filesChan)
+			return err
+		}
+	}
+	close(filesChan)
+
+	return <-errChan
+}
+
 // Extract reads files out of an archive while decompressing the results.
-func (caf CompressedArchive) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error {
+// The error of closing the decompressor is returned unless extracting failed.
+func (caf CompressedArchive) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) (err error) {
+	if caf.Compression != nil && caf.AutoDetectCompression {
+		rr := newRewindReader(sourceArchive)
+		if err := caf.decompressionError(rr); err != nil {
+			rr.rewind()
+			mr, matchErr := caf.Archival.Match("", rr)
+			if matchErr != nil || !mr.ByStream {
+				return fmt.Errorf("input is not %s compressed: %w", caf.Compression.Name(), err)
+			}
+
+			rr.rewind()
+			return caf.Archival.(Extractor).Extract(ctx, rr.reader(), pathsInArchive, handleFile)
+		}
+
+		rr.rewind()
+		sourceArchive = rr.reader()
+	}
+
 	if caf.Compression != nil {
-		rc, err := caf.Compression.OpenReader(sourceArchive)
-		if err != nil {
-			return err
+		rc, openErr := caf.Compression.OpenReader(sourceArchive)
+		if openErr != nil {
+			return openErr
 		}
 
-		defer rc.Close()
+		defer closeAndKeepError(rc, &err)
 		sourceArchive = rc
 	}
 	return caf.Archival.(Extractor).Extract(ctx, sourceArchive, pathsInArchive, handleFile)
 }
 
-// RegisterFormat registers the format.
+// newPeriodicFlusher returns a writer to w, which writes to output, that flushes both every interval
+// until stop is called. If interval is not positive, it is only flushed when its flush method is called.
+func newPeriodicFlusher(w, output io.Writer, interval time.Duration) *periodicFlusher {
+	pf := &periodicFlusher{
+		w:      w,
+		output: output,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if interval <= 0 {
+		close(pf.done)
+		return pf
+	}
+
+	go func() {
+		defer close(pf.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-pf.quit:
+				return
+			case <-ticker.C:
+				pf.flush()
+			}
+		}
+	}()
+
+	return pf
+}
+
+func (pf *periodicFlusher) Write(p []byte) (int, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.err != nil {
+		return 0, pf.err
+	}
+
+	pf.pending = true
+	return pf.w.Write(p)
+}
+
+// flush flushes the compressor and the output if anything was written since the last flush.
+// An error is returned by the next write.
+func (pf *periodicFlusher) flush() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if !pf.pending || pf.err != nil {
+		return
+	}
+	pf.pending = false
+
+	if f, ok := pf.w.(interface{ Flush() error }); ok {
+		if pf.err = f.Flush(); pf.err != nil {
+			return
+		}
+	}
+
+	switch f := pf.output.(type) {
+	case interface{ Flush() error }:
+		pf.err = f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+}
+
+// stop stops flushing and waits until a flush in progress is done.
+func (pf *periodicFlusher) stop() {
+	close(pf.quit)
+	<-pf.done
+}
+
+// decompressionError returns the error, if any, of opening the decompressor
+// on r and reading the first byte from it.
+func (caf CompressedArchive) decompressionError(r io.Reader) error {
+	rc, err := caf.Compression.OpenReader(r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := io.ReadFull(rc, make([]byte, 1)); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// CountingDecompressor wraps a compression format and counts the compressed bytes read
+// and the decompressed bytes produced by the readers it opens, e.g. to report the progress
+// of extracting a CompressedArchive whose compression layer it is.
+// The counts accumulate over all opened readers and can be read while they are in use.
+// Use NewCountingDecompressor to create one.
+type CountingDecompressor struct {
+	Compression
+
+	compressed   *int64
+	decompressed *int64
+}
+
+// countingReader adds the number of bytes read to n.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+// NewCountingDecompressor returns a CountingDecompressor wrapping the decompressor of compression.
+func NewCountingDecompressor(compression Compression) CountingDecompressor {
+	return CountingDecompressor{
+		Compression:  compression,
+		compressed:   new(int64),
+		decompressed: new(int64),
+	}
+}
+
+func (cd CountingDecompressor) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	rc, err := cd.Compression.OpenReader(countingReader{r, cd.compressed})
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{countingReader{rc, cd.decompressed}, rc}, nil
+}
+
+// CompressedBytes returns the number of compressed bytes read so far.
+func (cd CountingDecompressor) CompressedBytes() int64 {
+	return atomic.LoadInt64(cd.compressed)
+}
+
+// DecompressedBytes returns the number of decompressed bytes produced so far.
+func (cd CountingDecompressor) DecompressedBytes() int64 {
+	return atomic.LoadInt64(cd.decompressed)
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// RegisterFormat registers the format with priority 0.
 // It must be called during init.
-// Duplicate formats by name are not allowed and will cause a panic.
+// Duplicate formats by name are not allowed and will cause a panic; see ReplaceFormat.
+// Formats are tried by Identify in the order they were registered.
 func RegisterFormat(format Format) {
-	name := strings.Trim(strings.ToLower(format.Name()), ".")
+	RegisterFormatWithPriority(format, 0)
+}
+
+// RegisterFormatWithPriority is like RegisterFormat, but Identify tries formats with a higher priority
+// before those with a lower one, and formats of the same priority in the order they were registered.
+// Since the first format matched by stream wins, this resolves formats whose headers overlap,
+// e.g. a format for a particular kind of zstd stream can take precedence over Zstd with a positive priority.
+// The built-in formats have priority 0.
+func RegisterFormatWithPriority(format Format, priority int) {
+	name := formatKey(format.Name())
 	if _, ok := formats[name]; ok {
 		panic("format " + name + " is already registered")
 	}
 
 	formats[name] = format
+	formatPriorities[name] = priority
+
+	// insert after the formats of the same or a higher priority
+	i := sort.Search(len(formatNames), func(i int) bool {
+		return formatPriorities[formatNames[i]] < priority
+	})
+	formatNames = append(formatNames, "")
+	copy(formatNames[i+1:], formatNames[i:])
+	formatNames[i] = name
+}
+
+// ReplaceFormat registers the format in place of the registered format of the same name,
+// e.g. to use a customized Zip for the ".zip" format, keeping its priority and its place in the order
+// in which Identify tries the formats. If there is no such format, it is registered like with RegisterFormat.
+// Like RegisterFormat, it must not be called concurrently with Identify or any other use of the registered formats.
+func ReplaceFormat(format Format) {
+	name := formatKey(format.Name())
+	if _, ok := formats[name]; !ok {
+		RegisterFormat(format)
+		return
+	}
+
+	formats[name] = format
+}
+
+// UnregisterFormat removes the format with the given name, e.g. ".zip", so that Identify no longer returns it.
+// Names are matched case-insensitively, with or without the leading dot. Unknown names are ignored.
+// Like RegisterFormat, it must not be called concurrently with Identify or any other use of the registered formats.
+func UnregisterFormat(name string) {
+	name = formatKey(name)
+	if _, ok := formats[name]; !ok {
+		return
+	}
+
+	delete(formats, name)
+	delete(formatPriorities, name)
+	for i, n := range formatNames {
+		if n == name {
+			formatNames = append(formatNames[:i:i], formatNames[i+1:]...)
+			break
+		}
+	}
+}
+
+// Formats returns the registered formats, sorted by name, e.g. to list them in help text.
+// The returned slice is a copy, which later registrations do not change.
+func Formats() []Format {
+	list := make([]Format, 0, len(formats))
+	for _, format := range formats {
+		list = append(list, format)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+
+	return list
+}
+
+// MimeType returns the MIME type of files in the format f, e.g. for the Content-Type of an HTTP response.
+// A compressed archive has the MIME type of its compression, since that is what its contents are encoded with.
+// Formats can report their own MIME type with a MimeType method; for others without a known MIME type,
+// it is "application/octet-stream".
+func MimeType(f Format) string {
+	if mt, ok := f.(interface{ MimeType() string }); ok {
+		return mt.MimeType()
+	}
+	if caf, ok := f.(CompressedArchive); ok && caf.Compression != nil {
+		return MimeType(caf.Compression)
+	}
+
+	if mimeType, ok := formatMimeTypes[f.Name()]; ok {
+		return mimeType
+	}
+
+	return "application/octet-stream"
+}
+
+// formatKey returns the key of the format with the given name in the registered formats.
+func formatKey(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
+
+// SetContinueOnError sets error tolerance on the format if it implements ErrorTolerant.
+// Reports whether the value was set. Note that the format must be a pointer,
+// since otherwise the change would be lost on a copy.
+func SetContinueOnError(f Format, v bool) bool {
+	et, ok := f.(ErrorTolerant)
+	if ok {
+		et.SetContinueOnError(v)
+	}
+
+	return ok
 }
 
 // Identify goes through the registered formats and returns the one that matches the given file name and/or stream.
@@ -225,65 +731,314 @@ func RegisterFormat(format Format) {
 // The returned io.Reader will always be non-nil and will read from the same point as the passed reader,
 // it should be used instead of the input stream after the Identify() call,
 // because it saves and re-reads bytes that have already been read in the Identify process.
+// A format matched by stream takes precedence over one matched only by name,
+// so that files with a misleading extension are still identified correctly.
+// Among formats that match equally, the one with the highest priority, or else registered first, is returned.
 func Identify(filename string, stream io.Reader) (Format, io.Reader, error) {
-	var compression Compression
-	var archival Archival
+	return IdentifyWithOptions(stream, IdentifyOptions{Filename: filename})
+}
 
+// IdentifyWithOptions is like Identify, but takes hints about the stream in options,
+// such as a MIME type in addition to the file name. A format the MIME type stands for
+// is considered matched by name, so a format matched by stream still takes precedence.
+func IdentifyWithOptions(stream io.Reader, options IdentifyOptions) (Format, io.Reader, error) {
 	rewindableStream := newRewindReader(stream)
+	format, err := identify(rewindableStream, options)
+
+	// the stream should be rewound by identifyOne
+	return format, rewindableStream.reader(), err
+}
+
+// IdentifyReaderAt is like Identify, but reads the file of the given size from r, e.g. an *os.File,
+// with ReadAt. Since the formats can read from wherever they need to, nothing is buffered,
+// and the offset of r, if it has one, is left as it is, so there is no reader to use instead of r.
+func IdentifyReaderAt(filename string, r io.ReaderAt, size int64) (Format, error) {
+	return identify(sectionStream{io.NewSectionReader(r, 0, size)}, IdentifyOptions{Filename: filename})
+}
+
+// IdentifyContext is like Identify, but gives up once ctx is done, even if reading from stream blocks,
+// e.g. because it is a slow network connection, and returns the error of ctx. In that case,
+// a read from stream may still be pending, so neither stream nor the returned reader can be used anymore.
+func IdentifyContext(ctx context.Context, filename string, stream io.Reader) (Format, io.Reader, error) {
+	rewindableStream := newRewindReader(&cancelableReader{ctx: ctx, r: stream})
+	format, err := identify(rewindableStream, IdentifyOptions{Filename: filename})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// formats may ignore errors reading the stream, and report no match instead
+		return nil, rewindableStream.reader(), ctxErr
+	}
+
+	// the rest of the stream is read as it is, without the goroutines
+	rewindableStream.Reader = stream
+	return format, rewindableStream.reader(), err
+}
+
+// identify returns the format of stream as described by IdentifyWithOptions.
+func identify(stream identifyStream, options IdentifyOptions) (Format, error) {
+	var compression, compressionByName Compression
+	var archival, archivalByName Archival
+
+	filename := options.Filename
+	byMimeType := mimeTypeFormats(options.MimeType)
 
 	// try compression format first, since that's the outer "layer"
-	for name, format := range formats {
+	for _, name := range formatNames {
+		format := formats[name]
 		cf, isCompression := format.(Compression)
 		if !isCompression {
 			continue
 		}
 
-		matchResult, err := identifyOne(format, filename, rewindableStream, nil)
+		matchResult, err := identifyOne(format, filename, stream, nil)
 		if err != nil {
-			return nil, rewindableStream.reader(), fmt.Errorf("matching %s: %w", name, err)
+			return nil, fmt.Errorf("matching %s: %w", name, err)
 		}
+		matchResult.ByName = matchResult.ByName || byMimeType[format.Name()]
 
 		// if matched, wrap input stream with decompression
 		// so we can see if it contains an archive within
-		if matchResult.Matched() {
+		if matchResult.ByStream {
 			compression = cf
 			break
 		}
+		if matchResult.ByName && compressionByName == nil {
+			compressionByName = cf
+		}
+	}
+	if compression == nil {
+		compression = compressionByName
 	}
 
 	// try archive format next
-	for name, format := range formats {
+	for _, name := range formatNames {
+		format := formats[name]
 		af, isArchive := format.(Archival)
 		if !isArchive {
 			continue
 		}
 
-		matchResult, err := identifyOne(format, filename, rewindableStream, compression)
+		matchResult, err := identifyOne(format, filename, stream, compression)
 		if err != nil {
-			return nil, rewindableStream.reader(), fmt.Errorf("matching %s: %w", name, err)
+			return nil, fmt.Errorf("matching %s: %w", name, err)
 		}
+		matchResult.ByName = matchResult.ByName || byMimeType[format.Name()]
 
-		if matchResult.Matched() {
+		if matchResult.ByStream {
 			archival = af
 			break
 		}
+		if matchResult.ByName && archivalByName == nil {
+			archivalByName = af
+		}
+	}
+	if archival == nil {
+		archival = archivalByName
 	}
 
-	// the stream should be rewound by identifyOne
-	bufferedStream := rewindableStream.reader()
 	switch {
 	case compression != nil && archival == nil:
-		return compression, bufferedStream, nil
+		return compression, nil
 	case compression == nil && archival != nil:
-		return archival, bufferedStream, nil
+		return archival, nil
 	case compression != nil && archival != nil:
-		return CompressedArchive{compression, archival}, bufferedStream, nil
+		return CompressedArchive{Compression: compression, Archival: archival}, nil
 	default:
-		return nil, bufferedStream, fmt.Errorf("no formats matched")
+		return nil, errNoFormatsMatched
 	}
 }
 
-func identifyOne(format Format, filename string, stream *rewindReader, comp Compression) (mr MatchResult, err error) {
+// IdentifyAll is like Identify, but returns all of the formats that match the given file name and/or stream,
+// including compressed archives, ranked by the strength of their matches: formats matched by stream
+// in more of their layers come first, then those matched by name in more of their layers,
+// and formats that match equally are in the order Identify tries them.
+// This lets callers handle inputs that match several formats, e.g. a tarball named .tar.gz that is not compressed.
+// Combinations of a compression format, matched by name, and an archive format are left out
+// if the stream cannot be decompressed. If no formats match, the returned slice is empty.
+func IdentifyAll(filename string, stream io.Reader) ([]Format, io.Reader, error) {
+	var candidates []identifyCandidate
+	rewindableStream := newRewindReader(stream)
+
+	// no compression, followed by the matching compression formats
+	compressions := []identifyCandidate{{}}
+	for _, name := range formatNames {
+		cf, isCompression := formats[name].(Compression)
+		if !isCompression {
+			continue
+		}
+
+		matchResult, err := identifyOne(cf, filename, rewindableStream, nil)
+		if err != nil {
+			return nil, rewindableStream.reader(), fmt.Errorf("matching %s: %w", name, err)
+		}
+		if matchResult.Matched() {
+			compressions = append(compressions, newIdentifyCandidate(cf, matchResult))
+		}
+	}
+	candidates = append(candidates, compressions[1:]...)
+
+	for _, comp := range compressions {
+		compression, _ := comp.format.(Compression)
+		for _, name := range formatNames {
+			af, isArchive := formats[name].(Archival)
+			if !isArchive {
+				continue
+			}
+
+			matchResult, err := identifyOne(af, filename, rewindableStream, compression)
+			if err != nil && compression != nil {
+				continue // the stream cannot be decompressed with this format after all
+			}
+			if err != nil {
+				return nil, rewindableStream.reader(), fmt.Errorf("matching %s: %w", name, err)
+			}
+			if !matchResult.Matched() {
+				continue
+			}
+
+			candidate := newIdentifyCandidate(af, matchResult)
+			if compression != nil {
+				candidate.format = CompressedArchive{Compression: compression, Archival: af}
+				candidate.byStream += comp.byStream
+				candidate.byName += comp.byName
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].byStream != candidates[j].byStream {
+			return candidates[i].byStream > candidates[j].byStream
+		}
+		return candidates[i].byName > candidates[j].byName
+	})
+
+	matched := make([]Format, len(candidates))
+	for i, candidate := range candidates {
+		matched[i] = candidate.format
+	}
+
+	return matched, rewindableStream.reader(), nil
+}
+
+// identifyCandidate is a format matched by IdentifyAll with the number of its layers matched by stream and by name.
+type identifyCandidate struct {
+	format   Format
+	byStream int
+	byName   int
+}
+
+func newIdentifyCandidate(format Format, mr MatchResult) identifyCandidate {
+	candidate := identifyCandidate{format: format}
+	if mr.ByStream {
+		candidate.byStream++
+	}
+	if mr.ByName {
+		candidate.byName++
+	}
+
+	return candidate
+}
+
+// IdentifyKind is like Identify, but also returns the kind of the format,
+// so that callers can branch on it without type assertions.
+// If no formats match, it returns KindUnknown and a nil format without an error.
+func IdentifyKind(filename string, stream io.Reader) (Kind, Format, io.Reader, error) {
+	format, reader, err := Identify(filename, stream)
+	if errors.Is(err, errNoFormatsMatched) {
+		return KindUnknown, nil, reader, nil
+	}
+	if err != nil {
+		return KindUnknown, nil, reader, err
+	}
+
+	switch format.(type) {
+	case CompressedArchive:
+		return KindCompressedArchive, format, reader, nil
+	case Archival:
+		return KindArchive, format, reader, nil
+	case Compression:
+		return KindCompression, format, reader, nil
+	default:
+		return KindUnknown, format, reader, nil
+	}
+}
+
+// ClassifyFile identifies the format of the file at path on disk and returns its kind,
+// without building a file system for it as FileSystem does. Plain files are of KindUnknown.
+func ClassifyFile(path string) (Kind, Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return KindUnknown, nil, err
+	}
+	defer file.Close()
+
+	kind, format, _, err := IdentifyKind(filepath.Base(path), file)
+	return kind, format, err
+}
+
+// OpenNested extracts the archive at innerPath from the archive in source, read with outer,
+// identifies its format and returns an extractor and a reader for it, which can be passed
+// to its Extract or to OpenNested again to go further down. The inner archive is read into memory,
+// so that zip and 7z archives, which need to seek, can be nested too.
+// If there is no file at innerPath, the error wraps fs.ErrNotExist.
+func OpenNested(ctx context.Context, outer Extractor, source io.Reader, innerPath string) (Extractor, io.Reader, error) {
+	var data []byte
+	var found bool
+	err := outer.Extract(ctx, source, []string{innerPath}, func(ctx context.Context, f File) error {
+		if f.FileName != innerPath || !f.Mode().IsRegular() {
+			return nil
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		data, err = io.ReadAll(rc)
+		found = true
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("extracting %s: %w", innerPath, err)
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("%s: %w", innerPath, fs.ErrNotExist)
+	}
+
+	format, _, err := Identify(innerPath, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("identifying %s: %w", innerPath, err)
+	}
+
+	ex, ok := format.(Extractor)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: format %s is not an archive format", innerPath, format.Name())
+	}
+
+	return ex, bytes.NewReader(data), nil
+}
+
+// mimeTypeFormats returns the names of the formats that mimeType stands for.
+// Parameters of the MIME type are ignored.
+func mimeTypeFormats(mimeType string) map[string]bool {
+	if mimeType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, name := range mimeTypes[mediaType] {
+		names[name] = true
+	}
+
+	return names
+}
+
+func identifyOne(format Format, filename string, stream identifyStream, comp Compression) (mr MatchResult, err error) {
 	defer stream.rewind()
 
 	// if the search is in a compressed format, wrap the stream in a reader
@@ -336,3 +1091,25 @@ func readAtMost(stream io.Reader, n int) ([]byte, error) {
 
 	return buf[:nr], nil
 }
+
+// sfxSection returns a section of ra starting at the first occurrence of sig.
+// Only the first sfxSearchLimit bytes are searched,
+// which allows to skip the executable stub of self-extracting archives.
+func sfxSection(ra io.ReaderAt, size int64, sig []byte) (*io.SectionReader, error) {
+	limit := int64(sfxSearchLimit)
+	if limit > size {
+		limit = size
+	}
+
+	buf, err := readAtMost(io.NewSectionReader(ra, 0, limit), int(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	offset := bytes.Index(buf, sig)
+	if offset < 0 {
+		return nil, fmt.Errorf("archive signature not found in the first %d bytes", limit)
+	}
+
+	return io.NewSectionReader(ra, int64(offset), size-int64(offset)), nil
+}
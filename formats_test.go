@@ -1,13 +1,22 @@
 package compressor
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -122,6 +131,34 @@ func TestIdentifyAndOpenZip(t *testing.T) {
 	checkErr(t, err, "extracting zip")
 }
 
+func TestIdentifyReaderAt(t *testing.T) {
+	f, err := os.Open("test/test.zip")
+	checkErr(t, err, "opening zip")
+	defer f.Close()
+
+	info, err := f.Stat()
+	checkErr(t, err, "statting zip")
+	_, err = f.Seek(10, io.SeekStart)
+	checkErr(t, err, "seeking")
+
+	// the name does not give the format away
+	format, err := IdentifyReaderAt("archive", f, info.Size())
+	checkErr(t, err, "identifying zip")
+	if format.Name() != ".zip" {
+		t.Fatalf("unexpected format found: expected=.zip actual:%s", format.Name())
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	checkErr(t, err, "getting offset")
+	if offset != 10 {
+		t.Errorf("expected the offset of the file to be left at 10 but it is %d", offset)
+	}
+
+	if _, err := IdentifyReaderAt("", bytes.NewReader([]byte("plain text")), 10); !errors.Is(err, errNoFormatsMatched) {
+		t.Errorf("expected no formats to match plain text but got %v", err)
+	}
+}
+
 func TestIdentifyDoesNotMatchContentFromTrimmedKnownHeaderHaving0Suffix(t *testing.T) {
 	// Using the outcome of `n, err := io.ReadFull(stream, buf)` without minding n
 	// may lead to a mis-characterization for cases with known header ending with 0x0
@@ -417,3 +454,1164 @@ func checkErr(t *testing.T, err error, msgFmt string, args ...interface{}) {
 	args = append(args, err)
 	t.Fatalf(msgFmt+": %s", args...)
 }
+
+func TestArchiveContentTransform(t *testing.T) {
+	tempTxtFileName, tempTxtFileInfo := newTempTextFile(t, "this is text")
+	t.Cleanup(func() {
+		os.Remove(tempTxtFileName)
+	})
+
+	// uppercase the contents and add a header, which changes the size
+	upper := func(name string, r io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.MultiReader(strings.NewReader("LICENSE\n"), bytes.NewReader(bytes.ToUpper(b))), nil
+	}
+
+	for _, tc := range []struct {
+		archiver  Archiver
+		extractor Extractor
+	}{
+		{Tar{ContentTransform: upper}, Tar{}},
+		{Zip{ContentTransform: upper}, Zip{}},
+	} {
+		tc := tc
+		t.Run(tc.archiver.(Format).Name(), func(t *testing.T) {
+			archived := archive(t, tc.archiver, tempTxtFileName, tempTxtFileInfo)
+
+			// the transform also applies when extracting, so extract without it
+			var contents string
+			err := tc.extractor.Extract(context.Background(), bytes.NewReader(archived), nil, func(ctx context.Context, f File) error {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+
+				b, err := io.ReadAll(rc)
+				contents = string(b)
+				return err
+			})
+			checkErr(t, err, "extracting")
+			if contents != "LICENSE\nTHIS IS TEXT" {
+				t.Fatalf("expected transformed contents but got '%s'", contents)
+			}
+		})
+	}
+}
+
+func TestArchiveProgress(t *testing.T) {
+	var files []File
+	for i := 1; i <= 3; i++ {
+		name, info := newTempTextFile(t, strings.Repeat("x", i*1000))
+		t.Cleanup(func() {
+			os.Remove(name)
+		})
+		files = append(files, File{
+			FileInfo: info,
+			FileName: fmt.Sprintf("file%d.txt", i),
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(name)
+			},
+		})
+	}
+	const total = 6000
+
+	for _, tc := range []struct {
+		name   string
+		format func(progress func(File, int64, int64)) Archiver
+	}{
+		{
+			name:   "tar",
+			format: func(progress func(File, int64, int64)) Archiver { return Tar{Progress: progress} },
+		},
+		{
+			name:   "zip",
+			format: func(progress func(File, int64, int64)) Archiver { return Zip{Progress: progress} },
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			var last int64
+			progress := func(file File, bytesProcessed, totalBytes int64) {
+				calls++
+				if bytesProcessed <= last {
+					t.Errorf("bytes processed did not increase: %d after %d", bytesProcessed, last)
+				}
+				if totalBytes != total {
+					t.Errorf("expected total of %d bytes but got %d", total, totalBytes)
+				}
+				last = bytesProcessed
+			}
+
+			err := tc.format(progress).Archive(context.Background(), io.Discard, files)
+			checkErr(t, err, "archiving")
+			if calls < len(files) {
+				t.Errorf("expected at least %d calls but got %d", len(files), calls)
+			}
+			if last != total {
+				t.Errorf("expected %d bytes processed in the end but got %d", total, last)
+			}
+		})
+	}
+}
+
+func TestExtractContentTransform(t *testing.T) {
+	tempTxtFileName, tempTxtFileInfo := newTempTextFile(t, "line one\r\nline two\r\n")
+	t.Cleanup(func() {
+		os.Remove(tempTxtFileName)
+	})
+
+	crlfToLF := func(name string, r io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))), nil
+	}
+
+	for _, tc := range []struct {
+		archiver  Archiver
+		extractor Extractor
+	}{
+		{Tar{}, Tar{ContentTransform: crlfToLF}},
+		{Zip{}, Zip{ContentTransform: crlfToLF}},
+	} {
+		tc := tc
+		t.Run(tc.archiver.(Format).Name(), func(t *testing.T) {
+			archived := archive(t, tc.archiver, tempTxtFileName, tempTxtFileInfo)
+
+			dir := t.TempDir()
+			err := tc.extractor.Extract(context.Background(), bytes.NewReader(archived), nil, func(ctx context.Context, f File) error {
+				out, err := os.Create(filepath.Join(dir, f.FileName))
+				if err != nil {
+					return err
+				}
+				defer out.Close()
+
+				return openAndCopyFile(ctx, f, out)
+			})
+			checkErr(t, err, "extracting")
+
+			written, err := os.ReadFile(filepath.Join(dir, "temp.txt"))
+			checkErr(t, err, "reading extracted file")
+			if string(written) != "line one\nline two\n" {
+				t.Fatalf("expected LF line endings but got %q", written)
+			}
+		})
+	}
+}
+
+func TestArchiveOmitDirectoryEntries(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/b/c.txt", "a/d.txt", "e.txt"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(p), 0755), "making parent of %s", name)
+		checkErr(t, os.WriteFile(p, []byte(name), 0644), "writing %s", name)
+	}
+	checkErr(t, os.Mkdir(filepath.Join(dir, "a", "empty"), 0755), "making empty dir")
+
+	files, err := FilesFromDisk(nil, map[string]string{dir: "root"})
+	checkErr(t, err, "getting files from disk")
+
+	for _, tc := range []struct {
+		format   Archival
+		expected []string
+	}{
+		{
+			format:   Tar{OmitDirectoryEntries: true},
+			expected: []string{"root/a/b/c.txt", "root/a/d.txt", "root/e.txt"},
+		},
+		{
+			format:   Zip{OmitDirectoryEntries: true},
+			expected: []string{"root/a/b/c.txt", "root/a/d.txt", "root/e.txt"},
+		},
+		{
+			format:   Tar{OmitDirectoryEntries: true, EmptyDirectorySentinel: ".keep"},
+			expected: []string{"root/a/b/c.txt", "root/a/d.txt", "root/a/empty/.keep", "root/e.txt"},
+		},
+		{
+			format:   Zip{OmitDirectoryEntries: true, EmptyDirectorySentinel: ".keep"},
+			expected: []string{"root/a/b/c.txt", "root/a/d.txt", "root/a/empty/.keep", "root/e.txt"},
+		},
+	} {
+		buf := new(bytes.Buffer)
+		err := tc.format.Archive(context.Background(), buf, files)
+		checkErr(t, err, "%s: archiving", tc.format.Name())
+
+		var names []string
+		err = tc.format.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+			if f.IsDir() {
+				t.Errorf("%s: unexpected directory entry %s", tc.format.Name(), f.FileName)
+			}
+			names = append(names, f.FileName)
+			return nil
+		})
+		checkErr(t, err, "%s: extracting", tc.format.Name())
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("%s: expected %v but got %v", tc.format.Name(), tc.expected, names)
+		}
+	}
+}
+
+func TestIdentifyPrefersStreamOverMisleadingName(t *testing.T) {
+	content := []byte("this is text, not an archive")
+	for _, tc := range []struct {
+		filename string
+		stream   []byte
+		expected string
+	}{
+		{filename: "data.gz", stream: compress(t, ".xz", content, Xz{}.OpenWriter), expected: ".xz"},
+		{filename: "data.xz", stream: compress(t, ".gz", content, Gz{}.OpenWriter), expected: ".gz"},
+	} {
+		// the formats are tried in random order, so try a few times
+		for i := 0; i < 20; i++ {
+			format, _, err := Identify(tc.filename, bytes.NewReader(tc.stream))
+			checkErr(t, err, "identifying %s", tc.filename)
+			if format.Name() != tc.expected {
+				t.Fatalf("%s: expected %s but got %s", tc.filename, tc.expected, format.Name())
+			}
+		}
+	}
+}
+
+func TestArchiveMaxPathDepth(t *testing.T) {
+	name, info := newTempTextFile(t, "deep")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	for _, tc := range []struct {
+		filename string
+		ok       bool
+	}{
+		{filename: "a/b/c.txt", ok: true},
+		{filename: "a/b/c/d.txt", ok: false},
+		{filename: "a/b/c/d/e/f/g/h/i/j.txt", ok: false},
+	} {
+		files := []File{
+			{
+				FileInfo: info,
+				FileName: tc.filename,
+				Open: func() (io.ReadCloser, error) {
+					return os.Open(name)
+				},
+			},
+		}
+
+		for _, format := range []Archiver{
+			Tar{MaxPathDepth: 3},
+			Zip{MaxPathDepth: 3},
+		} {
+			err := format.Archive(context.Background(), io.Discard, files)
+			if tc.ok && err != nil {
+				t.Errorf("%s: %s: expected no error but got %v", format.(Format).Name(), tc.filename, err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("%s: %s: expected the path depth limit to be enforced", format.(Format).Name(), tc.filename)
+			}
+		}
+	}
+}
+
+func TestCompressedArchiveAutoDetectCompression(t *testing.T) {
+	name, info := newTempTextFile(t, "not compressed after all")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	plainTar := archive(t, Tar{}, name, info)
+	gzTar := compress(t, ".gz", plainTar, Gz{}.OpenWriter)
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		format CompressedArchive
+		ok     bool
+	}{
+		{name: "plain tar", stream: plainTar, format: CompressedArchive{Compression: Gz{}, Archival: Tar{}, AutoDetectCompression: true}, ok: true},
+		{name: "gzipped tar", stream: gzTar, format: CompressedArchive{Compression: Gz{}, Archival: Tar{}, AutoDetectCompression: true}, ok: true},
+		{name: "plain tar without auto-detection", stream: plainTar, format: CompressedArchive{Compression: Gz{}, Archival: Tar{}}, ok: false},
+		{name: "garbage", stream: []byte("neither compressed nor an archive"), format: CompressedArchive{Compression: Gz{}, Archival: Tar{}, AutoDetectCompression: true}, ok: false},
+	} {
+		var contents string
+		err := tc.format.Extract(context.Background(), bytes.NewReader(tc.stream), nil, func(ctx context.Context, f File) error {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			b, err := io.ReadAll(rc)
+			contents = string(b)
+			return err
+		})
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		checkErr(t, err, "%s: extracting", tc.name)
+		if contents != "not compressed after all" {
+			t.Errorf("%s: unexpected contents: %q", tc.name, contents)
+		}
+	}
+}
+
+func TestIdentifyKind(t *testing.T) {
+	name, info := newTempTextFile(t, "this is text")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	tarball := archive(t, Tar{}, name, info)
+	for _, tc := range []struct {
+		filename string
+		stream   []byte
+		want     Kind
+		wantName string
+	}{
+		{filename: "data.gz", stream: compress(t, ".gz", []byte("this is text"), Gz{}.OpenWriter), want: KindCompression, wantName: ".gz"},
+		{filename: "data.tar", stream: tarball, want: KindArchive, wantName: ".tar"},
+		{filename: "data.tar.gz", stream: compress(t, ".gz", tarball, Gz{}.OpenWriter), want: KindCompressedArchive, wantName: ".tar.gz"},
+		{filename: "data.txt", stream: []byte("this is text"), want: KindUnknown},
+	} {
+		kind, format, reader, err := IdentifyKind(tc.filename, bytes.NewReader(tc.stream))
+		checkErr(t, err, "identifying %s", tc.filename)
+		if kind != tc.want {
+			t.Errorf("%s: expected kind %d but got %d", tc.filename, tc.want, kind)
+		}
+		if tc.want == KindUnknown {
+			if format != nil {
+				t.Errorf("%s: expected no format but got %s", tc.filename, format.Name())
+			}
+		} else if format == nil || format.Name() != tc.wantName {
+			t.Errorf("%s: expected format %s but got %v", tc.filename, tc.wantName, format)
+		}
+
+		// the returned reader reads the whole input
+		b, err := io.ReadAll(reader)
+		checkErr(t, err, "reading %s", tc.filename)
+		if !bytes.Equal(b, tc.stream) {
+			t.Errorf("%s: expected the returned reader to read the whole input", tc.filename)
+		}
+	}
+}
+
+func TestIdentifyWithMimeType(t *testing.T) {
+	name, info := newTempTextFile(t, "this is text")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	text := []byte("this is text")
+	tarball := archive(t, Tar{}, name, info)
+	for i, tc := range []struct {
+		options IdentifyOptions
+		stream  []byte
+		want    string
+	}{
+		{
+			options: IdentifyOptions{MimeType: "application/gzip"},
+			stream:  compress(t, ".gz", text, Gz{}.OpenWriter),
+			want:    ".gz",
+		},
+		{
+			// the contents alone are not enough to identify the format
+			options: IdentifyOptions{MimeType: "application/x-tar"},
+			stream:  []byte{},
+			want:    ".tar",
+		},
+		{
+			options: IdentifyOptions{MimeType: "application/zip; charset=binary"},
+			stream:  text,
+			want:    ".zip",
+		},
+		{
+			options: IdentifyOptions{MimeType: "application/x-compressed-tar"},
+			stream:  compress(t, ".gz", tarball, Gz{}.OpenWriter),
+			want:    ".tar.gz",
+		},
+		{
+			// the stream takes precedence over the MIME type
+			options: IdentifyOptions{MimeType: "application/x-bzip2"},
+			stream:  compress(t, ".xz", text, Xz{}.OpenWriter),
+			want:    ".xz",
+		},
+		{
+			options: IdentifyOptions{Filename: "data.tar", MimeType: "text/plain"},
+			stream:  []byte{},
+			want:    ".tar",
+		},
+		{
+			options: IdentifyOptions{MimeType: "text/plain"},
+			stream:  text,
+		},
+	} {
+		format, _, err := IdentifyWithOptions(bytes.NewReader(tc.stream), tc.options)
+		if tc.want == "" {
+			if !errors.Is(err, errNoFormatsMatched) {
+				t.Errorf("test %d: expected no match but got %v, %v", i, format, err)
+			}
+			continue
+		}
+		checkErr(t, err, "test %d: identifying", i)
+		if format.Name() != tc.want {
+			t.Errorf("test %d: expected %s but got %s", i, tc.want, format.Name())
+		}
+	}
+}
+
+func TestMimeType(t *testing.T) {
+	for _, tc := range []struct {
+		format Format
+		want   string
+	}{
+		{Gz{}, "application/gzip"},
+		{Bz2{}, "application/x-bzip2"},
+		{Xz{}, "application/x-xz"},
+		{Zstd{}, "application/zstd"},
+		{Lz4{}, "application/x-lz4"},
+		{Lzma{}, "application/x-lzma"},
+		{Lzw{}, "application/x-compress"},
+		{Zlib{}, "application/zlib"},
+		{Sz{}, "application/x-snappy-framed"},
+		{Brotli{}, "application/x-brotli"},
+		{Tar{}, "application/x-tar"},
+		{Zip{}, "application/zip"},
+		{SevenZip{}, "application/x-7z-compressed"},
+		{Rar{}, "application/vnd.rar"},
+		{CompressedArchive{Compression: Gz{}, Archival: Tar{}}, "application/gzip"},
+		{gzipLikeFormat{name: ".unknown"}, "application/octet-stream"},
+	} {
+		if got := MimeType(tc.format); got != tc.want {
+			t.Errorf("%s: expected MIME type %s but got %s", tc.format.Name(), tc.want, got)
+		}
+	}
+
+	// serving an archive with the MIME type of its identified format
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, stream, err := Identify("", bytes.NewReader(testZIP))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", MimeType(format))
+		io.Copy(w, stream)
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test.zip", nil))
+	if got := rec.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("expected Content-Type application/zip but got %s", got)
+	}
+
+	// the MIME types of the formats identify them again
+	for _, format := range Formats() {
+		mimeType := MimeType(format)
+		if mimeType == "application/octet-stream" {
+			continue
+		}
+		if !mimeTypeFormats(mimeType)[format.Name()] {
+			t.Errorf("%s: MIME type %s does not stand for the format", format.Name(), mimeType)
+		}
+	}
+}
+
+func TestCountingDecompressor(t *testing.T) {
+	content := bytes.Repeat([]byte("very compressible content "), 4096)
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.txt": content, "b.txt": content})
+
+	var buf bytes.Buffer
+	err := CompressedArchive{Compression: Gz{}, Archival: Tar{}}.Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	counter := NewCountingDecompressor(Gz{})
+	format := CompressedArchive{Compression: counter, Archival: Tar{}}
+
+	var previous int64
+	err = format.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			return err
+		}
+
+		// the counters advance as the archive is read
+		if counter.DecompressedBytes() <= previous+int64(len(content)) || counter.CompressedBytes() == 0 {
+			t.Errorf("%s: expected the counters to advance past %d but got %d compressed and %d decompressed bytes",
+				f.Name(), previous+int64(len(content)), counter.CompressedBytes(), counter.DecompressedBytes())
+		}
+		previous = counter.DecompressedBytes()
+		return nil
+	})
+	checkErr(t, err, "extracting")
+
+	if compressed := counter.CompressedBytes(); compressed != int64(buf.Len()) {
+		t.Errorf("expected %d compressed bytes but got %d", buf.Len(), compressed)
+	}
+	if decompressed := counter.DecompressedBytes(); decompressed <= counter.CompressedBytes() || decompressed < 2*int64(len(content)) {
+		t.Errorf("expected more decompressed bytes than the %d compressed ones and the content but got %d", counter.CompressedBytes(), decompressed)
+	}
+}
+
+func TestClassifyFile(t *testing.T) {
+	name, info := newTempTextFile(t, "this is text")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	dir := t.TempDir()
+	tarball := archive(t, Tar{}, name, info)
+	for filename, content := range map[string][]byte{
+		"file.gz":     compress(t, ".gz", []byte("this is text"), Gz{}.OpenWriter),
+		"file.tar.gz": compress(t, ".gz", tarball, Gz{}.OpenWriter),
+	} {
+		checkErr(t, os.WriteFile(filepath.Join(dir, filename), content, 0o644), "writing %s", filename)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		want     Kind
+		wantName string
+	}{
+		{path: "test/test.zip", want: KindArchive, wantName: ".zip"},
+		{path: filepath.Join(dir, "file.gz"), want: KindCompression, wantName: ".gz"},
+		{path: filepath.Join(dir, "file.tar.gz"), want: KindCompressedArchive, wantName: ".tar.gz"},
+		{path: name, want: KindUnknown},
+	} {
+		kind, format, err := ClassifyFile(tc.path)
+		checkErr(t, err, "classifying %s", tc.path)
+		if kind != tc.want {
+			t.Errorf("%s: expected kind %d but got %d", tc.path, tc.want, kind)
+		}
+		if tc.want != KindUnknown && (format == nil || format.Name() != tc.wantName) {
+			t.Errorf("%s: expected format %s but got %v", tc.path, tc.wantName, format)
+		}
+	}
+
+	if _, _, err := ClassifyFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestCompressedArchiveFlushInterval(t *testing.T) {
+	first := bytes.Repeat([]byte("first file "), 1000)
+	received := make(chan struct{})
+
+	files := []File{
+		FilesFromBytes(time.Now(), map[string][]byte{"first.txt": first})[0],
+		{
+			FileInfo: memFileInfo{name: "second.txt", size: 6, mode: 0o644, modTime: time.Now()},
+			FileName: "second.txt",
+			Open: func() (io.ReadCloser, error) {
+				// the second file is only available once the client got a part of the archive
+				select {
+				case <-received:
+					return io.NopCloser(strings.NewReader("second")), nil
+				case <-time.After(5 * time.Second):
+					return nil, fmt.Errorf("no part of the archive arrived before the end")
+				}
+			},
+		},
+	}
+
+	format := CompressedArchive{Compression: Gz{}, Archival: Tar{}, FlushInterval: 10 * time.Millisecond}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := format.Archive(r.Context(), w, files); err != nil {
+			t.Errorf("archiving: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	checkErr(t, err, "requesting archive")
+	defer resp.Body.Close()
+
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("expected chunked transfer encoding but got %v", resp.TransferEncoding)
+	}
+
+	// read the first part before the archive is complete
+	var body bytes.Buffer
+	_, err = io.CopyN(&body, resp.Body, 1)
+	checkErr(t, err, "reading the first part")
+	close(received)
+
+	_, err = io.Copy(&body, resp.Body)
+	checkErr(t, err, "reading the rest")
+
+	got := make(map[string]int)
+	err = format.Extract(context.Background(), &body, nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		got[f.FileName] = len(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if want := map[string]int{"first.txt": len(first), "second.txt": 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected files %v but got %v", want, got)
+	}
+}
+
+func TestCompressedArchiveSubformats(t *testing.T) {
+	name, info := newTempTextFile(t, "this is text")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	stream := compress(t, ".gz", archive(t, Tar{}, name, info), Gz{}.OpenWriter)
+	format, _, err := Identify("", bytes.NewReader(stream))
+	checkErr(t, err, "identifying")
+
+	caf, ok := format.(CompressedArchive)
+	if !ok {
+		t.Fatalf("expected a CompressedArchive but got %T", format)
+	}
+	if _, ok := caf.CompressionFormat().(Gz); !ok {
+		t.Errorf("expected the compression format to be Gz but got %T", caf.CompressionFormat())
+	}
+	if _, ok := caf.ArchiveFormat().(Tar); !ok {
+		t.Errorf("expected the archive format to be Tar but got %T", caf.ArchiveFormat())
+	}
+
+	if caf := (CompressedArchive{Compression: Gz{}}); caf.ArchiveFormat() != nil {
+		t.Errorf("expected no archive format but got %T", caf.ArchiveFormat())
+	}
+}
+
+func TestOpenNested(t *testing.T) {
+	ctx := context.Background()
+	tarGz := CompressedArchive{Compression: Gz{}, Archival: Tar{}}
+
+	var inner bytes.Buffer
+	err := tarGz.Archive(ctx, &inner, FilesFromBytes(time.Now(), map[string][]byte{
+		"docs/readme.txt": []byte("inner readme"),
+		"main.go":         []byte("package main"),
+	}))
+	checkErr(t, err, "archiving inner tar.gz")
+
+	var outer bytes.Buffer
+	err = Zip{}.Archive(ctx, &outer, FilesFromBytes(time.Now(), map[string][]byte{
+		"bundle/inner.tar.gz": inner.Bytes(),
+		"notes.txt":           []byte("not an archive"),
+	}))
+	checkErr(t, err, "archiving outer zip")
+
+	ex, r, err := OpenNested(ctx, Zip{}, bytes.NewReader(outer.Bytes()), "bundle/inner.tar.gz")
+	checkErr(t, err, "opening nested archive")
+	if caf, ok := ex.(CompressedArchive); !ok || caf.Name() != ".tar.gz" {
+		t.Fatalf("expected a .tar.gz extractor but got %#v", ex)
+	}
+
+	var got string
+	err = ex.Extract(ctx, r, []string{"docs/readme.txt"}, func(ctx context.Context, f File) error {
+		if f.FileName != "docs/readme.txt" {
+			return nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		got = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting from nested archive")
+	if got != "inner readme" {
+		t.Errorf("expected %q but got %q", "inner readme", got)
+	}
+
+	if _, _, err := OpenNested(ctx, Zip{}, bytes.NewReader(outer.Bytes()), "missing.zip"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a missing entry but got %v", err)
+	}
+	if _, _, err := OpenNested(ctx, Zip{}, bytes.NewReader(outer.Bytes()), "notes.txt"); err == nil {
+		t.Error("expected an error for an entry that is not an archive")
+	}
+}
+
+func TestIdentifyAll(t *testing.T) {
+	name, info := newTempTextFile(t, "this is text")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	tarball := archive(t, Tar{}, name, info)
+	formatNames := func(formats []Format) []string {
+		names := make([]string, len(formats))
+		for i, format := range formats {
+			names[i] = format.Name()
+		}
+		return names
+	}
+
+	for _, tc := range []struct {
+		filename string
+		stream   []byte
+		want     []string
+	}{
+		// an uncompressed tarball with a misleading extension
+		{filename: "data.tar.gz", stream: tarball, want: []string{".tar", ".gz"}},
+		{filename: "data.tar.gz", stream: compress(t, ".gz", tarball, Gz{}.OpenWriter), want: []string{".tar.gz", ".gz", ".tar"}},
+		{filename: "data.tgz", stream: compress(t, ".gz", tarball, Gz{}.OpenWriter), want: []string{".tar.gz", ".gz"}},
+		{filename: "data.txt", stream: []byte("this is text")},
+	} {
+		formats, reader, err := IdentifyAll(tc.filename, bytes.NewReader(tc.stream))
+		checkErr(t, err, "identifying %s", tc.filename)
+		if got := formatNames(formats); !reflect.DeepEqual(got, tc.want) && !(len(got) == 0 && len(tc.want) == 0) {
+			t.Errorf("%s: expected formats %v but got %v", tc.filename, tc.want, got)
+		}
+
+		b, err := io.ReadAll(reader)
+		checkErr(t, err, "reading %s", tc.filename)
+		if !bytes.Equal(b, tc.stream) {
+			t.Errorf("%s: expected the returned reader to read the whole input", tc.filename)
+		}
+	}
+}
+
+// ambiguousFormat is a compression format that matches files named *.ambiguous by name only,
+// like the other instances of it.
+type ambiguousFormat struct {
+	name string
+}
+
+func (f ambiguousFormat) Name() string { return f.name }
+
+func (f ambiguousFormat) Match(filename string, stream io.Reader) (MatchResult, error) {
+	return MatchResult{ByName: strings.HasSuffix(filename, ".ambiguous")}, nil
+}
+
+func (ambiguousFormat) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (ambiguousFormat) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+var registerAmbiguousFormats sync.Once
+
+func TestIdentifyRegistrationOrder(t *testing.T) {
+	// formats registered after the built-in ones, in an order that differs from the order of their names
+	registerAmbiguousFormats.Do(func() {
+		for _, name := range []string{".ambiguous-m", ".ambiguous-z", ".ambiguous-a"} {
+			RegisterFormat(ambiguousFormat{name})
+		}
+	})
+
+	for i := 0; i < 100; i++ {
+		format, _, err := Identify("data.ambiguous", strings.NewReader("this is text"))
+		checkErr(t, err, "identifying")
+		if format.Name() != ".ambiguous-m" {
+			t.Fatalf("attempt %d: expected the format registered first but got %s", i, format.Name())
+		}
+	}
+
+	formats, _, err := IdentifyAll("data.ambiguous", strings.NewReader("this is text"))
+	checkErr(t, err, "identifying all")
+	var names []string
+	for _, format := range formats {
+		names = append(names, format.Name())
+	}
+	if want := []string{".ambiguous-m", ".ambiguous-z", ".ambiguous-a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected formats %v but got %v", want, names)
+	}
+}
+
+// gzipLikeFormat is a compression format that matches gzip streams, like Gz does.
+type gzipLikeFormat struct {
+	Gz
+	name string
+}
+
+func (f gzipLikeFormat) Name() string { return f.name }
+
+// restoreFormats restores the registered formats when the test ends,
+// so that the other tests still identify the streams as the built-in formats.
+func restoreFormats(t *testing.T) {
+	savedFormats := make(map[string]Format, len(formats))
+	for name, format := range formats {
+		savedFormats[name] = format
+	}
+	savedPriorities := make(map[string]int, len(formatPriorities))
+	for name, priority := range formatPriorities {
+		savedPriorities[name] = priority
+	}
+	savedNames := append([]string(nil), formatNames...)
+	t.Cleanup(func() {
+		formats = savedFormats
+		formatPriorities = savedPriorities
+		formatNames = savedNames
+	})
+}
+
+func TestRegisterFormatWithPriority(t *testing.T) {
+	restoreFormats(t)
+
+	stream := compress(t, ".gz", []byte("this is text"), Gz{}.OpenWriter)
+	identify := func() string {
+		format, _, err := Identify("", bytes.NewReader(stream))
+		checkErr(t, err, "identifying")
+		return format.Name()
+	}
+
+	RegisterFormat(gzipLikeFormat{name: ".gz-default"})
+	if name := identify(); name != ".gz" {
+		t.Errorf("expected the built-in format registered first to win at the same priority but got %s", name)
+	}
+
+	RegisterFormatWithPriority(gzipLikeFormat{name: ".gz-low"}, -1)
+	RegisterFormatWithPriority(gzipLikeFormat{name: ".gz-high"}, 10)
+	RegisterFormatWithPriority(gzipLikeFormat{name: ".gz-higher"}, 20)
+	for i := 0; i < 10; i++ {
+		if name := identify(); name != ".gz-higher" {
+			t.Fatalf("attempt %d: expected the format with the highest priority to win but got %s", i, name)
+		}
+	}
+
+	if formatNames[0] != "gz-higher" || formatNames[1] != "gz-high" || formatNames[len(formatNames)-1] != "gz-low" {
+		t.Errorf("expected the formats to be ordered by priority, got %v", formatNames)
+	}
+}
+
+// stubGz is a replacement for Gz.
+type stubGz struct{ Gz }
+
+func TestFormats(t *testing.T) {
+	list := Formats()
+
+	var names []string
+	for _, format := range list {
+		names = append(names, format.Name())
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("expected the formats to be sorted by name, got %v", names)
+	}
+
+	for _, want := range []string{".7z", ".Z", ".br", ".bz2", ".gz", ".lz4", ".lzma", ".rar", ".sz", ".tar", ".xz", ".zip", ".zst", ".zz"} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("expected %s among the formats, got %v", want, names)
+		}
+	}
+
+	restoreFormats(t)
+	UnregisterFormat(".gz")
+	if got := len(Formats()); got != len(list)-1 {
+		t.Errorf("expected %d formats after unregistering one, got %d", len(list)-1, got)
+	}
+}
+
+func TestReplaceFormat(t *testing.T) {
+	restoreFormats(t)
+
+	stream := compress(t, ".gz", []byte("this is text"), Gz{}.OpenWriter)
+	position := func() int {
+		for i, name := range formatNames {
+			if name == "gz" {
+				return i
+			}
+		}
+		return -1
+	}
+	before := position()
+
+	ReplaceFormat(stubGz{})
+	format, _, err := Identify("file.gz", bytes.NewReader(stream))
+	checkErr(t, err, "identifying")
+	if _, ok := format.(stubGz); !ok {
+		t.Errorf("expected the replacement but got %T", format)
+	}
+	if after := position(); after != before {
+		t.Errorf("expected the replacement to be tried where Gz was (%d) but it is at %d", before, after)
+	}
+
+	UnregisterFormat(".GZ")
+	if _, _, err := Identify("", bytes.NewReader(stream)); !errors.Is(err, errNoFormatsMatched) {
+		t.Errorf("expected no format to match after unregistering but got %v", err)
+	}
+	if _, ok := formats["gz"]; ok || position() >= 0 {
+		t.Error("expected the format to be removed from the registered formats")
+	}
+
+	// with nothing to replace, the format is registered
+	ReplaceFormat(stubGz{})
+	format, _, err = Identify("", bytes.NewReader(stream))
+	checkErr(t, err, "identifying")
+	if _, ok := format.(stubGz); !ok {
+		t.Errorf("expected the registered replacement but got %T", format)
+	}
+}
+
+func TestIdentifyCompressedTarRoundTrip(t *testing.T) {
+	want := map[string]string{
+		"a.txt":     "first file",
+		"dir/b.txt": "second file",
+		"dir/c.txt": strings.Repeat("third file ", 100),
+	}
+	contents := make(map[string][]byte, len(want))
+	for name, content := range want {
+		contents[name] = []byte(content)
+	}
+
+	for _, comp := range []Compression{Lz4{}, Sz{}} {
+		var buf bytes.Buffer
+		err := Tar{}.Archive(context.Background(), &buf, FilesFromBytes(time.Now(), contents))
+		checkErr(t, err, "archiving")
+		stream := compress(t, comp.Name(), buf.Bytes(), comp.OpenWriter)
+
+		for _, filename := range []string{"files.tar" + comp.Name(), ""} {
+			format, r, err := Identify(filename, bytes.NewReader(stream))
+			checkErr(t, err, "%s: identifying %q", comp.Name(), filename)
+			ca, ok := format.(CompressedArchive)
+			if !ok {
+				t.Fatalf("%s: expected a compressed archive for %q but got %T", comp.Name(), filename, format)
+			}
+			if ca.Compression.Name() != comp.Name() || ca.Archival.Name() != ".tar" {
+				t.Fatalf("%s: expected a tar%s for %q but got %s", comp.Name(), comp.Name(), filename, format.Name())
+			}
+
+			got := make(map[string]string)
+			err = ca.Extract(context.Background(), r, nil, func(ctx context.Context, f File) error {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				b, err := io.ReadAll(rc)
+				got[f.FileName] = string(b)
+				return err
+			})
+			checkErr(t, err, "%s: extracting", comp.Name())
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: expected %v but got %v", comp.Name(), want, got)
+			}
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) Bytes() []byte {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return append([]byte(nil), sb.buf.Bytes()...)
+}
+
+func TestCompressedArchiveFlushEachFile(t *testing.T) {
+	for _, comp := range []Compression{Gz{}, Zstd{}} {
+		released := make(chan struct{})
+		files := []File{
+			FilesFromBytes(time.Now(), map[string][]byte{"first.txt": []byte("first")})[0],
+			{
+				FileInfo: memFileInfo{name: "second.txt", size: 6, mode: 0o644, modTime: time.Now()},
+				FileName: "second.txt",
+				Open: func() (io.ReadCloser, error) {
+					<-released
+					return io.NopCloser(strings.NewReader("second")), nil
+				},
+			},
+		}
+
+		format := CompressedArchive{Compression: comp, Archival: Tar{}, FlushEachFile: true}
+		var output syncBuffer
+		done := make(chan error, 1)
+		go func() {
+			done <- format.Archive(context.Background(), &output, files)
+		}()
+
+		// the first file can be read from the partial output while the second one is being archived
+		readFirst := func() (string, error) {
+			rc, err := comp.OpenReader(bytes.NewReader(output.Bytes()))
+			if err != nil {
+				return "", err
+			}
+			defer rc.Close()
+			tr := tar.NewReader(rc)
+			hdr, err := tr.Next()
+			if err != nil {
+				return "", err
+			}
+			content := make([]byte, hdr.Size)
+			_, err = io.ReadFull(tr, content)
+			return hdr.Name + ":" + string(content), err
+		}
+		var got string
+		var err error
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if got, err = readFirst(); err == nil {
+				break
+			}
+		}
+		close(released)
+
+		checkErr(t, <-done, "%s: archiving", comp.Name())
+		if err != nil || got != "first.txt:first" {
+			t.Errorf("%s: expected the first file before the archive was complete but got %q (%v)", comp.Name(), got, err)
+		}
+	}
+}
+
+func TestNewCompressedArchive(t *testing.T) {
+	if _, err := NewCompressedArchive(nil, Tar{}); err == nil {
+		t.Error("expected an error without a compression format")
+	}
+	if _, err := NewCompressedArchive(Gz{}, nil); err == nil {
+		t.Error("expected an error without an archive format")
+	}
+	if _, err := NewCompressedArchive(nil, nil); err == nil {
+		t.Error("expected an error without formats")
+	}
+
+	caf, err := NewCompressedArchive(Gz{}, Tar{})
+	checkErr(t, err, "creating compressed archive")
+	if caf.Name() != ".tar.gz" {
+		t.Errorf("expected .tar.gz but got %s", caf.Name())
+	}
+
+	var buf bytes.Buffer
+	err = caf.Archive(context.Background(), &buf, FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("a")}))
+	checkErr(t, err, "archiving")
+	var names []string
+	err = caf.Extract(context.Background(), &buf, nil, func(ctx context.Context, f File) error {
+		names = append(names, f.FileName)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Errorf("expected a.txt but got %v", names)
+	}
+}
+
+// closeErrorGz is Gz whose writers and readers fail to close.
+type closeErrorGz struct {
+	Gz
+	err error
+}
+
+type closeErrorWriter struct {
+	io.WriteCloser
+	err error
+}
+
+type closeErrorReader struct {
+	io.ReadCloser
+	err error
+}
+
+func (w closeErrorWriter) Close() error {
+	w.WriteCloser.Close()
+	return w.err
+}
+
+func (r closeErrorReader) Close() error {
+	r.ReadCloser.Close()
+	return r.err
+}
+
+func (gz closeErrorGz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	wc, err := gz.Gz.OpenWriter(w)
+	return closeErrorWriter{wc, gz.err}, err
+}
+
+func (gz closeErrorGz) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	rc, err := gz.Gz.OpenReader(r)
+	return closeErrorReader{rc, gz.err}, err
+}
+
+func TestCompressedArchiveCloseError(t *testing.T) {
+	errClose := errors.New("flushing failed")
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("a")})
+
+	var buf bytes.Buffer
+	err := CompressedArchive{Compression: closeErrorGz{err: errClose}, Archival: Tar{}}.Archive(context.Background(), &buf, files)
+	if !errors.Is(err, errClose) {
+		t.Errorf("expected the error of closing the compressor but got %v", err)
+	}
+
+	// the error of archiving takes precedence
+	errOpen := errors.New("cannot open")
+	failing := files[0]
+	failing.Open = func() (io.ReadCloser, error) { return nil, errOpen }
+	err = CompressedArchive{Compression: closeErrorGz{err: errClose}, Archival: Tar{}}.Archive(context.Background(), io.Discard, []File{failing})
+	if !errors.Is(err, errOpen) {
+		t.Errorf("expected the error of archiving but got %v", err)
+	}
+
+	err = CompressedArchive{Compression: closeErrorGz{err: errClose}, Archival: Tar{}}.Extract(context.Background(), &buf, nil, func(ctx context.Context, f File) error {
+		return nil
+	})
+	if !errors.Is(err, errClose) {
+		t.Errorf("expected the error of closing the decompressor but got %v", err)
+	}
+}
+
+// blockingReader blocks reading until unblock is closed, like a stalled network connection.
+type blockingReader struct{ unblock chan struct{} }
+
+func (r blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return 0, io.EOF
+}
+
+func TestIdentifyContext(t *testing.T) {
+	format, reader, err := IdentifyContext(context.Background(), "", bytes.NewReader(testZIP))
+	checkErr(t, err, "identifying zip")
+	if format.Name() != ".zip" {
+		t.Fatalf("unexpected format found: expected=.zip actual:%s", format.Name())
+	}
+	if data, err := io.ReadAll(reader); err != nil || !bytes.Equal(data, testZIP) {
+		t.Errorf("expected the returned reader to read the whole stream, got %d bytes and error %v", len(data), err)
+	}
+
+	// the stream starts with a gzip header, and then stalls in the middle of the compressed data
+	var gzipped bytes.Buffer
+	gw, err := Gz{}.OpenWriter(&gzipped)
+	checkErr(t, err, "opening gzip writer")
+	_, err = gw.Write(bytes.Repeat([]byte("stalled"), 1000))
+	checkErr(t, err, "writing gzip")
+	checkErr(t, gw.Close(), "closing gzip writer")
+	unblock := make(chan struct{})
+	defer close(unblock)
+	stream := io.MultiReader(bytes.NewReader(gzipped.Bytes()[:20]), blockingReader{unblock})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = IdentifyContext(ctx, "", stream)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the error of the context but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected identification to give up once the context is done, but it took %v", elapsed)
+	}
+}
@@ -13,6 +13,7 @@ require (
 	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/ulikunitz/xz v0.5.11
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
+	golang.org/x/sys v0.4.0
 	golang.org/x/text v0.6.0
 )
 
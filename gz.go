@@ -70,6 +70,8 @@ func (gz Gz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
 	return wc, err
 }
 
+// OpenReader returns a reader of the decompressed data,
+// which includes all members of streams of concatenated gzip files.
 func (gz Gz) OpenReader(r io.Reader) (io.ReadCloser, error) {
 	var rc io.ReadCloser
 	var err error
@@ -0,0 +1,25 @@
+package compressor
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGzMultistream(t *testing.T) {
+	for _, gz := range []Gz{{}, {Multithreaded: true}} {
+		// concatenated members, as written by e.g. `cat a.gz b.gz`
+		stream := append(compress(t, ".gz", []byte("first member\n"), gz.OpenWriter),
+			compress(t, ".gz", []byte("second member\n"), gz.OpenWriter)...)
+
+		rc, err := gz.OpenReader(bytes.NewReader(stream))
+		checkErr(t, err, "opening reader")
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		checkErr(t, err, "multithreaded=%t: reading", gz.Multithreaded)
+
+		if want := "first member\nsecond member\n"; string(got) != want {
+			t.Errorf("multithreaded=%t: expected %q but got %q", gz.Multithreaded, want, got)
+		}
+	}
+}
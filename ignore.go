@@ -0,0 +1,191 @@
+package compressor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignorePattern is a pattern of a .gitignore-style file.
+type ignorePattern struct {
+	base     string // slash-separated directory of the ignore file relative to the root, or "" for the root
+	pattern  string
+	negate   bool // the pattern starts with "!" and re-includes what it matches
+	dirOnly  bool // the pattern ends with "/" and only matches directories
+	anchored bool // the pattern contains a "/" and is relative to base instead of matching names at any depth
+}
+
+// ignoreMatcher decides whether files are ignored by the patterns of the ignore files read so far.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// FilesFromDiskWithIgnore returns the files in the directory root, placed in the root of the archive,
+// leaving out those ignored by the .gitignore-style files named in ignoreFiles (e.g. ".gitignore").
+// Like with git, the ignore files are read from every directory, and their patterns apply
+// to the files in that directory and below, taking precedence over the patterns of the parent directories.
+// Ignored directories are not walked at all, so their contents cannot be re-included by negated patterns.
+// The ignore files themselves are included unless they are ignored.
+// The files are assembled according to the settings specified in the options, as with FilesFromDisk.
+func FilesFromDiskWithIgnore(ctx context.Context, options *FromDiskOptions, root string, ignoreFiles []string) ([]File, error) {
+	var matcher ignoreMatcher
+
+	rootOnDisk := filepath.Clean(root) + string(filepath.Separator)
+	skip := func(filename string, d fs.DirEntry) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		rel, err := filepath.Rel(rootOnDisk, filename)
+		if err != nil {
+			return false, err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && matcher.ignored(rel, d.IsDir()) {
+			return true, nil
+		}
+
+		if d.IsDir() {
+			for _, name := range ignoreFiles {
+				if err := matcher.load(filepath.Join(filename, name), rel); err != nil {
+					return false, options.handleError(filename, d, err)
+				}
+			}
+		}
+
+		return false, nil
+	}
+
+	return options.filesFromDisk(rootOnDisk, "", skip)
+}
+
+// load adds the patterns of the ignore file at filename, which is in the directory dir relative to the root.
+// A missing file is not an error.
+func (m *ignoreMatcher) load(filename, dir string) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if dir == "." {
+		dir = ""
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pattern, ok := parseIgnorePattern(scanner.Text(), dir); ok {
+			m.patterns = append(m.patterns, pattern)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// ignored reports whether the file with the slash-separated name relative to the root is ignored.
+// The last matching pattern decides, so that negated patterns can re-include files.
+func (m *ignoreMatcher) ignored(name string, isDir bool) bool {
+	var ignored bool
+	for _, p := range m.patterns {
+		if p.match(name, isDir) {
+			ignored = !p.negate
+		}
+	}
+
+	return ignored
+}
+
+// parseIgnorePattern parses a line of an ignore file in the directory base.
+// It reports false for blank lines and comments.
+func parseIgnorePattern(line, base string) (ignorePattern, bool) {
+	p := ignorePattern{base: base}
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // escaped leading "!" or "#"
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	p.pattern = line
+	return p, line != ""
+}
+
+// match reports whether the pattern matches the file with the slash-separated name relative to the root.
+func (p ignorePattern) match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if p.base != "" {
+		if !strings.HasPrefix(name, p.base+"/") {
+			return false
+		}
+		name = name[len(p.base)+1:]
+	}
+
+	if !p.anchored {
+		// the parent directories were matched when they were walked
+		ok, _ := path.Match(p.pattern, path.Base(name))
+		return ok
+	}
+
+	return matchIgnoreSegments(strings.Split(p.pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchIgnoreSegments matches the path elements of a name against those of a pattern,
+// in which "**" matches any number of elements.
+func matchIgnoreSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			// a trailing "**" matches everything inside, but not the directory itself
+			if len(patterns) == 1 {
+				return len(names) > 0
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchIgnoreSegments(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(patterns[0], names[0]); !ok {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+
+	return len(names) == 0
+}
@@ -0,0 +1,72 @@
+package compressor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFilesFromDiskWithIgnore(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		".gitignore":                     "# dependencies\nnode_modules/\n*.log\n!keep.log\n/build\n",
+		"main.go":                        "package main",
+		"debug.log":                      "log",
+		"keep.log":                       "kept",
+		"node_modules/pkg/index.js":      "module",
+		"build/out.bin":                  "binary",
+		"src/build/gen.go":               "package build",
+		"src/app.log":                    "log",
+		"src/node_modules":               "a file, not a directory",
+		"docs/.gitignore":                "*.tmp\n/drafts/**\n",
+		"docs/guide.md":                  "guide",
+		"docs/notes.tmp":                 "tmp",
+		"docs/drafts/a/draft.md":         "draft",
+		"other/notes.tmp":                "tmp outside of docs",
+		"other/vendor/node_modules/x.js": "nested",
+		"other/vendor/node_modules.txt":  "not the directory",
+	} {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(filename), 0o755), "creating directory of %s", name)
+		checkErr(t, os.WriteFile(filename, []byte(content), 0o644), "writing %s", name)
+	}
+
+	files, err := FilesFromDiskWithIgnore(context.Background(), nil, root, []string{".gitignore"})
+	checkErr(t, err, "gathering files")
+
+	var got []string
+	for _, f := range files {
+		got = append(got, f.FileName)
+	}
+	sort.Strings(got)
+
+	want := []string{
+		".gitignore",
+		"docs",
+		"docs/.gitignore",
+		"docs/drafts",
+		"docs/guide.md",
+		"keep.log",
+		"main.go",
+		"other",
+		"other/notes.tmp",
+		"other/vendor",
+		"other/vendor/node_modules.txt",
+		"src",
+		"src/build",
+		"src/build/gen.go",
+		"src/node_modules",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected files:\n%v\nbut got:\n%v", want, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FilesFromDiskWithIgnore(ctx, nil, root, []string{".gitignore"}); err == nil {
+		t.Error("expected an error with a canceled context")
+	}
+}
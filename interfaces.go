@@ -78,6 +78,14 @@ type Extractor interface {
 	Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error
 }
 
+// ErrorTolerant is implemented by formats that can continue
+// after an error occurred while reading or writing a file in the archive.
+type ErrorTolerant interface {
+	// SetContinueOnError sets whether errors for individual files are logged
+	// and the operation continues for the remaining files.
+	SetContinueOnError(bool)
+}
+
 // Inserter can insert files into an existing archive.
 type Inserter interface {
 	// Context cancellation must be honored.
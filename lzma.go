@@ -0,0 +1,173 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Lzma facilitates LZMA compression in the classic (standalone) .lzma format.
+type Lzma struct {
+	// If greater than 0, decompressing a stream whose header declares a larger dictionary
+	// fails with ErrDictTooLarge before the dictionary is allocated.
+	// If 0, dictionaries of up to 4 GiB, the most the header can declare, are allocated.
+	MaxDictSize int
+}
+
+func init() {
+	RegisterFormat(Lzma{})
+}
+
+func (Lzma) Name() string {
+	return ".lzma"
+}
+
+// Match matches the file header, which has no magic number,
+// by the properties byte and a dictionary and uncompressed size that make sense.
+func (lz Lzma) Match(filename string, stream io.Reader) (MatchResult, error) {
+	var mr MatchResult
+
+	// match filename
+	if strings.Contains(strings.ToLower(filename), lz.Name()) {
+		mr.ByName = true
+	}
+
+	// match file header
+	buf, err := readAtMost(stream, lzma.HeaderLen)
+	if err != nil {
+		return mr, err
+	}
+
+	mr.ByStream = isLzmaHeader(buf)
+
+	return mr, nil
+}
+
+func (Lzma) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	return lzma.NewWriter(w)
+}
+
+func (lz Lzma) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, lzma.HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if dictSize := binary.LittleEndian.Uint32(header[1:5]); lz.MaxDictSize > 0 && int64(dictSize) > int64(lz.MaxDictSize) {
+		return nil, fmt.Errorf("%w: %d bytes, more than %d", ErrDictTooLarge, dictSize, lz.MaxDictSize)
+	}
+
+	lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), r))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(lr), nil
+}
+
+// isLzmaHeader reports whether buf looks like the header of an .lzma file.
+func isLzmaHeader(buf []byte) bool {
+	if len(buf) < lzma.HeaderLen {
+		return false
+	}
+
+	// the properties byte is (pb * 5 + lp) * 9 + lc with pb, lp <= 4 and lc <= 8
+	if buf[0] >= 9*5*5 {
+		return false
+	}
+
+	// encoders use dictionary sizes of 2^n or 2^n + 2^(n-1)
+	dictSize := binary.LittleEndian.Uint32(buf[1:5])
+	if dictSize < lzma.MinDictCap {
+		return false
+	}
+	switch bits.OnesCount32(dictSize) {
+	case 1:
+	case 2:
+		if dictSize&(dictSize>>1) == 0 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	// the uncompressed size is either unknown (all ones) or not absurdly large
+	size := binary.LittleEndian.Uint64(buf[5:13])
+	return size == 1<<64-1 || size < 1<<48
+}
+
+// zipLzmaWriter converts the classic LZMA format written by lzma.Writer into the one used in zip archives,
+// in which the properties are preceded by the LZMA SDK version and the size of the properties,
+// and the uncompressed size is not part of the header.
+type zipLzmaWriter struct {
+	w      io.Writer
+	header []byte
+}
+
+func (zw *zipLzmaWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	// the header is held back until it is complete, since archive/zip creates
+	// the compressor, and thus lzma.Writer, before it writes the local file header
+	if len(zw.header) < lzma.HeaderLen {
+		k := lzma.HeaderLen - len(zw.header)
+		if k > len(p) {
+			k = len(p)
+		}
+		zw.header = append(zw.header, p[:k]...)
+		p = p[k:]
+
+		if len(zw.header) < lzma.HeaderLen {
+			return n, nil
+		}
+
+		// version 9.20 of the LZMA SDK and 5 bytes of properties, followed by the properties
+		prefix := append([]byte{9, 20, 5, 0}, zw.header[:5]...)
+		if _, err := zw.w.Write(prefix); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := zw.w.Write(p); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// newZipLzmaWriter returns a writer compressing to out with LZMA as used in zip archives.
+// The end of the stream is marked with an EOS marker, which must be indicated by bit 1 of the entry's flags.
+func newZipLzmaWriter(out io.Writer) (io.WriteCloser, error) {
+	return lzma.WriterConfig{EOSMarker: true}.NewWriter(&zipLzmaWriter{w: out})
+}
+
+// newZipLzmaReader returns a reader decompressing LZMA as used in zip archives from r.
+// The stream must be terminated by an EOS marker, since the decompressor does not know the uncompressed size.
+func newZipLzmaReader(r io.Reader) (io.ReadCloser, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	props := make([]byte, binary.LittleEndian.Uint16(prefix[2:]))
+	if _, err := io.ReadFull(r, props); err != nil {
+		return nil, err
+	}
+	if len(props) != 5 {
+		return nil, fmt.Errorf("unsupported size of LZMA properties: %d", len(props))
+	}
+
+	// rebuild the classic header with an unknown uncompressed size
+	header := append(props, bytes.Repeat([]byte{0xff}, 8)...)
+	lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), r))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(lr), nil
+}
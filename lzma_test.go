@@ -0,0 +1,95 @@
+package compressor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLzma(t *testing.T) {
+	contents := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)
+
+	buf := new(bytes.Buffer)
+	w, err := Lzma{}.OpenWriter(buf)
+	checkErr(t, err, "opening writer")
+	_, err = io.WriteString(w, contents)
+	checkErr(t, err, "compressing")
+	checkErr(t, w.Close(), "closing writer")
+
+	mr, err := Lzma{}.Match("", bytes.NewReader(buf.Bytes()))
+	checkErr(t, err, "matching")
+	if !mr.ByStream {
+		t.Errorf("expected a match by stream")
+	}
+
+	mr, err = Lzma{}.Match("", strings.NewReader(contents))
+	checkErr(t, err, "matching plain text")
+	if mr.ByStream {
+		t.Errorf("expected no match by stream for plain text")
+	}
+
+	r, err := Lzma{}.OpenReader(bytes.NewReader(buf.Bytes()))
+	checkErr(t, err, "opening reader")
+	decompressed, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing")
+	if string(decompressed) != contents {
+		t.Fatalf("expected round-tripped contents but got %d bytes", len(decompressed))
+	}
+}
+
+func TestZipLzma(t *testing.T) {
+	contents := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)
+	name, info := newTempTextFile(t, contents)
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	z := Zip{SelectiveCompression: true, Compression: ZipMethodLzma}
+	archived := archive(t, z, name, info)
+
+	zr, err := zip.NewReader(bytes.NewReader(archived), int64(len(archived)))
+	checkErr(t, err, "reading archive")
+	if f := zr.File[0]; f.Method != ZipMethodLzma || f.Flags&0x2 == 0 {
+		t.Fatalf("expected LZMA with an EOS marker but got method %d and flags %#x", f.Method, f.Flags)
+	}
+
+	var extracted string
+	err = z.Extract(context.Background(), bytes.NewReader(archived), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		extracted = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if extracted != contents {
+		t.Fatalf("expected round-tripped contents but got %d bytes", len(extracted))
+	}
+}
+
+func TestLzmaMaxDictSize(t *testing.T) {
+	stream := compress(t, ".lzma", []byte("the quick brown fox jumps over the lazy dog"), Lzma{}.OpenWriter)
+
+	// declare a dictionary of 1 GiB, which would be allocated up front
+	crafted := append([]byte(nil), stream...)
+	binary.LittleEndian.PutUint32(crafted[1:], 1<<30)
+
+	if _, err := (Lzma{MaxDictSize: 64 << 20}).OpenReader(bytes.NewReader(crafted)); !errors.Is(err, ErrDictTooLarge) {
+		t.Errorf("expected ErrDictTooLarge but got %v", err)
+	}
+
+	r, err := Lzma{MaxDictSize: 64 << 20}.OpenReader(bytes.NewReader(stream))
+	checkErr(t, err, "opening reader within the limit")
+	_, err = io.ReadAll(r)
+	checkErr(t, err, "decompressing within the limit")
+}
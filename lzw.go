@@ -0,0 +1,370 @@
+package compressor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Lzw facilitates the LZW compression of the Unix compress utility (.Z).
+// The standard library's compress/lzw cannot be used for it, since the .Z format
+// has no end code, uses codes of up to 16 bits and pads the codes in groups when their width changes.
+type Lzw struct {
+	// Maximum width of the codes when compressing, between 9 and 16 (default 16).
+	MaxBits int
+}
+
+const (
+	lzwMinBits   = 9
+	lzwMaxBits   = 16
+	lzwBlockMode = 0x80 // the table is reset on a clear code
+	lzwClear     = 256
+)
+
+var lzwHeader = []byte{0x1f, 0x9d}
+
+var errLzwCorrupt = errors.New("lzw: corrupt input")
+
+// lzwWriter compresses to the .Z format.
+type lzwWriter struct {
+	w        *bufio.Writer
+	maxBits  uint
+	nBits    uint
+	maxCode  int
+	free     int
+	count    int // codes written with the current width
+	ent      int // code of the string matched so far, or -1
+	dict     map[int]int
+	bits     uint64
+	numBits  uint
+	wroteHdr bool
+	err      error
+}
+
+// lzwReader decompresses the .Z format.
+type lzwReader struct {
+	r         *bufio.Reader
+	maxBits   uint
+	blockMode bool
+	nBits     uint
+	maxCode   int
+	free      int
+	count     int // codes read with the current width
+	oldCode   int
+	finChar   byte
+	prefix    []uint16
+	suffix    []byte
+	bits      uint64
+	numBits   uint
+	stack     []byte
+	out       []byte
+	err       error
+}
+
+func init() {
+	RegisterFormat(Lzw{})
+}
+
+func (Lzw) Name() string {
+	return ".Z"
+}
+
+func (lz Lzw) Match(filename string, stream io.Reader) (MatchResult, error) {
+	var mr MatchResult
+
+	// match filename; case-sensitively, since .z is the unrelated format of the pack utility
+	if filepath.Ext(filename) == lz.Name() {
+		mr.ByName = true
+	}
+
+	// match file header
+	buf, err := readAtMost(stream, len(lzwHeader))
+	if err != nil {
+		return mr, err
+	}
+
+	mr.ByStream = bytes.Equal(buf, lzwHeader)
+
+	return mr, nil
+}
+
+func (lz Lzw) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	maxBits := lz.MaxBits
+	if maxBits == 0 {
+		maxBits = lzwMaxBits
+	}
+	if maxBits < lzwMinBits || maxBits > lzwMaxBits {
+		return nil, fmt.Errorf("invalid maximum code width: %d", maxBits)
+	}
+
+	return &lzwWriter{
+		w:       bufio.NewWriter(w),
+		maxBits: uint(maxBits),
+		nBits:   lzwMinBits,
+		maxCode: 1<<lzwMinBits - 1,
+		free:    lzwClear + 1,
+		ent:     -1,
+		dict:    make(map[int]int),
+	}, nil
+}
+
+func (Lzw) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:2], lzwHeader) {
+		return nil, fmt.Errorf("lzw: invalid header")
+	}
+
+	maxBits := uint(header[2] & 0x1f)
+	if maxBits < lzwMinBits || maxBits > lzwMaxBits || header[2]&0x60 != 0 {
+		return nil, fmt.Errorf("lzw: unsupported flags: %#x", header[2])
+	}
+
+	lr := &lzwReader{
+		r:         br,
+		maxBits:   maxBits,
+		blockMode: header[2]&lzwBlockMode != 0,
+		nBits:     lzwMinBits,
+		maxCode:   1<<lzwMinBits - 1,
+		free:      lzwClear,
+		oldCode:   -1,
+		prefix:    make([]uint16, 1<<maxBits),
+		suffix:    make([]byte, 1<<maxBits),
+	}
+	if lr.blockMode {
+		lr.free++
+	}
+	for i := 0; i < 256; i++ {
+		lr.suffix[i] = byte(i)
+	}
+
+	return io.NopCloser(lr), nil
+}
+
+func (lw *lzwWriter) Write(p []byte) (int, error) {
+	if lw.err != nil {
+		return 0, lw.err
+	}
+
+	if !lw.wroteHdr {
+		lw.wroteHdr = true
+		lw.w.Write(append(lzwHeader, byte(lw.maxBits)|lzwBlockMode))
+	}
+
+	for _, c := range p {
+		if lw.ent < 0 {
+			lw.ent = int(c)
+			continue
+		}
+
+		key := lw.ent<<8 | int(c)
+		if code, ok := lw.dict[key]; ok {
+			lw.ent = code
+			continue
+		}
+
+		lw.writeCode(lw.ent)
+
+		// like compress, widen the codes once the next code to be added does not fit anymore
+		if lw.free > lw.maxCode {
+			lw.pad()
+			lw.nBits++
+			if lw.nBits == lw.maxBits {
+				lw.maxCode = 1 << lw.maxBits
+			} else {
+				lw.maxCode = 1<<lw.nBits - 1
+			}
+		}
+
+		if lw.free < 1<<lw.maxBits {
+			lw.dict[key] = lw.free
+			lw.free++
+		} else {
+			// start over with an empty table once it is full, so that it adapts to the input
+			lw.writeCode(lzwClear)
+			lw.pad()
+			lw.nBits = lzwMinBits
+			lw.maxCode = 1<<lzwMinBits - 1
+			lw.free = lzwClear + 1
+			lw.dict = make(map[int]int)
+		}
+
+		lw.ent = int(c)
+	}
+
+	return len(p), lw.err
+}
+
+func (lw *lzwWriter) Close() error {
+	if lw.err != nil {
+		return lw.err
+	}
+
+	if !lw.wroteHdr {
+		lw.wroteHdr = true
+		lw.w.Write(append(lzwHeader, byte(lw.maxBits)|lzwBlockMode))
+	}
+
+	if lw.ent >= 0 {
+		lw.writeCode(lw.ent)
+	}
+
+	// flush the remaining bits; unlike when widening the codes, the group is not padded
+	if lw.numBits > 0 {
+		lw.w.WriteByte(byte(lw.bits))
+	}
+
+	return lw.w.Flush()
+}
+
+func (lw *lzwWriter) writeCode(code int) {
+	lw.bits |= uint64(code) << lw.numBits
+	lw.numBits += lw.nBits
+	for lw.numBits >= 8 {
+		if err := lw.w.WriteByte(byte(lw.bits)); err != nil && lw.err == nil {
+			lw.err = err
+		}
+		lw.bits >>= 8
+		lw.numBits -= 8
+	}
+
+	lw.count++
+}
+
+// pad writes zero codes up to the end of the current group of 8 codes,
+// which is what the decoders expect when the width of the codes changes.
+func (lw *lzwWriter) pad() {
+	for lw.count%8 != 0 {
+		lw.writeCode(0)
+	}
+
+	lw.count = 0
+}
+
+func (lr *lzwReader) Read(p []byte) (int, error) {
+	for len(lr.out) == 0 {
+		if lr.err != nil {
+			return 0, lr.err
+		}
+		lr.err = lr.decode()
+	}
+
+	n := copy(p, lr.out)
+	lr.out = lr.out[n:]
+
+	return n, nil
+}
+
+// decode decodes the next code into lr.out.
+func (lr *lzwReader) decode() error {
+	if lr.free > lr.maxCode {
+		if err := lr.skipGroup(); err != nil {
+			return err
+		}
+		lr.nBits++
+		if lr.nBits == lr.maxBits {
+			lr.maxCode = 1 << lr.maxBits
+		} else {
+			lr.maxCode = 1<<lr.nBits - 1
+		}
+	}
+
+	code, err := lr.readCode()
+	if err != nil {
+		return err
+	}
+
+	if lr.oldCode < 0 {
+		if code >= 256 {
+			return errLzwCorrupt
+		}
+		lr.oldCode = code
+		lr.finChar = byte(code)
+		lr.out = append(lr.out[:0], lr.finChar)
+		return nil
+	}
+
+	if code == lzwClear && lr.blockMode {
+		if err := lr.skipGroup(); err != nil {
+			return err
+		}
+		lr.nBits = lzwMinBits
+		lr.maxCode = 1<<lzwMinBits - 1
+		// the code after the clear code fills the slot of the clear code itself,
+		// which is never referenced
+		lr.free = lzwClear
+		return nil
+	}
+
+	inCode := code
+	lr.stack = lr.stack[:0]
+
+	// the KwKwK case, where the code is the one that is being defined
+	if code >= lr.free {
+		if code > lr.free {
+			return errLzwCorrupt
+		}
+		lr.stack = append(lr.stack, lr.finChar)
+		code = lr.oldCode
+	}
+
+	for code >= 256 {
+		lr.stack = append(lr.stack, lr.suffix[code])
+		code = int(lr.prefix[code])
+	}
+	lr.finChar = byte(code)
+	lr.stack = append(lr.stack, lr.finChar)
+
+	lr.out = lr.out[:0]
+	for i := len(lr.stack) - 1; i >= 0; i-- {
+		lr.out = append(lr.out, lr.stack[i])
+	}
+
+	if lr.free < 1<<lr.maxBits {
+		lr.prefix[lr.free] = uint16(lr.oldCode)
+		lr.suffix[lr.free] = lr.finChar
+		lr.free++
+	}
+	lr.oldCode = inCode
+
+	return nil
+}
+
+// readCode reads a code of the current width.
+// A trailing partial code at the end of the stream is ignored.
+func (lr *lzwReader) readCode() (int, error) {
+	for lr.numBits < lr.nBits {
+		b, err := lr.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		lr.bits |= uint64(b) << lr.numBits
+		lr.numBits += 8
+	}
+
+	code := int(lr.bits & (1<<lr.nBits - 1))
+	lr.bits >>= lr.nBits
+	lr.numBits -= lr.nBits
+	lr.count++
+
+	return code, nil
+}
+
+// skipGroup skips the padding up to the end of the current group of 8 codes,
+// which is where the codes of the new width start.
+func (lr *lzwReader) skipGroup() error {
+	for lr.count%8 != 0 {
+		if _, err := lr.readCode(); err != nil {
+			return err
+		}
+	}
+
+	lr.count = 0
+	return nil
+}
@@ -0,0 +1,73 @@
+package compressor
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// LICENSE compressed with 16-bit codes, which gzip -d decompresses as well
+//
+//go:embed test/LICENSE.Z
+var testLicenseZ []byte
+
+func TestLzw(t *testing.T) {
+	license, err := os.ReadFile("LICENSE")
+	checkErr(t, err, "reading license")
+
+	r, err := Lzw{}.OpenReader(bytes.NewReader(testLicenseZ))
+	checkErr(t, err, "opening reader")
+	decompressed, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing")
+	if !bytes.Equal(decompressed, license) {
+		t.Fatalf("expected decompressed fixture to equal the license")
+	}
+
+	// small code widths make the table fill up and be cleared
+	for _, maxBits := range []int{9, 12, 16} {
+		compressed := compress(t, ".Z", license, Lzw{MaxBits: maxBits}.OpenWriter)
+		r, err := Lzw{}.OpenReader(bytes.NewReader(compressed))
+		checkErr(t, err, "opening reader")
+		decompressed, err := io.ReadAll(r)
+		checkErr(t, err, "decompressing with maximum width %d", maxBits)
+		if !bytes.Equal(decompressed, license) {
+			t.Fatalf("expected round-tripped contents with maximum width %d", maxBits)
+		}
+	}
+}
+
+func TestLzwTar(t *testing.T) {
+	name, info := newTempTextFile(t, strings.Repeat("compressed with LZW\n", 50))
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+	tarZ := compress(t, ".Z", archive(t, Tar{}, name, info), Lzw{}.OpenWriter)
+
+	format, stream, err := Identify("test.tar.Z", bytes.NewReader(tarZ))
+	checkErr(t, err, "identifying")
+	caf, ok := format.(CompressedArchive)
+	if !ok || format.Name() != ".tar.Z" {
+		t.Fatalf("expected .tar.Z but got %s", format.Name())
+	}
+
+	var contents string
+	err = caf.Extract(context.Background(), stream, nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		contents = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if contents != strings.Repeat("compressed with LZW\n", 50) {
+		t.Fatalf("expected extracted contents but got %q", contents)
+	}
+}
@@ -17,12 +17,39 @@ import (
 )
 
 type Rar struct {
-	// If true, errors that occurred while reading or writing a file in the archive
-	// will be logged and the operation will continue for the remaining files.
+	// What happens when reading or writing a file in the archive fails; see ErrorMode.
+	ErrorMode ErrorMode
+
+	// If true and ErrorMode is FailFast, the errors are handled as with ContinueCollect.
+	// Kept for compatibility; SetContinueOnError sets it.
 	ContinueOnError bool
 
+	// If set, it is called with the path of a directory when extraction starts skipping it,
+	// because handleFile returned fs.SkipDir, and again for every entry left out because of it.
+	OnSkip func(dir string)
+
 	// Password to open archives.
 	Password string
+
+	// If set, the reader of each regular entry is wrapped with this function when extracting.
+	ContentTransform func(name string, r io.Reader) (io.Reader, error)
+
+	// Path of the first volume of an archive split into multiple volumes (.part1.rar, or .rar followed by .r00).
+	// If set, Extract reads the archive from this file instead of sourceArchive, and opens the following volumes
+	// from the same directory as they are needed, since they can only be found by their names.
+	MultiVolumePath string
+}
+
+// rarReader reads the entries of a RAR archive.
+type rarReader interface {
+	io.Reader
+	Next() (*rardecode.FileHeader, error)
+	Close() error
+}
+
+// rarStreamReader is a rardecode.Reader of a stream, which is closed by whoever opened it.
+type rarStreamReader struct {
+	*rardecode.Reader
 }
 
 // rarFileInfo satisfies the fs.FileInfo interface for RAR entries.
@@ -39,6 +66,13 @@ func init() {
 	RegisterFormat(Rar{})
 }
 
+func (r *Rar) SetContinueOnError(v bool) {
+	r.ContinueOnError = v
+	if !v {
+		r.ErrorMode = FailFast
+	}
+}
+
 func (Rar) Name() string {
 	return ".rar"
 }
@@ -73,6 +107,9 @@ func (r Rar) Archive(_ context.Context, _ io.Writer, _ []File) error {
 	return fmt.Errorf("not implemented because RAR is a proprietary format")
 }
 
+// Extract extracts files from the RAR archive.
+// Archives split into multiple volumes are read from the disk if MultiVolumePath is set;
+// sourceArchive is then ignored.
 func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error {
 	var options []rardecode.Option
 
@@ -80,14 +117,17 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 		options = append(options, rardecode.Password(r.Password))
 	}
 
-	rr, err := rardecode.NewReader(sourceArchive, options...)
+	rr, err := r.openReader(sourceArchive, options)
 	if err != nil {
 		return err
 	}
+	defer rr.Close()
 
-	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	included := newPathSet(pathsInArchive)
 
+	mode := errorMode(r.ErrorMode, r.ContinueOnError)
+	var errs MultiError
 	for {
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
@@ -98,17 +138,19 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 			break
 		}
 		if err != nil {
-			if r.ContinueOnError {
+			if mode.continues() && ctx.Err() == nil {
+				// the reader cannot recover from errors, so there are no more files to continue with
 				golog.Info("[ERROR] Advancing to next file in rar archive: %v", err)
-				continue
+				errs.add(fmt.Errorf("advancing to next file in rar archive: %w", err))
+				break
 			}
 			return err
 		}
 
-		if !fileIsIncluded(pathsInArchive, hdr.Name) {
+		if !included.includes(hdr.Name) {
 			continue
 		}
-		if fileIsIncluded(skipDirs, hdr.Name) {
+		if skipDirs.skipped(hdr.Name, r.OnSkip) {
 			continue
 		}
 
@@ -118,6 +160,9 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 			FileName: hdr.Name,
 			Open:     func() (io.ReadCloser, error) { return io.NopCloser(rr), nil },
 		}
+		if r.ContentTransform != nil && file.Mode().IsRegular() {
+			file = transformedFile(file, r.ContentTransform)
+		}
 
 		err = handleFile(ctx, file)
 		if errors.Is(err, fs.SkipDir) {
@@ -127,11 +172,35 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 				dirPath = path.Dir(hdr.Name) + "/"
 			}
 			skipDirs.add(dirPath)
+			if r.OnSkip != nil {
+				r.OnSkip(dirPath)
+			}
+		} else if errors.Is(err, ErrStopWalk) {
+			break
 		} else if err != nil {
 			return fmt.Errorf("handling file: %s: %w", hdr.Name, err)
 		}
 	}
 
+	return mode.result(&errs)
+}
+
+// openReader returns a reader of the archive in sourceArchive,
+// or of the volumes starting at MultiVolumePath if it is set.
+func (r Rar) openReader(sourceArchive io.Reader, options []rardecode.Option) (rarReader, error) {
+	if r.MultiVolumePath != "" {
+		return rardecode.OpenReader(r.MultiVolumePath, options...)
+	}
+
+	rr, err := rardecode.NewReader(sourceArchive, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rarStreamReader{rr}, nil
+}
+
+func (rarStreamReader) Close() error {
 	return nil
 }
 
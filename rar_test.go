@@ -0,0 +1,213 @@
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRarMultiVolume(t *testing.T) {
+	want := map[string]string{
+		"split.txt":      "this file is split across the first and the second volume\n",
+		"dir/second.txt": "this file is only in the second volume\n",
+	}
+
+	got := make(map[string]string)
+	err := Rar{MultiVolumePath: "test/multi.part1.rar"}.Extract(context.Background(), nil, nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		got[f.FileName] = string(b)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+
+	// the second volume cannot be found from a stream
+	data, err := os.ReadFile("test/multi.part1.rar")
+	checkErr(t, err, "reading first volume")
+	err = Rar{}.Extract(context.Background(), bytes.NewReader(data), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		_, err = io.ReadAll(rc)
+		return err
+	})
+	if err == nil {
+		t.Error("expected an error extracting a multi-volume archive from a stream")
+	}
+
+	fsys, err := FileSystem(context.Background(), "test/multi.part1.rar")
+	checkErr(t, err, "opening file system")
+	entries, err := fs.ReadDir(fsys, ".")
+	checkErr(t, err, "reading root directory")
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if wantNames := []string{"dir", "split.txt"}; !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("expected entries %v but got %v", wantNames, names)
+	}
+}
+
+func TestRarExtractFromFileOffset(t *testing.T) {
+	// another archive precedes the one to extract, which is read from the current offset of the file
+	prefix, err := os.ReadFile("test/nodir.rar")
+	checkErr(t, err, "reading prefix")
+	data, err := os.ReadFile("test/test.rar")
+	checkErr(t, err, "reading archive")
+	name := filepath.Join(t.TempDir(), "prefixed.rar")
+	checkErr(t, os.WriteFile(name, append(prefix, data...), 0o644), "writing file")
+
+	file, err := os.Open(name)
+	checkErr(t, err, "opening file")
+	defer file.Close()
+	_, err = file.Seek(int64(len(prefix)), io.SeekStart)
+	checkErr(t, err, "seeking")
+
+	var names []string
+	err = Rar{}.Extract(context.Background(), file, nil, func(ctx context.Context, f File) error {
+		names = append(names, f.FileName)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	sort.Strings(names)
+	if want := []string{"a.txt", "dir", "dir/b.txt", "dir/c.txt", "other/d.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected entries %v but got %v", want, names)
+	}
+}
+
+func TestRarExtract(t *testing.T) {
+	for i, tc := range []struct {
+		paths   []string
+		skipDir string
+		want    map[string]string
+	}{
+		{
+			want: map[string]string{
+				"a.txt":       "file a\n",
+				"dir":         "",
+				"dir/b.txt":   "file b\n",
+				"dir/c.txt":   "file c\n",
+				"other/d.txt": "file d\n",
+			},
+		},
+		{
+			paths: []string{"dir", "other/d.txt"},
+			want: map[string]string{
+				"dir":         "",
+				"dir/b.txt":   "file b\n",
+				"dir/c.txt":   "file c\n",
+				"other/d.txt": "file d\n",
+			},
+		},
+		{
+			skipDir: "dir/b.txt",
+			want: map[string]string{
+				"a.txt":       "file a\n",
+				"dir":         "",
+				"dir/b.txt":   "file b\n",
+				"other/d.txt": "file d\n",
+			},
+		},
+	} {
+		archive, err := os.Open("test/test.rar")
+		checkErr(t, err, "opening archive")
+
+		got := make(map[string]string)
+		err = Rar{}.Extract(context.Background(), archive, tc.paths, func(ctx context.Context, f File) error {
+			if f.IsDir() {
+				got[f.FileName] = ""
+				return nil
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				return err
+			}
+			got[f.FileName] = string(b)
+
+			if f.FileName == tc.skipDir {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		archive.Close()
+		checkErr(t, err, "test %d: extracting", i)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("test %d: expected %v but got %v", i, tc.want, got)
+		}
+	}
+}
+
+func TestRarExtractTruncatedContinueOnError(t *testing.T) {
+	data, err := os.ReadFile("test/test.rar")
+	checkErr(t, err, "reading archive")
+	truncated := data[:len(data)/2]
+
+	var handled int
+	err = Rar{ErrorMode: ContinueCollect}.Extract(context.Background(), bytes.NewReader(truncated), nil, func(ctx context.Context, f File) error {
+		handled++
+		return nil
+	})
+	var multi *MultiError
+	if !errors.As(err, &multi) || len(multi.Errors) != 1 {
+		t.Fatalf("expected a single error for the truncated archive but got %v", err)
+	}
+	if handled == 0 {
+		t.Errorf("expected the files before the truncation to be handled")
+	}
+}
+
+func TestRarImplicitDirectories(t *testing.T) {
+	// the archive only has an entry for a\b\c.txt, with the backslashes written by Windows
+	fsys := &ArchiveFS{Path: "test/nodir.rar", Format: Rar{}}
+
+	for _, tc := range []struct {
+		dir  string
+		want []string
+	}{
+		{dir: ".", want: []string{"a"}},
+		{dir: "a", want: []string{"b"}},
+		{dir: "a/b", want: []string{"c.txt"}},
+	} {
+		entries, err := fsys.ReadDir(tc.dir)
+		checkErr(t, err, "reading directory %s", tc.dir)
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+			if wantDir := entry.Name() != "c.txt"; entry.IsDir() != wantDir {
+				t.Errorf("%s: expected %s to be a directory: %t", tc.dir, entry.Name(), wantDir)
+			}
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%s: expected entries %v but got %v", tc.dir, tc.want, names)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package compressor
 
 import (
 	"archive/tar"
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -9,14 +10,70 @@ import (
 	"io/fs"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pchchv/golog"
 )
 
+// tarBufPool holds the buffered writers of newBufferedTarWriter.
+var tarBufPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, 32<<10)
+	},
+}
+
 type Tar struct {
-	// If true, errors that occurred while reading or writing a file in the archive
-	// will be logged and the operation will continue for the remaining files.
+	// What happens when reading or writing a file in the archive fails; see ErrorMode.
+	ErrorMode ErrorMode
+
+	// If true and ErrorMode is FailFast, the errors are handled as with ContinueCollect.
+	// Kept for compatibility; SetContinueOnError sets it.
 	ContinueOnError bool
+
+	// If set, it is called with the path of a directory when extraction starts skipping it,
+	// because handleFile returned fs.SkipDir, and again for every entry left out because of it.
+	OnSkip func(dir string)
+
+	// If set, the contents of each regular file are passed through this function when archiving,
+	// and the reader of each regular entry is wrapped with it when extracting.
+	// Since the tar header needs the size of the file up front,
+	// the transformed contents are buffered in memory.
+	ContentTransform func(name string, r io.Reader) (io.Reader, error)
+
+	// If set, it is called as the contents of files are written when archiving,
+	// or read when extracting, with the number of bytes processed so far in total.
+	// totalBytes is the sum of the sizes of all files, or -1 if it is not known in advance.
+	Progress func(file File, bytesProcessed, totalBytes int64)
+
+	// If true, no entries are written for directories, only for the files in them.
+	// Empty directories are lost, unless EmptyDirectorySentinel is set.
+	OmitDirectoryEntries bool
+
+	// If set along with OmitDirectoryEntries, an empty file of this name is written
+	// into each directory without other entries, so that the directory is preserved.
+	// Only Archive and Insert do this, since they know all of the files in advance.
+	EmptyDirectorySentinel string
+
+	// If greater than 0, archiving a file whose path has more components than this fails,
+	// which protects extraction onto file systems that reject deeply nested paths.
+	MaxPathDepth int
+
+	// If true, the Xattrs of files are written as PAX records when archiving,
+	// and the Xattrs of extracted files are filled from their PAX records.
+	// Writing them makes the archive a PAX one.
+	PreserveXattrs bool
+
+	// If true, archives are reproducible: the same files produce the same archive
+	// regardless of who owns them and when they were modified. Owner and group IDs and names are cleared,
+	// all modification times are set to the Unix epoch, access and change times are dropped,
+	// and the format is the one tar.Writer picks for the remaining fields.
+	Deterministic bool
+
+	// If set, it is called with the header of each file before it is written when archiving,
+	// after all of the other options have been applied, so that it can change any of its fields,
+	// e.g. to make root the owner of all files. Returning an error fails writing the file.
+	HeaderOverride func(hdr *tar.Header, file File) error
 }
 
 // Interface guards
@@ -24,12 +81,24 @@ var (
 	_ Archiver  = (*Tar)(nil)
 	_ Extractor = (*Tar)(nil)
 	_ Inserter  = (*Tar)(nil)
+
+	_ ErrorTolerant = (*Tar)(nil)
 )
 
+// paxSchilyXattr is the prefix of PAX records holding extended attributes.
+const paxSchilyXattr = "SCHILY.xattr."
+
 func init() {
 	RegisterFormat(Tar{})
 }
 
+func (t *Tar) SetContinueOnError(v bool) {
+	t.ContinueOnError = v
+	if !v {
+		t.ErrorMode = FailFast
+	}
+}
+
 func (Tar) Name() string {
 	return ".tar"
 }
@@ -50,38 +119,89 @@ func (t Tar) Match(filename string, stream io.Reader) (MatchResult, error) {
 	return mr, nil
 }
 
-func (t Tar) Archive(ctx context.Context, output io.Writer, files []File) error {
-	tw := tar.NewWriter(output)
-	defer tw.Close()
+func (t Tar) Archive(ctx context.Context, output io.Writer, files []File) (err error) {
+	tw, bw, closeTar := newBufferedTarWriter(output)
+	defer func() {
+		if closeErr := closeTar(); err == nil {
+			err = closeErr
+		}
+	}()
 
+	if t.OmitDirectoryEntries {
+		files = omitDirectories(files, t.EmptyDirectorySentinel)
+	}
+
+	p := newProgress(t.Progress, totalSize(files))
+
+	mode := errorMode(t.ErrorMode, t.ContinueOnError)
+	var errs MultiError
 	for _, file := range files {
-		if err := t.writeFileToArchive(ctx, tw, file); err != nil {
-			if t.ContinueOnError && ctx.Err() == nil { // context errors should always abort
+		// each entry reaches the output as a whole, but not later than that
+		err := t.writeFileToArchive(ctx, tw, file, p)
+		if flushErr := bw.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			if mode.continues() && ctx.Err() == nil { // context errors should always abort
 				golog.Info("[ERROR] %v", err)
+				errs.add(err)
 				continue
 			}
 			return err
 		}
 	}
 
-	return nil
+	return mode.result(&errs)
 }
 
-func (t Tar) ArchiveAsync(ctx context.Context, output io.Writer, files <-chan File) error {
-	tw := tar.NewWriter(output)
-	defer tw.Close()
+func (t Tar) ArchiveAsync(ctx context.Context, output io.Writer, files <-chan File) (err error) {
+	tw, bw, closeTar := newBufferedTarWriter(output)
+	defer func() {
+		if closeErr := closeTar(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	p := newProgress(t.Progress, -1)
 
+	mode := errorMode(t.ErrorMode, t.ContinueOnError)
+	var errs MultiError
 	for file := range files {
-		if err := t.writeFileToArchive(ctx, tw, file); err != nil {
-			if t.ContinueOnError && ctx.Err() == nil { // context errors should always abort
+		// each entry reaches the output as a whole, but not later than that
+		err := t.writeFileToArchive(ctx, tw, file, p)
+		if flushErr := bw.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			if mode.continues() && ctx.Err() == nil { // context errors should always abort
 				golog.Info("[ERROR] %v", err)
+				errs.add(err)
 				continue
 			}
 			return err
 		}
 	}
 
-	return nil
+	return mode.result(&errs)
+}
+
+// newBufferedTarWriter returns a tar.Writer that writes to output through bw, a buffered writer from tarBufPool,
+// so that the header, contents and padding of small files are not written to output separately.
+// closeTar closes the tar.Writer, flushes bw and returns it to the pool.
+func newBufferedTarWriter(output io.Writer) (tw *tar.Writer, bw *bufio.Writer, closeTar func() error) {
+	bw = tarBufPool.Get().(*bufio.Writer)
+	bw.Reset(output)
+	tw = tar.NewWriter(bw)
+
+	return tw, bw, func() error {
+		err := tw.Close()
+		if flushErr := bw.Flush(); err == nil {
+			err = flushErr
+		}
+		bw.Reset(nil) // do not keep output alive in the pool
+		tarBufPool.Put(bw)
+		return err
+	}
 }
 
 func (t Tar) Insert(ctx context.Context, into io.ReadWriteSeeker, files []File) error {
@@ -127,28 +247,48 @@ func (t Tar) Insert(ctx context.Context, into io.ReadWriteSeeker, files []File)
 	tw := tar.NewWriter(into)
 	defer tw.Close()
 
+	if t.OmitDirectoryEntries {
+		files = omitDirectories(files, t.EmptyDirectorySentinel)
+	}
+
+	p := newProgress(t.Progress, totalSize(files))
+
+	mode := errorMode(t.ErrorMode, t.ContinueOnError)
+	var errs MultiError
 	for i, file := range files {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		err = t.writeFileToArchive(ctx, tw, file)
+		err = t.writeFileToArchive(ctx, tw, file, p)
 		if err != nil {
-			if t.ContinueOnError && ctx.Err() == nil {
-				golog.Info("[ERROR] appending file %d into archive: %s: %v", i, file.Name(), err)
+			err = fmt.Errorf("appending file %d into archive: %s: %w", i, file.Name(), err)
+			if mode.continues() && ctx.Err() == nil {
+				golog.Info("[ERROR] %v", err)
+				errs.add(err)
 				continue
 			}
-			return fmt.Errorf("appending file %d into archive: %s: %w", i, file.Name(), err)
+			return err
 		}
 	}
 
-	return nil
+	return mode.result(&errs)
 }
 
+// Extract extracts the files in the tar archive sourceArchive, limited to pathsInArchive if not nil,
+// passing them to handleFile in the order they appear in the archive.
+// Sparse files, in the GNU and PAX formats, are passed with their full logical size,
+// and reading them yields zeros for their holes, so the holes are not known to handleFile.
+// Handlers writing such files to disk that want to keep them sparse have to seek over runs of zeros
+// instead of writing them, truncating the file to its size at the end; ExtractToDisk writes the zeros out.
 func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error {
 	tr := tar.NewReader(sourceArchive)
-	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	included := newPathSet(pathsInArchive)
+	// the total size of a tar archive is only known after reading it
+	p := newProgress(t.Progress, -1)
+	mode := errorMode(t.ErrorMode, t.ContinueOnError)
+	var errs MultiError
 
 	for {
 		if err := ctx.Err(); err != nil {
@@ -160,17 +300,20 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 			break
 		}
 		if err != nil {
-			if t.ContinueOnError && ctx.Err() == nil {
+			if mode.continues() && ctx.Err() == nil {
+				// the reader cannot recover from errors, so there are no more files to continue with
 				golog.Info("[ERROR] Advancing to next file in tar archive: %v", err)
-				continue
+				errs.add(fmt.Errorf("advancing to next file in tar archive: %w", err))
+				break
 			}
 			return err
 		}
 
-		if !fileIsIncluded(pathsInArchive, hdr.Name) {
+		hdr.Name = normalizeSeparators(hdr.Name)
+		if !included.includes(hdr.Name) {
 			continue
 		}
-		if fileIsIncluded(skipDirs, hdr.Name) {
+		if skipDirs.skipped(hdr.Name, t.OnSkip) {
 			continue
 		}
 
@@ -186,6 +329,13 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 			LinkTarget: hdr.Linkname,
 			Open:       func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
 		}
+		if t.PreserveXattrs {
+			file.Xattrs = xattrsFromPAXRecords(hdr.PAXRecords)
+		}
+		file = p.file(file)
+		if t.ContentTransform != nil && file.Mode().IsRegular() {
+			file = transformedFile(file, t.ContentTransform)
+		}
 
 		err = handleFile(ctx, file)
 		if errors.Is(err, fs.SkipDir) {
@@ -198,39 +348,157 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 			}
 
 			skipDirs.add(dirPath)
+			if t.OnSkip != nil {
+				t.OnSkip(dirPath)
+			}
+		} else if errors.Is(err, ErrStopWalk) {
+			break
 		} else if err != nil {
 			return fmt.Errorf("handling file: %s: %w", hdr.Name, err)
 		}
 	}
 
-	return nil
+	return mode.result(&errs)
 }
 
-func (Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file File) error {
+func (t Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file File, p *progress) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	if t.OmitDirectoryEntries && file.IsDir() {
+		return nil
+	}
+
+	if err := checkPathDepth(file.FileName, t.MaxPathDepth); err != nil {
+		return fmt.Errorf("file %s: %w", file.FileName, err)
+	}
+
+	if t.ContentTransform != nil && file.Mode().IsRegular() {
+		var err error
+		file, err = bufferFile(ctx, transformedFile(file, t.ContentTransform))
+		if err != nil {
+			return fmt.Errorf("file %s: transforming content: %w", file.FileName, err)
+		}
+	}
+
 	hdr, err := tar.FileInfoHeader(file, file.LinkTarget)
 	if err != nil {
 		return fmt.Errorf("file %s: creating header: %w", file.FileName, err)
 	}
 
+	if custom, ok := file.Header.(*tar.Header); ok {
+		mergeTarHeader(hdr, custom)
+	}
+
 	hdr.Name = file.FileName // complete path, since FileInfoHeader() only has base name
 
+	if t.Deterministic {
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Format = tar.FormatUnknown
+	}
+
+	if t.PreserveXattrs && len(file.Xattrs) > 0 {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, len(file.Xattrs))
+		}
+		for name, value := range file.Xattrs {
+			hdr.PAXRecords[paxSchilyXattr+name] = value
+		}
+	}
+
+	if t.HeaderOverride != nil {
+		if err := t.HeaderOverride(hdr, file); err != nil {
+			return fmt.Errorf("file %s: overriding header: %w", file.FileName, err)
+		}
+	}
+
+	// write the file body only if it actually exists (directories and links do not have a body);
+	// it is opened before the header is written, since an entry without its body would break the archive
+	var body io.ReadCloser
+	if hdr.Typeflag == tar.TypeReg {
+		body, err = file.Open()
+		if err != nil {
+			return fmt.Errorf("file %s: opening: %w", file.FileName, err)
+		}
+		defer body.Close()
+	}
+
 	if err := tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("file %s: writing header: %w", file.FileName, err)
 	}
 
-	// write the file body only if it actually exists
-	// (directories and links do not have a body)
-	if hdr.Typeflag != tar.TypeReg {
+	if body == nil {
 		return nil
 	}
 
-	if err := openAndCopyFile(file, tw); err != nil {
+	if _, err := copyContext(ctx, p.writer(tw, file), body); err != nil {
 		return fmt.Errorf("file %s: writing data: %w", file.FileName, err)
 	}
 
 	return nil
 }
+
+// mergeTarHeader overrides the fields of hdr, synthesized from the file info, with the ones set in custom,
+// which is the header supplied by the caller. The name, size, mode, type and link target
+// always come from the file, since they must match what is written. PAX records are merged,
+// with records that conflict with the fields of hdr being ignored by tar.Writer.
+func mergeTarHeader(hdr, custom *tar.Header) {
+	if custom.Uid != 0 {
+		hdr.Uid = custom.Uid
+	}
+	if custom.Gid != 0 {
+		hdr.Gid = custom.Gid
+	}
+	if custom.Uname != "" {
+		hdr.Uname = custom.Uname
+	}
+	if custom.Gname != "" {
+		hdr.Gname = custom.Gname
+	}
+	if !custom.ModTime.IsZero() {
+		hdr.ModTime = custom.ModTime
+	}
+	if !custom.AccessTime.IsZero() {
+		hdr.AccessTime = custom.AccessTime
+	}
+	if !custom.ChangeTime.IsZero() {
+		hdr.ChangeTime = custom.ChangeTime
+	}
+	if custom.Devmajor != 0 || custom.Devminor != 0 {
+		hdr.Devmajor = custom.Devmajor
+		hdr.Devminor = custom.Devminor
+	}
+	if custom.Format != tar.FormatUnknown {
+		hdr.Format = custom.Format
+	}
+
+	if len(custom.PAXRecords) > 0 {
+		records := make(map[string]string, len(hdr.PAXRecords)+len(custom.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			records[k] = v
+		}
+		for k, v := range custom.PAXRecords {
+			records[k] = v
+		}
+		hdr.PAXRecords = records
+	}
+}
+
+// xattrsFromPAXRecords returns the extended attributes stored in records, or nil if there are none.
+func xattrsFromPAXRecords(records map[string]string) map[string]string {
+	var xattrs map[string]string
+	for k, v := range records {
+		if name := strings.TrimPrefix(k, paxSchilyXattr); name != k {
+			if xattrs == nil {
+				xattrs = make(map[string]string)
+			}
+			xattrs[name] = v
+		}
+	}
+
+	return xattrs
+}
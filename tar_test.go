@@ -0,0 +1,399 @@
+package compressor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarPreserveXattrs(t *testing.T) {
+	name, info := newTempTextFile(t, "with attributes")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	files := []File{
+		{
+			FileInfo: info,
+			Header:   &tar.Header{PAXRecords: map[string]string{"VENDOR.custom": "value"}},
+			FileName: "file.txt",
+			Xattrs:   map[string]string{"user.comment": "hello"},
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(name)
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		preserve    bool
+		wantXattrs  map[string]string
+		wantRecords map[string]string
+	}{
+		{
+			preserve:   true,
+			wantXattrs: map[string]string{"user.comment": "hello"},
+			wantRecords: map[string]string{
+				"VENDOR.custom":             "value",
+				"SCHILY.xattr.user.comment": "hello",
+			},
+		},
+		{
+			preserve:    false,
+			wantRecords: map[string]string{"VENDOR.custom": "value"},
+		},
+	} {
+		var buf bytes.Buffer
+		err := Tar{PreserveXattrs: tc.preserve}.Archive(context.Background(), &buf, files)
+		checkErr(t, err, "archiving")
+
+		var extracted int
+		err = Tar{PreserveXattrs: true}.Extract(context.Background(), &buf, nil, func(ctx context.Context, f File) error {
+			extracted++
+			if !reflect.DeepEqual(f.Xattrs, tc.wantXattrs) {
+				t.Errorf("preserve=%t: expected xattrs %v but got %v", tc.preserve, tc.wantXattrs, f.Xattrs)
+			}
+			records := f.Header.(*tar.Header).PAXRecords
+			for k, v := range tc.wantRecords {
+				if records[k] != v {
+					t.Errorf("preserve=%t: expected PAX record %s=%q but got %q", tc.preserve, k, v, records[k])
+				}
+			}
+			if _, ok := records["SCHILY.xattr.user.comment"]; !tc.preserve && ok {
+				t.Errorf("preserve=%t: expected no xattr PAX record but got %v", tc.preserve, records)
+			}
+			return nil
+		})
+		checkErr(t, err, "extracting")
+		if extracted != 1 {
+			t.Errorf("preserve=%t: expected 1 file but got %d", tc.preserve, extracted)
+		}
+	}
+}
+
+func TestTarHeaderFromFile(t *testing.T) {
+	name, info := newTempTextFile(t, "with header")
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	custom := &tar.Header{
+		Name:       "ignored.txt",
+		Uid:        1234,
+		Gid:        5678,
+		Uname:      "someone",
+		Gname:      "somegroup",
+		PAXRecords: map[string]string{"VENDOR.custom": "value", "VENDOR.other": "other value"},
+	}
+	files := []File{
+		{
+			FileInfo: info,
+			Header:   custom,
+			FileName: "dir/file.txt",
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(name)
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := Tar{}.Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	var extracted int
+	err = Tar{}.Extract(context.Background(), &buf, nil, func(ctx context.Context, f File) error {
+		extracted++
+		hdr := f.Header.(*tar.Header)
+		if hdr.Name != "dir/file.txt" {
+			t.Errorf("expected name from the file but got %q", hdr.Name)
+		}
+		if hdr.Size != info.Size() {
+			t.Errorf("expected size %d but got %d", info.Size(), hdr.Size)
+		}
+		if hdr.Uid != custom.Uid || hdr.Gid != custom.Gid || hdr.Uname != custom.Uname || hdr.Gname != custom.Gname {
+			t.Errorf("expected ownership %d:%d (%s:%s) but got %d:%d (%s:%s)",
+				custom.Uid, custom.Gid, custom.Uname, custom.Gname, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+		}
+		for k, v := range custom.PAXRecords {
+			if hdr.PAXRecords[k] != v {
+				t.Errorf("expected PAX record %s=%q but got %q", k, v, hdr.PAXRecords[k])
+			}
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if extracted != 1 {
+		t.Errorf("expected 1 file but got %d", extracted)
+	}
+}
+
+// ownedFileInfo is a FileInfo whose owner is reported by its Sys() like the one of a file from a tar archive.
+type ownedFileInfo struct {
+	fs.FileInfo
+	owner *tar.Header
+}
+
+func (info ownedFileInfo) Sys() interface{} {
+	return info.owner
+}
+
+func TestTarDeterministic(t *testing.T) {
+	contents := map[string][]byte{
+		"a.txt":     []byte("file a"),
+		"dir/b.txt": []byte("file b"),
+	}
+
+	// the same files, owned by different users and modified at different times
+	archiveAs := func(format Tar, owner *tar.Header, modTime time.Time) []byte {
+		files := FilesFromBytes(modTime, contents)
+		for i := range files {
+			files[i].FileInfo = ownedFileInfo{FileInfo: files[i].FileInfo, owner: owner}
+		}
+
+		var buf bytes.Buffer
+		err := format.Archive(context.Background(), &buf, files)
+		checkErr(t, err, "archiving")
+		return buf.Bytes()
+	}
+	alice := &tar.Header{Uid: 1000, Gid: 1000, Uname: "alice", Gname: "users"}
+	bob := &tar.Header{Uid: 1001, Gid: 100, Uname: "bob", Gname: "staff", AccessTime: time.Now()}
+	modTime := time.Date(2023, 1, 31, 12, 0, 0, 0, time.UTC)
+
+	if bytes.Equal(archiveAs(Tar{}, alice, modTime), archiveAs(Tar{}, bob, modTime.Add(time.Hour))) {
+		t.Fatal("expected archives of files with different owners to differ")
+	}
+
+	first := archiveAs(Tar{Deterministic: true}, alice, modTime)
+	second := archiveAs(Tar{Deterministic: true}, bob, modTime.Add(time.Hour))
+	if !bytes.Equal(first, second) {
+		t.Fatal("expected deterministic archives to be identical")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		checkErr(t, err, "reading archive")
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" || !hdr.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%s: expected no owner and a modification time at the epoch but got %d:%d (%s:%s) %v",
+				hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname, hdr.ModTime)
+		}
+		if hdr.Format != tar.FormatUSTAR {
+			t.Errorf("%s: expected USTAR format but got %v", hdr.Name, hdr.Format)
+		}
+	}
+}
+
+func TestTarHeaderOverride(t *testing.T) {
+	files := FilesFromBytes(time.Now(), map[string][]byte{
+		"a.txt":     []byte("file a"),
+		"dir/b.txt": []byte("file b"),
+	})
+	for i := range files {
+		files[i].FileInfo = ownedFileInfo{
+			FileInfo: files[i].FileInfo,
+			owner:    &tar.Header{Uid: 1000, Gid: 1000, Uname: "alice", Gname: "users"},
+		}
+	}
+
+	format := Tar{
+		HeaderOverride: func(hdr *tar.Header, file File) error {
+			if file.Name() == "b.txt" {
+				return errors.New("refused")
+			}
+			hdr.Uid, hdr.Gid = 0, 0
+			hdr.Uname, hdr.Gname = "root", "root"
+			return nil
+		},
+	}
+
+	var buf bytes.Buffer
+	err := format.Archive(context.Background(), &buf, files)
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("expected the error of the override but got %v", err)
+	}
+
+	buf.Reset()
+	format.ContinueOnError = true
+	err = format.Archive(context.Background(), &buf, files)
+	var multiErr *MultiError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("expected a *MultiError but got %v", err)
+	}
+
+	var names []string
+	err = format.Extract(context.Background(), &buf, nil, func(ctx context.Context, f File) error {
+		hdr := f.Header.(*tar.Header)
+		names = append(names, hdr.Name)
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "root" || hdr.Gname != "root" {
+			t.Errorf("%s: expected root ownership but got %d:%d (%s:%s)", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Errorf("expected only a.txt to be archived but got %v", names)
+	}
+}
+
+func TestTarSparse(t *testing.T) {
+	// a 4 MiB file with "hello" at 1 MiB and "world" at 3 MiB, archived by GNU tar with --sparse
+	want := make([]byte, 4<<20)
+	copy(want[1<<20:], "hello")
+	copy(want[3<<20:], "world")
+
+	for _, tc := range []struct {
+		fixture    string
+		paxVersion string // of the GNU sparse format, whose map is in the PAX records (0.x) or the file data (1.0)
+	}{
+		{fixture: "test/sparse-gnu.tar"}, // old GNU format, with the map in the header
+		{fixture: "test/sparse-pax.tar", paxVersion: "1.0"},
+	} {
+		fixture := tc.fixture
+		archive, err := os.Open(fixture)
+		checkErr(t, err, "opening %s", fixture)
+		defer archive.Close()
+
+		var extracted int
+		err = Tar{}.Extract(context.Background(), archive, nil, func(ctx context.Context, f File) error {
+			extracted++
+			if f.FileName != "sparse.img" {
+				t.Errorf("%s: expected sparse.img but got %s", fixture, f.FileName)
+			}
+			if f.Size() != int64(len(want)) {
+				t.Errorf("%s: expected size %d but got %d", fixture, len(want), f.Size())
+			}
+			if tc.paxVersion != "" {
+				records := f.Header.(*tar.Header).PAXRecords
+				if version := records["GNU.sparse.major"] + "." + records["GNU.sparse.minor"]; version != tc.paxVersion {
+					t.Errorf("%s: expected sparse format %s but got %s", fixture, tc.paxVersion, version)
+				}
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: reconstructed contents differ from the original", fixture)
+			}
+			return nil
+		})
+		checkErr(t, err, "extracting %s", fixture)
+		if extracted != 1 {
+			t.Errorf("%s: expected 1 file but got %d", fixture, extracted)
+		}
+	}
+}
+
+// BenchmarkArchiveSmallFiles archives many tiny files into a file on disk,
+// where every write to the output is a system call.
+func BenchmarkArchiveSmallFiles(b *testing.B) {
+	contents := make(map[string][]byte, 5000)
+	for i := 0; i < 5000; i++ {
+		contents[fmt.Sprintf("dir%d/file%d.txt", i%50, i)] = []byte(strings.Repeat("small file ", i%20+1))
+	}
+	files := FilesFromBytes(time.Now(), contents)
+
+	for _, archiver := range []Archiver{Tar{}, Zip{}} {
+		archiver := archiver
+		b.Run(archiver.(Format).Name(), func(b *testing.B) {
+			out, err := os.Create(filepath.Join(b.TempDir(), "archive"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer out.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := out.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if err := archiver.Archive(context.Background(), out, files); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+func TestTarArchiveOutputError(t *testing.T) {
+	errWrite := errors.New("disk full")
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("contents")})
+
+	for _, mode := range []ErrorMode{FailFast, ContinueSilent, ContinueCollect} {
+		err := Tar{ErrorMode: mode}.Archive(context.Background(), failingWriter{errWrite}, files)
+		if !errors.Is(err, errWrite) {
+			t.Errorf("mode %d: expected the error of the output but got %v", mode, err)
+		}
+	}
+}
+
+func TestTarStopWalk(t *testing.T) {
+	ctx := context.Background()
+	contents := map[string][]byte{
+		"a.txt":      []byte("file a"),
+		"known/file": []byte("known"),
+		"z.txt":      []byte("file z"),
+	}
+	var buf bytes.Buffer
+	checkErr(t, Tar{}.Archive(ctx, &buf, FilesFromBytes(time.Now(), contents)), "archiving")
+
+	var handled []string
+	err := Tar{ContinueOnError: true}.Extract(ctx, bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		handled = append(handled, f.FileName)
+		if f.FileName == "known/file" {
+			return ErrStopWalk
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if last := handled[len(handled)-1]; last != "known/file" {
+		t.Errorf("expected to stop at known/file but handled %v", handled)
+	}
+
+	fsys := ArchiveFS{Stream: io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), Format: Tar{}}
+	f, err := fsys.Open("known/file")
+	checkErr(t, err, "opening known/file")
+	data, err := io.ReadAll(f)
+	checkErr(t, err, "reading known/file")
+	checkErr(t, f.Close(), "closing known/file")
+	if string(data) != "known" {
+		t.Errorf("expected the contents of known/file but got %q", data)
+	}
+}
+
+func TestTarCloseError(t *testing.T) {
+	var buf bytes.Buffer
+	tw, _, closeTar := newBufferedTarWriter(&buf)
+	checkErr(t, tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0o644, Size: 10, Typeflag: tar.TypeReg}), "writing header")
+	_, err := tw.Write([]byte("short"))
+	checkErr(t, err, "writing contents")
+
+	// the trailer cannot be written after an incomplete entry
+	if err := closeTar(); err == nil {
+		t.Error("expected an error closing the archive")
+	}
+}
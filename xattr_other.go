@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package compressor
+
+// setXattrs does nothing, since extended attributes are only set on Linux and macOS.
+func setXattrs(path string, xattrs map[string]string) error {
+	return nil
+}
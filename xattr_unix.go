@@ -0,0 +1,26 @@
+//go:build linux || darwin
+
+package compressor
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// setXattrs sets the extended attributes of the file at path.
+// Attributes that the file system does not support, such as the ones of another platform, are skipped.
+func setXattrs(path string, xattrs map[string]string) error {
+	for name, value := range xattrs {
+		err := unix.Setxattr(path, name, []byte(value), 0)
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("setting extended attribute %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+//go:build linux || darwin
+
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractToDiskXattrs(t *testing.T) {
+	dest := t.TempDir()
+	if err := unix.Setxattr(dest, "user.probe", []byte("x"), 0); errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+		t.Skipf("file system does not support extended attributes: %v", err)
+	}
+
+	xattrs := map[string]string{"user.comment": "merged"}
+	if runtime.GOOS == "darwin" {
+		xattrs["com.apple.quarantine"] = "0081;63d8f1a2;Safari;"
+	} else {
+		// not a valid namespace on Linux, so it is skipped
+		xattrs["com.apple.FinderInfo"] = "finder info"
+	}
+	data := testAppleDoubleZip(t, xattrs)
+
+	err := ExtractToDisk(context.Background(), Zip{MergeAppleDouble: true}, bytes.NewReader(data), nil, dest, nil)
+	checkErr(t, err, "extracting")
+
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		for attr, want := range xattrs {
+			if runtime.GOOS != "darwin" && attr != "user.comment" {
+				continue
+			}
+			buf := make([]byte, 64)
+			n, err := unix.Getxattr(filepath.Join(dest, name), attr, buf)
+			checkErr(t, err, "getting %s of %s", attr, name)
+			if got := string(buf[:n]); got != want {
+				t.Errorf("%s: expected %s to be %q but got %q", name, attr, want, got)
+			}
+		}
+	}
+
+	if _, err := unix.Getxattr(filepath.Join(dest, "dir", "._c.txt"), "user.comment", nil); err == nil {
+		t.Error("expected dir/._c.txt to have no extended attributes")
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "__MACOSX")); err == nil {
+		t.Error("expected the __MACOSX directory not to be extracted")
+	}
+}
@@ -2,7 +2,10 @@ package compressor
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"strings"
 
 	"github.com/ulikunitz/xz"
@@ -10,11 +13,37 @@ import (
 )
 
 // Xz facilitates xz compression.
-type Xz struct{}
+type Xz struct {
+	// If true, a stream that matches the header is only considered a match
+	// if the beginning of it can actually be decoded. This reads more of the stream
+	// than the header, but avoids identifying truncated or corrupt streams as xz.
+	VerifyStream bool
+
+	// Compression preset from 1 (fastest) to 9 (best compression), like those of the xz utility,
+	// which sets the size of the dictionary. If 0, the default of the library is used.
+	Preset int
+
+	// If greater than 0, decompressing a stream that declares a larger dictionary fails with ErrDictTooLarge
+	// before the dictionary is allocated. If 0 or negative, the limit of the decoder, 64 MiB, applies,
+	// which is the dictionary size of the highest preset.
+	MaxDictSize int
+}
+
+// xzReader reports streams whose dictionary exceeds the limit with ErrDictTooLarge.
+type xzReader struct {
+	*xxz.Reader
+}
 
 // magic number at the beginning of xz files.
 var xzHeader = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
 
+// ErrDictTooLarge is returned when decompressing an xz or lzma stream that declares
+// a dictionary larger than the MaxDictSize of the format, which guards against exhausting memory.
+var ErrDictTooLarge = errors.New("dictionary too large")
+
+// xzPresetDictCaps are the dictionary sizes of the presets 1 to 9 of the xz utility.
+var xzPresetDictCaps = [...]int{1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
 func init() {
 	RegisterFormat(Xz{})
 }
@@ -38,19 +67,66 @@ func (x Xz) Match(filename string, stream io.Reader) (MatchResult, error) {
 	}
 
 	mr.ByStream = bytes.Equal(buf, xzHeader)
+	if mr.ByStream && x.VerifyStream {
+		mr.ByStream = xzDecodable(io.MultiReader(bytes.NewReader(buf), stream))
+	}
 
 	return mr, nil
 }
 
-func (Xz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
-	return xz.NewWriter(w)
+func (x Xz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	if x.Preset == 0 {
+		return xz.NewWriter(w)
+	}
+	if x.Preset < 1 || x.Preset > len(xzPresetDictCaps) {
+		return nil, fmt.Errorf("invalid preset: %d", x.Preset)
+	}
+
+	return xz.WriterConfig{DictCap: xzPresetDictCaps[x.Preset-1]}.NewWriter(w)
+}
+
+func (x Xz) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	// 0 makes the decoder use its own limit
+	var maxDictSize uint32
+	if x.MaxDictSize > 0 {
+		maxDictSize = math.MaxUint32
+		if uint64(x.MaxDictSize) < math.MaxUint32 {
+			maxDictSize = uint32(x.MaxDictSize)
+		}
+	}
+
+	// the decoder checks the dictionary size in the block headers before allocating the dictionary
+	xr, err := xxz.NewReader(r, maxDictSize)
+	if err != nil {
+		return nil, xzDictError(err)
+	}
+
+	return io.NopCloser(xzReader{xr}), err
+}
+
+func (xr xzReader) Read(p []byte) (int, error) {
+	n, err := xr.Reader.Read(p)
+	return n, xzDictError(err)
+}
+
+// xzDictError returns ErrDictTooLarge for the error of the decoder about exceeding the dictionary limit,
+// and err itself otherwise.
+func xzDictError(err error) error {
+	if err == xxz.ErrMemlimit {
+		return fmt.Errorf("%w: %v", ErrDictTooLarge, err)
+	}
+
+	return err
 }
 
-func (Xz) OpenReader(r io.Reader) (io.ReadCloser, error) {
+// xzDecodable reports whether the first byte of the xz stream r can be decoded,
+// which requires the stream header and the header of the first block to be valid.
+func xzDecodable(r io.Reader) bool {
 	xr, err := xxz.NewReader(r, 0)
 	if err != nil {
-		return nil, err
+		return false
 	}
 
-	return io.NopCloser(xr), err
+	_, err = io.ReadFull(xr, make([]byte, 1))
+	return err == nil || err == io.EOF
 }
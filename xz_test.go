@@ -0,0 +1,125 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestXzVerifyStream(t *testing.T) {
+	// incompressible contents, so that the stream is long enough to be cut in the middle
+	contents := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	buf := new(bytes.Buffer)
+	w, err := Xz{}.OpenWriter(buf)
+	checkErr(t, err, "opening writer")
+	_, err = w.Write(contents)
+	checkErr(t, err, "compressing")
+	checkErr(t, w.Close(), "closing writer")
+	valid := buf.Bytes()
+
+	for _, tc := range []struct {
+		name     string
+		stream   []byte
+		expected bool
+	}{
+		{name: "valid", stream: valid, expected: true},
+		{name: "valid prefix", stream: valid[:len(valid)/2], expected: true},
+		{name: "header only", stream: xzHeader, expected: false},
+		{name: "header with invalid payload", stream: append(append([]byte(nil), xzHeader...), bytes.Repeat([]byte{0xAB}, 64)...), expected: false},
+	} {
+		mr, err := Xz{}.Match("", bytes.NewReader(tc.stream))
+		checkErr(t, err, "%s: matching", tc.name)
+		if !mr.ByStream {
+			t.Errorf("%s: expected a match by header without VerifyStream", tc.name)
+		}
+
+		mr, err = Xz{VerifyStream: true}.Match("", bytes.NewReader(tc.stream))
+		checkErr(t, err, "%s: matching with VerifyStream", tc.name)
+		if mr.ByStream != tc.expected {
+			t.Errorf("%s: expected match to be %t but got %t", tc.name, tc.expected, mr.ByStream)
+		}
+	}
+
+}
+
+func TestXzPreset(t *testing.T) {
+	// a random block repeated at a distance that only the larger dictionary covers
+	block := make([]byte, 1<<20+1<<16)
+	rand.New(rand.NewSource(1)).Read(block)
+	contents := append(append([]byte{}, block...), block...)
+
+	sizes := make(map[int]int)
+	for _, preset := range []int{1, 9} {
+		compressed := compress(t, ".xz", contents, Xz{Preset: preset}.OpenWriter)
+		sizes[preset] = len(compressed)
+
+		r, err := Xz{}.OpenReader(bytes.NewReader(compressed))
+		checkErr(t, err, "preset %d: opening reader", preset)
+		decompressed, err := io.ReadAll(r)
+		checkErr(t, err, "preset %d: decompressing", preset)
+		if !bytes.Equal(decompressed, contents) {
+			t.Errorf("preset %d: round trip changed the contents", preset)
+		}
+	}
+	if sizes[9] >= sizes[1] {
+		t.Errorf("expected preset 9 to compress better than preset 1, but got %d and %d bytes", sizes[9], sizes[1])
+	}
+
+	if _, err := (Xz{Preset: 10}).OpenWriter(io.Discard); err == nil {
+		t.Errorf("expected an error for an invalid preset")
+	}
+}
+
+func TestXzMaxDictSize(t *testing.T) {
+	contents := []byte("the quick brown fox jumps over the lazy dog")
+	stream := compress(t, ".xz", contents, Xz{Preset: 1}.OpenWriter)
+
+	// declare a dictionary of 1.5 GiB in the LZMA2 filter of the first block header,
+	// which follows the 12 bytes of the stream header, and fix its checksum
+	crafted := append([]byte(nil), stream...)
+	headerLen := (int(crafted[12]) + 1) * 4
+	blockHeader := crafted[12 : 12+headerLen]
+	filter := bytes.Index(blockHeader, []byte{0x21, 0x01})
+	if filter < 0 {
+		t.Fatal("LZMA2 filter not found in block header")
+	}
+	blockHeader[filter+2] = 37
+	binary.LittleEndian.PutUint32(blockHeader[headerLen-4:], crc32.ChecksumIEEE(blockHeader[:headerLen-4]))
+
+	for _, tc := range []struct {
+		name   string
+		format Xz
+		stream []byte
+		tooBig bool
+	}{
+		{name: "default limit", format: Xz{}, stream: stream},
+		{name: "within limit", format: Xz{MaxDictSize: 1 << 20}, stream: stream},
+		{name: "above limit", format: Xz{MaxDictSize: 1 << 19}, stream: stream, tooBig: true},
+		{name: "crafted", format: Xz{}, stream: crafted, tooBig: true},
+		{name: "crafted negative limit", format: Xz{MaxDictSize: -1}, stream: crafted, tooBig: true},
+		{name: "crafted above limit", format: Xz{MaxDictSize: 1 << 30}, stream: crafted, tooBig: true},
+	} {
+		// the decoder reads the first block header when it is opened, so either may fail
+		var decompressed []byte
+		r, err := tc.format.OpenReader(bytes.NewReader(tc.stream))
+		if err == nil {
+			decompressed, err = io.ReadAll(r)
+		}
+		if tc.tooBig {
+			if !errors.Is(err, ErrDictTooLarge) {
+				t.Errorf("%s: expected ErrDictTooLarge but got %v", tc.name, err)
+			}
+			continue
+		}
+		checkErr(t, err, "%s: decompressing", tc.name)
+		if !bytes.Equal(decompressed, contents) {
+			t.Errorf("%s: round trip changed the contents", tc.name)
+		}
+	}
+}
@@ -3,14 +3,19 @@ package compressor
 import (
 	"archive/zip"
 	"bytes"
+	"compress/flate"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/fs"
-	"log"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
@@ -26,25 +31,130 @@ import (
 )
 
 type Zip struct {
-	// Only compress files which are not already in a compressed format.
+	// Only compress files which are not already in a compressed format,
+	// storing those whose extension is in compressedFormats instead.
 	SelectiveCompression bool
 
-	// Method or algorithm for compressing stored files.
+	// Method or algorithm for compressing stored files, used for all regular files
+	// unless SelectiveCompression or StoreOnly say otherwise.
+	// If 0 (zip.Store), files are compressed with zip.Deflate; use StoreOnly to store them.
 	Compression uint16
 
-	// If true, errors that occurred while reading or writing a file in the archive
-	// will be logged and the operation will continue for the remaining files.
+	// If true, all files are stored without compression, e.g. for speed,
+	// regardless of Compression.
+	StoreOnly bool
+
+	// What happens when reading or writing a file in the archive fails; see ErrorMode.
+	ErrorMode ErrorMode
+
+	// If true and ErrorMode is FailFast, the errors are handled as with ContinueCollect.
+	// Kept for compatibility; SetContinueOnError sets it.
 	ContinueOnError bool
 
+	// If set, it is called with the path of a directory when extraction starts skipping it,
+	// because handleFile returned fs.SkipDir, and again for every entry left out because of it.
+	// It is meant for diagnosing why files are missing.
+	OnSkip func(dir string)
+
 	// Encoding for files in zip archives whose names and comments are not UTF-8 encoded.
 	TextEncoding string
+
+	// If true, archives preceded by an executable stub (self-extracting archives)
+	// are matched and extracted. The signature is searched for in the first sfxSearchLimit bytes.
+	AllowSFX bool
+
+	// Password for entries encrypted with WinZip AES.
+	// If set when archiving, files are encrypted with AES-256; directories are not.
+	Password string
+
+	// If set, the contents of each regular file are passed through this function when archiving,
+	// and the reader of each regular entry is wrapped with it when extracting.
+	// The size of the transformed contents may differ, which is fine,
+	// since the final sizes are only written once the contents are.
+	ContentTransform func(name string, r io.Reader) (io.Reader, error)
+
+	// If set, it is called as the contents of files are written when archiving,
+	// or read when extracting, with the number of bytes processed so far in total.
+	// totalBytes is the sum of the sizes of all files, or -1 if it is not known in advance.
+	Progress func(file File, bytesProcessed, totalBytes int64)
+
+	// If true, no entries are written for directories, only for the files in them.
+	// Empty directories are lost, unless EmptyDirectorySentinel is set.
+	OmitDirectoryEntries bool
+
+	// If set along with OmitDirectoryEntries, an empty file of this name is written
+	// into each directory without other entries, so that the directory is preserved.
+	// Only Archive does this, since it knows all of the files in advance.
+	EmptyDirectorySentinel string
+
+	// If greater than 0, archiving a file whose path has more components than this fails,
+	// which protects extraction onto file systems that reject deeply nested paths.
+	MaxPathDepth int
+
+	// Comment of the archive written by Archive and ArchiveAsync. The comments of the files
+	// are taken from their Header if it is a zip.FileHeader, like the ones of extracted files, or a *zip.FileHeader.
+	// The comment of an archive being extracted can be read with ZipArchiveComment.
+	Comment string
+
+	// If true, the AppleDouble entries ("._name") that macOS writes for the extended attributes
+	// and resource forks of files, mostly into the __MACOSX directory, are not extracted as files;
+	// instead, the attributes they hold are set as the Xattrs of the files they belong to.
+	// The __MACOSX directory is left out altogether.
+	MergeAppleDouble bool
+
+	// If true, the contents of each extracted file that is not a directory are checked against the CRC-32
+	// in the header of the entry, so that corrupted entries fail extraction even if the handler does not read them,
+	// or not to the end: what the handler leaves unread is read when it closes the file, or once it returns.
+	// A mismatch is an error of the file, handled according to ErrorMode.
+	VerifyChecksums bool
 }
 
+// zipCommentKey is the context key of the comment of the archive being extracted.
+type zipCommentKey struct{}
+
+// zipDirectoryEndLen is the length of the end of central directory record without the comment.
+const zipDirectoryEndLen = 22
+
 type seekReaderAt interface {
 	io.ReaderAt
 	io.Seeker
 }
 
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// zipModeFileInfo overrides the mode of a zip entry.
+type zipModeFileInfo struct {
+	fs.FileInfo
+	mode fs.FileMode
+}
+
+// zipEntryCheck verifies the checksum of an extracted entry with the reader handed to the handler,
+// reading what the handler leaves unread once it is done, so that the entry is read only once.
+type zipEntryCheck struct {
+	z Zip
+	f *zip.File
+	r *zipVerifyingReader // the reader opened last, if any
+}
+
+// zipVerifyingReader reads the contents of an entry, checking them against its CRC-32 at the end.
+// It reads the rest of the contents when it is closed before, which checks them, too.
+type zipVerifyingReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	hash   hash.Hash32 // nil for AES entries, whose readers authenticate the contents themselves
+	want   uint32
+	done   bool // the end of the contents, or an error, was reached
+	closed bool
+	err    error
+}
+
+// pooledFlateWriter is a Deflate compressor that returns itself to flateWriterPool when it is closed.
+type pooledFlateWriter struct {
+	fw *flate.Writer
+}
+
 const (
 	// Additional compression methods not offered by archive/zip.
 	ZipMethodBzip2 = 12
@@ -53,46 +163,79 @@ const (
 	ZipMethodXz    = 95
 )
 
+// host systems of the creator version of entries, and the file types of unix modes in their external attributes
+const (
+	zipCreatorUnix   = 3
+	zipCreatorMacOSX = 19
+
+	unixTypeMask    = 0o170000
+	unixTypeRegular = 0o100000
+	unixTypeDir     = 0o040000
+	unixTypeSymlink = 0o120000
+)
+
+// IDs of the extra fields of entries
+const (
+	zipExtraZip64     = 0x0001
+	zipExtraNTFS      = 0x000a
+	zipExtraTimestamp = 0x5455
+)
+
+// zipNTFSEpoch is the number of seconds from the epoch of NTFS times, January 1, 1601, to the unix epoch.
+const zipNTFSEpoch = 11644473600
+
 var (
 	// headers of empty zip files might end with 0x05,0x06 or 0x06,0x06 instead of 0x03,0x04
 	zipHeader = []byte("PK\x03\x04")
 
+	zipDirectoryEndSignature = []byte("PK\x05\x06")
+
 	// compressedFormats is an incomplete set of file extensions with lowercase letters
 	// for formats that are normally already compressed.
 	// Compressing already compressed files is inefficient.
 	compressedFormats = map[string]struct{}{
-		".7z":   {},
-		".avi":  {},
-		".br":   {},
-		".bz2":  {},
-		".cab":  {},
-		".docx": {},
-		".gif":  {},
-		".gz":   {},
-		".jar":  {},
-		".jpeg": {},
-		".jpg":  {},
-		".lz":   {},
-		".lz4":  {},
-		".lzma": {},
-		".m4v":  {},
-		".mov":  {},
-		".mp3":  {},
-		".mp4":  {},
-		".mpeg": {},
-		".mpg":  {},
-		".png":  {},
-		".pptx": {},
-		".rar":  {},
-		".sz":   {},
-		".tbz2": {},
-		".tgz":  {},
-		".tsz":  {},
-		".txz":  {},
-		".xlsx": {},
-		".xz":   {},
-		".zip":  {},
-		".zipx": {},
+		".7z":    {},
+		".avi":   {},
+		".avif":  {},
+		".br":    {},
+		".bz2":   {},
+		".cab":   {},
+		".docx":  {},
+		".flac":  {},
+		".gif":   {},
+		".gz":    {},
+		".jar":   {},
+		".jpeg":  {},
+		".jpg":   {},
+		".lz":    {},
+		".lz4":   {},
+		".lzma":  {},
+		".m4a":   {},
+		".m4v":   {},
+		".mov":   {},
+		".mp3":   {},
+		".mp4":   {},
+		".mpeg":  {},
+		".mpg":   {},
+		".ogg":   {},
+		".opus":  {},
+		".png":   {},
+		".pptx":  {},
+		".rar":   {},
+		".sz":    {},
+		".tbz2":  {},
+		".tgz":   {},
+		".tsz":   {},
+		".txz":   {},
+		".webm":  {},
+		".webp":  {},
+		".woff":  {},
+		".woff2": {},
+		".xlsx":  {},
+		".xz":    {},
+		".zip":   {},
+		".zipx":  {},
+		".zst":   {},
 	}
 
 	encodings = map[string]encoding.Encoding{
@@ -136,43 +279,152 @@ var (
 	}
 )
 
-func init() {
-	RegisterFormat(Zip{})
-	zip.RegisterCompressor(ZipMethodBzip2, func(out io.Writer) (io.WriteCloser, error) {
+// zipCompressors are the compressors registered with archive/zip in addition to its built-in ones.
+var zipCompressors = map[uint16]zip.Compressor{
+	ZipMethodBzip2: func(out io.Writer) (io.WriteCloser, error) {
 		return bzip2.NewWriter(out, &bzip2.WriterConfig{ /*TODO: Level: z.CompressionLevel*/ })
-	})
-
-	zip.RegisterCompressor(ZipMethodZstd, func(out io.Writer) (io.WriteCloser, error) {
+	},
+	ZipMethodZstd: func(out io.Writer) (io.WriteCloser, error) {
 		return zstd.NewWriter(out)
-	})
-
-	zip.RegisterCompressor(ZipMethodXz, func(out io.Writer) (io.WriteCloser, error) {
+	},
+	ZipMethodXz: func(out io.Writer) (io.WriteCloser, error) {
 		return xz.NewWriter(out)
-	})
+	},
+	ZipMethodLzma: newZipLzmaWriter,
+}
+
+// flateWriterPool holds the Deflate compressors of newPooledFlateWriter.
+var flateWriterPool sync.Pool
 
-	zip.RegisterDecompressor(ZipMethodBzip2, func(r io.Reader) io.ReadCloser {
+// zipDecompressors are the decompressors registered with archive/zip in addition to its built-in ones.
+var zipDecompressors = map[uint16]zip.Decompressor{
+	ZipMethodBzip2: func(r io.Reader) io.ReadCloser {
 		bz2r, err := bzip2.NewReader(r, nil)
 		if err != nil {
 			return nil
 		}
 		return bz2r
-	})
-
-	zip.RegisterDecompressor(ZipMethodZstd, func(r io.Reader) io.ReadCloser {
+	},
+	ZipMethodZstd: func(r io.Reader) io.ReadCloser {
 		zr, err := zstd.NewReader(r)
 		if err != nil {
 			return nil
 		}
 		return zr.IOReadCloser()
-	})
-
-	zip.RegisterDecompressor(ZipMethodXz, func(r io.Reader) io.ReadCloser {
+	},
+	ZipMethodXz: func(r io.Reader) io.ReadCloser {
 		xr, err := xz.NewReader(r)
 		if err != nil {
 			return nil
 		}
 		return io.NopCloser(xr)
-	})
+	},
+	ZipMethodLzma: func(r io.Reader) io.ReadCloser {
+		lr, err := newZipLzmaReader(r)
+		if err != nil {
+			return nil
+		}
+		return lr
+	},
+}
+
+func init() {
+	RegisterFormat(Zip{})
+	for method, compressor := range zipCompressors {
+		zip.RegisterCompressor(method, compressor)
+	}
+
+	for method, decompressor := range zipDecompressors {
+		zip.RegisterDecompressor(method, decompressor)
+	}
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// zipCompressor returns the compressor for method, or nil if it is not supported.
+func zipCompressor(method uint16) zip.Compressor {
+	switch method {
+	case zip.Store:
+		return func(out io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{out}, nil
+		}
+	case zip.Deflate:
+		return newPooledFlateWriter
+	}
+
+	return zipCompressors[method]
+}
+
+// newPooledFlateWriter returns a Deflate compressor writing to out that is taken from flateWriterPool,
+// and returned to it when it is closed, like archive/zip does it, since a compressor takes about a megabyte
+// of memory, which adds up when archiving many small files.
+func newPooledFlateWriter(out io.Writer) (io.WriteCloser, error) {
+	fw, ok := flateWriterPool.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(out)
+	} else {
+		var err error
+		if fw, err = flate.NewWriter(out, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pooledFlateWriter{fw: fw}, nil
+}
+
+func (w *pooledFlateWriter) Write(p []byte) (int, error) {
+	if w.fw == nil {
+		return 0, errors.New("write to closed compressor")
+	}
+
+	return w.fw.Write(p)
+}
+
+func (w *pooledFlateWriter) Close() error {
+	if w.fw == nil {
+		return nil
+	}
+
+	err := w.fw.Close()
+	flateWriterPool.Put(w.fw)
+	w.fw = nil
+
+	return err
+}
+
+// zipDecompressor returns the decompressor for method, or nil if it is not supported.
+func zipDecompressor(method uint16) zip.Decompressor {
+	switch method {
+	case zip.Store:
+		return io.NopCloser
+	case zip.Deflate:
+		return flate.NewReader
+	}
+
+	return zipDecompressors[method]
+}
+
+// NewWebZip returns a Zip for archives whose files are to be served over HTTP, e.g. by http.FileServer.
+// Files in formats that are already compressed, such as images, audio, video and fonts, are stored,
+// which costs hardly any space, and keeps their contents as they are in the archive,
+// so that a byte range of a large media file, as requested by players seeking in it,
+// can be read at its offset without decompressing everything before it.
+// The other files, mostly text like HTML, CSS and JavaScript, are deflated to save space and bandwidth,
+// since they are usually requested in full.
+func NewWebZip() Zip {
+	return Zip{
+		SelectiveCompression: true,
+		Compression:          zip.Deflate,
+	}
+}
+
+func (z *Zip) SetContinueOnError(v bool) {
+	z.ContinueOnError = v
+	if !v {
+		z.ErrorMode = FailFast
+	}
 }
 
 func (z Zip) Name() string {
@@ -195,20 +447,103 @@ func (z Zip) Match(filename string, stream io.Reader) (MatchResult, error) {
 
 	mr.ByStream = bytes.Equal(buf, zipHeader)
 
+	// self-extracting archives have the signature after the executable stub
+	if !mr.ByStream && z.AllowSFX {
+		rest, err := readAtMost(stream, sfxSearchLimit-len(buf))
+		if err != nil {
+			return mr, err
+		}
+		mr.ByStream = bytes.Contains(append(buf, rest...), zipHeader)
+	}
+
+	// archives preceded by other data (e.g. a BOM or a stub) can still be found
+	// by their end of central directory record, if the stream can be read from the end
+	if !mr.ByStream {
+		if ra, ok := seekableStream(stream); ok {
+			mr.ByStream, err = hasZipDirectoryEnd(ra)
+			if err != nil {
+				return mr, err
+			}
+		}
+	}
+
 	return mr, nil
 }
 
+// seekableStream returns the stream, or the one underlying a rewindReader, if it is io.ReaderAt and io.Seeker.
+func seekableStream(stream io.Reader) (seekReaderAt, bool) {
+	if rr, ok := stream.(*rewindReader); ok {
+		stream = rr.Reader
+	}
+
+	sra, ok := stream.(seekReaderAt)
+	return sra, ok
+}
+
+// hasZipDirectoryEnd reports whether sra ends with an end of central directory record,
+// which is followed only by the archive comment.
+func hasZipDirectoryEnd(sra seekReaderAt) (bool, error) {
+	size, err := streamSizeBySeeking(sra)
+	if err != nil {
+		return false, err
+	}
+
+	tailSize := int64(zipDirectoryEndLen + 1<<16 - 1) // the record and the longest comment
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := sra.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return false, err
+	}
+
+	for i := len(tail) - zipDirectoryEndLen; i >= 0; i-- {
+		if !bytes.Equal(tail[i:i+4], zipDirectoryEndSignature) {
+			continue
+		}
+		commentLen := int(binary.LittleEndian.Uint16(tail[i+20:]))
+		if i+zipDirectoryEndLen+commentLen == len(tail) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Archive writes files to output as a zip archive.
+// If output is an io.WriteSeeker that can actually seek, such as a file, the CRC and sizes
+// of regular files are filled into their local headers by seeking back once their contents are written,
+// instead of being written in data descriptors, which some legacy tools do not handle.
 func (z Zip) Archive(ctx context.Context, output io.Writer, files []File) error {
 	zw := zip.NewWriter(output)
 	defer zw.Close()
 
+	if err := zw.SetComment(z.Comment); err != nil {
+		return fmt.Errorf("setting archive comment: %w", err)
+	}
+
+	ws := zipOutputSeeker(output)
+
+	if z.OmitDirectoryEntries {
+		files = omitDirectories(files, z.EmptyDirectorySentinel)
+	}
+
+	p := newProgress(z.Progress, totalSize(files))
+
+	mode := errorMode(z.ErrorMode, z.ContinueOnError)
+	var errs MultiError
 	for i, file := range files {
-		if err := z.archiveOneFile(ctx, zw, i, file); err != nil {
+		if err := z.archiveOneFile(ctx, zw, ws, i, file, p); err != nil {
+			if mode.continues() && ctx.Err() == nil { // context errors should always abort
+				golog.Info("[ERROR] %v", err)
+				errs.add(err)
+				continue
+			}
 			return err
 		}
 	}
 
-	return nil
+	return mode.result(&errs)
 }
 
 func (z Zip) ArchiveAsync(ctx context.Context, output io.Writer, files <-chan File) error {
@@ -217,10 +552,20 @@ func (z Zip) ArchiveAsync(ctx context.Context, output io.Writer, files <-chan Fi
 	zw := zip.NewWriter(output)
 	defer zw.Close()
 
+	if err := zw.SetComment(z.Comment); err != nil {
+		return fmt.Errorf("setting archive comment: %w", err)
+	}
+
+	ws := zipOutputSeeker(output)
+	p := newProgress(z.Progress, -1)
+
+	mode := errorMode(z.ErrorMode, z.ContinueOnError)
+	var errs MultiError
 	for file := range files {
-		if err := z.archiveOneFile(ctx, zw, i, file); err != nil {
-			if z.ContinueOnError && ctx.Err() == nil { // context errors should always abort
-				golog.Error("[ERROR] %v", err)
+		if err := z.archiveOneFile(ctx, zw, ws, i, file, p); err != nil {
+			if mode.continues() && ctx.Err() == nil { // context errors should always abort
+				golog.Info("[ERROR] %v", err)
+				errs.add(err)
 				continue
 			}
 			return err
@@ -228,19 +573,43 @@ func (z Zip) ArchiveAsync(ctx context.Context, output io.Writer, files <-chan Fi
 		i++
 	}
 
-	return nil
+	return mode.result(&errs)
 }
 
-func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file File) error {
+// archiveOneFile writes file to zw. If ws is not nil, it is the output of zw,
+// which is used to fill in the local header of regular files once their contents are written.
+func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, ws io.WriteSeeker, idx int, file File, p *progress) error {
 	if err := ctx.Err(); err != nil {
 		return err // honor context cancellation
 	}
 
+	if z.OmitDirectoryEntries && file.IsDir() {
+		return nil
+	}
+
+	if err := checkPathDepth(file.FileName, z.MaxPathDepth); err != nil {
+		return fmt.Errorf("file %d: %s: %w", idx, file.FileName, err)
+	}
+
+	if z.ContentTransform != nil && file.Mode().IsRegular() {
+		file = transformedFile(file, z.ContentTransform)
+	}
+
 	hdr, err := zip.FileInfoHeader(file)
 	if err != nil {
 		return fmt.Errorf("getting info for file %d: %s: %w", idx, file.Name(), err)
 	}
 	hdr.Name = file.FileName // complete path, since FileInfoHeader() only has base name
+	// FileInfoHeader() converts the time to UTC, but the DOS time is written in the time zone of the file
+	hdr.Modified = file.ModTime()
+	if fh := zipFileHeader(file); fh != nil {
+		hdr.Comment = fh.Comment
+		if !fh.Modified.IsZero() {
+			hdr.Modified = fh.Modified
+		}
+	}
+	// the DOS time and the extended timestamp that archive/zip writes are precise to seconds at best
+	hdr.Extra = append(hdr.Extra, zipNTFSExtra(hdr.Modified)...)
 
 	// customize header based on file properties
 	if file.IsDir() {
@@ -248,17 +617,47 @@ func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file F
 			hdr.Name += "/" // required
 		}
 		hdr.Method = zip.Store
-	} else if z.SelectiveCompression {
-		// only enable compression on compressable files
-		ext := strings.ToLower(path.Ext(hdr.Name))
-		if _, ok := compressedFormats[ext]; ok {
+	} else {
+		hdr.Method = z.Compression
+		if hdr.Method == zip.Store {
+			hdr.Method = zip.Deflate
+		}
+
+		if z.StoreOnly {
 			hdr.Method = zip.Store
-		} else {
-			hdr.Method = z.Compression
+		} else if z.SelectiveCompression {
+			// only enable compression on compressable files
+			ext := strings.ToLower(path.Ext(hdr.Name))
+			if _, ok := compressedFormats[ext]; ok {
+				hdr.Method = zip.Store
+			}
 		}
 	}
 
-	w, err := zw.CreateHeader(hdr)
+	if hdr.Method == ZipMethodLzma {
+		hdr.Flags |= 0x2 // the stream is terminated by an EOS marker
+	}
+
+	compressor := zipCompressor(hdr.Method)
+	if z.Password != "" && !file.IsDir() {
+		// the encryption is done by a compressor registered for this entry only,
+		// which wraps the one of the actual method, so that archive/zip still
+		// takes care of the checksum, sizes and data descriptor
+		compressor = newZipAESCompressor(z.Password, hdr.Method)
+		zw.RegisterCompressor(ZipMethodAES, compressor)
+		hdr.Extra = append(hdr.Extra, zipAESExtraField(hdr.Method)...)
+		hdr.Flags |= 0x1 // encrypted
+		hdr.Method = ZipMethodAES
+	}
+
+	var w io.Writer
+	var seekable *zipSeekableEntry
+	if ws != nil && file.Mode().IsRegular() && compressor != nil && file.Size() < zipSeekableMaxSize {
+		seekable, err = newZipSeekableEntry(zw, ws, hdr, compressor)
+		w = seekable
+	} else {
+		w, err = zw.CreateHeader(hdr)
+	}
 	if err != nil {
 		return fmt.Errorf("creating header for file %d: %s: %w", idx, file.Name(), err)
 	}
@@ -267,37 +666,202 @@ func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file F
 	if file.IsDir() {
 		return nil
 	}
-	if err := openAndCopyFile(file, w); err != nil {
+	// symbolic links store their target as the file body
+	if isSymlink(file) && file.LinkTarget != "" {
+		if _, err := io.WriteString(w, file.LinkTarget); err != nil {
+			return fmt.Errorf("writing link target of file %d: %s: %w", idx, file.Name(), err)
+		}
+		return nil
+	}
+	if err := openAndCopyFile(ctx, file, p.writer(w, file)); err != nil {
 		return fmt.Errorf("writing file %d: %s: %w", idx, file.Name(), err)
 	}
 
+	if seekable != nil {
+		if err := seekable.Close(); err != nil {
+			return fmt.Errorf("finishing file %d: %s: %w", idx, file.Name(), err)
+		}
+	}
+
 	return nil
 }
 
-// Extract extracts files from z by implementing the Extractor interface.
-// sourceArchive must be io.ReaderAt and io.Seeker, which, oddly enough,
-// are mismatched interfaces from io.Reader, which requires a method signature.
-// This signature is chosen for the interface because you can Read() from anything you can Read() or Seek().
-// Because of the nature of the zip archive format, if sourceArchive is not io.Seeker and io.ReaderAt, an error is returned.
-func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error {
-	sra, ok := sourceArchive.(seekReaderAt)
+// zipSeekableMaxSize is the size up to which files are written with their CRC and sizes
+// filled into the local header, which has no room for the 64-bit sizes of larger files.
+// It leaves headroom for contents that grow when compressing or transforming them.
+const zipSeekableMaxSize = 1 << 31
+
+// zipFileHeader returns the header of file if it is a zip.FileHeader or *zip.FileHeader, or nil.
+// Its comment and modification time, if set, are written instead of the ones from the file info.
+func zipFileHeader(file File) *zip.FileHeader {
+	switch fh := file.Header.(type) {
+	case zip.FileHeader:
+		return &fh
+	case *zip.FileHeader:
+		return fh
+	}
+
+	return nil
+}
+
+// zipOutputSeeker returns output as an io.WriteSeeker if it supports seeking, or nil.
+// Files such as os.Stdout implement io.Seeker, but fail to seek if they are pipes.
+func zipOutputSeeker(output io.Writer) io.WriteSeeker {
+	ws, ok := output.(io.WriteSeeker)
 	if !ok {
-		return fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekCurrent); err != nil {
+		return nil
 	}
 
-	size, err := streamSizeBySeeking(sra)
+	return ws
+}
+
+// zipSeekableEntry writes an entry without a data descriptor.
+// Its local header is written with a zero CRC and sizes,
+// which are filled in by seeking back to it once the contents are written.
+type zipSeekableEntry struct {
+	zw         *zip.Writer
+	ws         io.WriteSeeker
+	hdr        *zip.FileHeader
+	offset     int64 // of the local header in ws
+	compressor io.WriteCloser
+	compressed *countWriter
+	crc        hash.Hash32
+	size       uint64
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w     io.Writer
+	count uint64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += uint64(n)
+	return n, err
+}
+
+func newZipSeekableEntry(zw *zip.Writer, ws io.WriteSeeker, hdr *zip.FileHeader, compressor zip.Compressor) (*zipSeekableEntry, error) {
+	// the local header starts at the current position once zw's buffer is flushed
+	if err := zw.Flush(); err != nil {
+		return nil, err
+	}
+	offset, err := ws.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return fmt.Errorf("determining stream size: %w", err)
+		return nil, err
 	}
 
-	zr, err := zip.NewReader(sra, size)
+	hdr.Flags &^= 0x8 // no data descriptor
+	// unlike CreateHeader, CreateRaw does not derive the DOS time and extended timestamp from Modified
+	if !hdr.Modified.IsZero() {
+		hdr.ModifiedDate, hdr.ModifiedTime = zipDOSTime(hdr.Modified)
+		hdr.Extra = append(hdr.Extra, zipTimestampExtra(hdr.Modified)...)
+	}
+	raw, err := zw.CreateRaw(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := &countWriter{w: raw}
+	cw, err := compressor(compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zipSeekableEntry{
+		zw:         zw,
+		ws:         ws,
+		hdr:        hdr,
+		offset:     offset,
+		compressor: cw,
+		compressed: compressed,
+		crc:        crc32.NewIEEE(),
+	}, nil
+}
+
+func (e *zipSeekableEntry) Write(p []byte) (int, error) {
+	n, err := e.compressor.Write(p)
+	e.crc.Write(p[:n])
+	e.size += uint64(n)
+	return n, err
+}
+
+// Close finishes the compressed contents and fills in the local header.
+// The central directory, written by zw when it is closed, uses the same header.
+func (e *zipSeekableEntry) Close() error {
+	if err := e.compressor.Close(); err != nil {
+		return err
+	}
+
+	if e.size >= 1<<32-1 || e.compressed.count >= 1<<32-1 {
+		return fmt.Errorf("entry too large for its local header: %d bytes compressed to %d", e.size, e.compressed.count)
+	}
+
+	e.hdr.CRC32 = e.crc.Sum32()
+	e.hdr.UncompressedSize64 = e.size
+	e.hdr.CompressedSize64 = e.compressed.count
+	// older versions of archive/zip write the 32-bit sizes into the central directory
+	e.hdr.CompressedSize = uint32(e.compressed.count)
+	e.hdr.UncompressedSize = uint32(e.size)
+
+	if err := e.zw.Flush(); err != nil {
+		return err
+	}
+	end, err := e.ws.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return err
 	}
 
-	// important to initialize to non-nil, empty value due to how fileIsIncluded works
+	// the CRC and sizes follow the signature, version, flags, method, time and date
+	fields := make([]byte, 12)
+	binary.LittleEndian.PutUint32(fields, e.hdr.CRC32)
+	binary.LittleEndian.PutUint32(fields[4:], uint32(e.compressed.count))
+	binary.LittleEndian.PutUint32(fields[8:], uint32(e.size))
+	if _, err := e.ws.Seek(e.offset+14, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := e.ws.Write(fields); err != nil {
+		return err
+	}
+
+	_, err = e.ws.Seek(end, io.SeekStart)
+	return err
+}
+
+// Extract extracts files from z by implementing the Extractor interface.
+// sourceArchive should be io.ReaderAt and io.Seeker, which, oddly enough,
+// are mismatched interfaces from io.Reader, which requires a method signature.
+// This signature is chosen for the interface because you can Read() from anything you can Read() or Seek().
+// Because of the nature of the zip archive format, whose central directory is at the end,
+// if sourceArchive is not io.Seeker and io.ReaderAt, the entries are read one after the other instead.
+// Their local headers lack the unix modes, so that symbolic links are extracted as regular files;
+// entries encrypted with a password cannot be read, and MergeAppleDouble has no effect.
+func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler) error {
+	if _, ok := sourceArchive.(seekReaderAt); !ok {
+		return z.extractStream(ctx, sourceArchive, pathsInArchive, handleFile)
+	}
+
+	zr, err := z.openArchive(sourceArchive)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, zipCommentKey{}, zr.Comment)
+
 	skipDirs := skipList{}
+	included := newPathSet(pathsInArchive)
+
+	p := z.extractProgress(zr, pathsInArchive)
 
+	var sidecars map[string]*zip.File
+	if z.MergeAppleDouble {
+		sidecars = z.appleDoubleSidecars(zr)
+	}
+
+	mode := errorMode(z.ErrorMode, z.ContinueOnError)
+	var errs MultiError
 	for i, f := range zr.File {
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
@@ -305,23 +869,32 @@ func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 
 		// ensure filename and comment are UTF-8 encoded (issue #147 and PR #305)
 		z.decodeText(&f.FileHeader)
+		f.Name = normalizeSeparators(f.Name)
 
-		if !fileIsIncluded(pathsInArchive, f.Name) {
+		if !included.includes(f.Name) {
 			continue
 		}
 
-		if fileIsIncluded(skipDirs, f.Name) {
+		if skipDirs.skipped(f.Name, z.OnSkip) {
 			continue
 		}
 
-		file := File{
-			FileInfo: f.FileInfo(),
-			Header:   f.FileHeader,
-			FileName: f.Name,
-			Open:     func() (io.ReadCloser, error) { return f.Open() },
+		if z.MergeAppleDouble && isAppleDoubleEntry(f.Name, f, sidecars) {
+			continue
 		}
 
-		err := handleFile(ctx, file)
+		file, check := z.entryFile(ctx, f, p)
+
+		var err error
+		if sidecar := sidecars[strings.TrimSuffix(f.Name, "/")]; sidecar != nil {
+			err = z.mergeAppleDouble(&file, sidecar)
+		}
+		if err == nil {
+			err = handleFile(ctx, file)
+		}
+		if err == nil && check != nil {
+			err = check.verify(ctx)
+		}
 		if errors.Is(err, fs.SkipDir) {
 			// if a directory, skip this path; if a file, skip the folder path
 			dirPath := f.Name
@@ -329,18 +902,399 @@ func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, pathsInArchiv
 				dirPath = path.Dir(f.Name) + "/"
 			}
 			skipDirs.add(dirPath)
+			if z.OnSkip != nil {
+				z.OnSkip(dirPath)
+			}
+		} else if errors.Is(err, ErrStopWalk) {
+			break
 		} else if err != nil {
-			if z.ContinueOnError {
-				log.Printf("[ERROR] %s: %v", f.Name, err)
+			err = fmt.Errorf("handling file %d: %s: %w", i, f.Name, err)
+			if mode.continues() {
+				golog.Info("[ERROR] %v", err)
+				errs.add(err)
 				continue
 			}
-			return fmt.Errorf("handling file %d: %s: %w", i, f.Name, err)
+			return err
+		}
+	}
+
+	return mode.result(&errs)
+}
+
+// ExtractParallel is like Extract, but handles the files from the given number of goroutines,
+// or GOMAXPROCS goroutines if workers is not positive, which decompress the entries concurrently.
+// handleFile must therefore be safe for concurrent use; see SerializeHandler otherwise.
+// Since files are handled out of order, returning fs.SkipDir from handleFile has no effect.
+func (z Zip) ExtractParallel(ctx context.Context, sourceArchive io.Reader, pathsInArchive []string, handleFile FileHandler, workers int) error {
+	zr, err := z.openArchive(sourceArchive)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, zipCommentKey{}, zr.Comment)
+
+	p := z.extractProgress(zr, pathsInArchive)
+
+	var sidecars map[string]*zip.File
+	if z.MergeAppleDouble {
+		sidecars = z.appleDoubleSidecars(zr)
+	}
+
+	included := newPathSet(pathsInArchive)
+	files := make([]File, 0, len(zr.File))
+	checks := make([]*zipEntryCheck, 0, len(zr.File))
+	for _, f := range zr.File {
+		// ensure filename and comment are UTF-8 encoded (issue #147 and PR #305)
+		z.decodeText(&f.FileHeader)
+		f.Name = normalizeSeparators(f.Name)
+
+		if !included.includes(f.Name) {
+			continue
+		}
+		if z.MergeAppleDouble && isAppleDoubleEntry(f.Name, f, sidecars) {
+			continue
+		}
+		file, check := z.entryFile(ctx, f, p)
+		files = append(files, file)
+		checks = append(checks, check)
+	}
+
+	if z.MergeAppleDouble {
+		// the AppleDouble entries are read by the workers along with the files they belong to
+		handle := handleFile
+		handleFile = func(ctx context.Context, file File) error {
+			if sidecar := sidecars[strings.TrimSuffix(file.FileName, "/")]; sidecar != nil {
+				if err := z.mergeAppleDouble(&file, sidecar); err != nil {
+					return err
+				}
+			}
+			return handle(ctx, file)
+		}
+	}
+
+	var verify func(ctx context.Context, i int) error
+	if z.VerifyChecksums {
+		verify = func(ctx context.Context, i int) error {
+			if checks[i] == nil {
+				return nil
+			}
+			return checks[i].verify(ctx)
+		}
+	}
+
+	return handleFilesParallel(ctx, files, workers, handleFile, verify, errorMode(z.ErrorMode, z.ContinueOnError))
+}
+
+// openArchive returns a zip.Reader for sourceArchive, which must be io.ReaderAt and io.Seeker.
+func (z Zip) openArchive(sourceArchive io.Reader) (*zip.Reader, error) {
+	sra, ok := sourceArchive.(seekReaderAt)
+	if !ok {
+		return nil, fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
+	}
+
+	size, err := streamSizeBySeeking(sra)
+	if err != nil {
+		return nil, fmt.Errorf("determining stream size: %w", err)
+	}
+
+	return z.newReader(sra, size)
+}
+
+// extractProgress returns the progress for extracting the files in pathsInArchive from zr.
+func (z Zip) extractProgress(zr *zip.Reader, pathsInArchive []string) *progress {
+	if z.Progress == nil {
+		return nil
+	}
+
+	included := newPathSet(pathsInArchive)
+	var total int64
+	for _, f := range zr.File {
+		if included.includes(f.Name) && f.Mode().IsRegular() {
+			total += int64(f.UncompressedSize64)
+		}
+	}
+
+	return newProgress(z.Progress, total)
+}
+
+// entryFile returns the File to pass to the handler for the zip entry f.
+// Reading it fails once ctx is done. If VerifyChecksums is set, the returned check
+// verifies the contents of the entry once the handler returns, unless it is a directory.
+func (z Zip) entryFile(ctx context.Context, f *zip.File, p *progress) (File, *zipEntryCheck) {
+	setZipNTFSModTime(&f.FileHeader)
+
+	info := zipEntryInfo(&f.FileHeader)
+	var check *zipEntryCheck
+	if z.VerifyChecksums && !info.IsDir() {
+		check = &zipEntryCheck{z: z, f: f}
+	}
+
+	// the file info is taken from the central directory, whose sizes are reliable;
+	// local headers of streamed entries may have zero sizes followed by a data descriptor
+	file := File{
+		FileInfo: info,
+		Header:   f.FileHeader,
+		FileName: f.Name,
+		Open: func() (io.ReadCloser, error) {
+			rc, err := z.openFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if check != nil {
+				check.r = newZipVerifyingReader(ctx, f, rc)
+				rc = check.r
+			}
+			return contextReader{ctx, rc}, nil
+		},
+	}
+	file = p.file(file)
+	if z.ContentTransform != nil && file.Mode().IsRegular() {
+		file = transformedFile(file, z.ContentTransform)
+	}
+
+	return file, check
+}
+
+// zipEntryInfo returns the file info of the entry fh. archive/zip only takes the unix mode from the external attributes
+// of entries created on unix, and the DOS attributes otherwise, which lack the executable bit. Some tools on Windows,
+// like 7-Zip, also store the unix mode of files, and since it is more precise, it is preferred to the DOS attributes.
+func zipEntryInfo(fh *zip.FileHeader) fs.FileInfo {
+	info := fh.FileInfo()
+	if creator := fh.CreatorVersion >> 8; creator == zipCreatorUnix || creator == zipCreatorMacOSX {
+		return info
+	}
+
+	unixMode := fh.ExternalAttrs >> 16
+	var mode fs.FileMode
+	switch unixMode & unixTypeMask {
+	case unixTypeRegular:
+	case unixTypeDir:
+		mode = fs.ModeDir
+	case unixTypeSymlink:
+		mode = fs.ModeSymlink
+	default:
+		// without the file type, the upper bits are unlikely to be a unix mode
+		return info
+	}
+	mode |= fs.FileMode(unixMode & 0o777)
+	if unixMode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if unixMode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if unixMode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	if strings.HasSuffix(fh.Name, "/") {
+		mode |= fs.ModeDir
+	}
+
+	return zipModeFileInfo{info, mode}
+}
+
+// zipNTFSExtra returns the NTFS extra field holding t as the modification, access and creation time,
+// which is precise to 100 ns, or nothing if t is zero or before 1601.
+func zipNTFSExtra(t time.Time) []byte {
+	if t.IsZero() || t.Unix() < -zipNTFSEpoch {
+		return nil
+	}
+
+	le := binary.LittleEndian
+	ticks := uint64(t.Unix()+zipNTFSEpoch)*1e7 + uint64(t.Nanosecond()/100)
+	extra := make([]byte, 4+4+4+3*8)
+	le.PutUint16(extra, zipExtraNTFS)
+	le.PutUint16(extra[2:], uint16(len(extra)-4))
+	// after 4 reserved bytes, the attribute with the times
+	le.PutUint16(extra[8:], 1)
+	le.PutUint16(extra[10:], 3*8)
+	for i := 0; i < 3; i++ {
+		le.PutUint64(extra[12+8*i:], ticks)
+	}
+
+	return extra
+}
+
+// zipTimestampExtra returns the extended timestamp extra field holding t as the modification time,
+// like the one archive/zip writes when creating a header.
+func zipTimestampExtra(t time.Time) []byte {
+	extra := make([]byte, 4+1+4)
+	binary.LittleEndian.PutUint16(extra, zipExtraTimestamp)
+	binary.LittleEndian.PutUint16(extra[2:], 1+4)
+	extra[4] = 1 // the modification time is present
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+
+	return extra
+}
+
+// zipDOSTime returns the DOS date and time of t in its time zone, precise to 2 seconds.
+func zipDOSTime(t time.Time) (date, tm uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
+
+// setZipNTFSModTime sets the Modified time of fh to the one in its NTFS extra field, if there is one.
+// archive/zip prefers the extended timestamp, which comes after it in the entries written by Zip,
+// but is precise to seconds only. The time zone that archive/zip derived from the DOS time is kept.
+func setZipNTFSModTime(fh *zip.FileHeader) {
+	le := binary.LittleEndian
+	for extra := fh.Extra; len(extra) >= 4; {
+		tag, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			return
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		// after 4 reserved bytes, the attribute with the times, whose first one is the modification time
+		if tag != zipExtraNTFS || len(field) < 4+4+3*8 || le.Uint16(field[4:]) != 1 || le.Uint16(field[6:]) != 3*8 {
+			continue
 		}
+		ticks := le.Uint64(field[8:])
+		modified := time.Unix(int64(ticks/1e7)-zipNTFSEpoch, int64(ticks%1e7)*100)
+
+		loc := time.UTC
+		if !fh.Modified.IsZero() {
+			loc = fh.Modified.Location()
+		}
+		fh.Modified = modified.In(loc)
+		return
+	}
+}
+
+func (info zipModeFileInfo) Mode() fs.FileMode {
+	return info.mode
+}
+
+func (info zipModeFileInfo) IsDir() bool {
+	return info.mode.IsDir()
+}
+
+// openFile opens the zip entry f, decrypting it if it is encrypted with WinZip AES.
+func (z Zip) openFile(f *zip.File) (io.ReadCloser, error) {
+	if f.Method == ZipMethodAES {
+		return openAESFile(f, z.Password)
+	}
+
+	return f.Open()
+}
+
+// verify checks the contents of the entry, reading them unless the handler read them to the end already.
+func (c *zipEntryCheck) verify(ctx context.Context) error {
+	if c.r == nil {
+		rc, err := c.z.openFile(c.f)
+		if err != nil {
+			return err
+		}
+		c.r = newZipVerifyingReader(ctx, c.f, rc)
+	}
+
+	if err := c.r.Close(); err != nil {
+		return fmt.Errorf("verifying checksum: %w", err)
 	}
 
 	return nil
 }
 
+// newZipVerifyingReader returns a reader of rc, the contents of the entry f, that checks them against its CRC-32.
+func newZipVerifyingReader(ctx context.Context, f *zip.File, rc io.ReadCloser) *zipVerifyingReader {
+	r := &zipVerifyingReader{ReadCloser: rc, ctx: ctx, want: f.CRC32}
+	// archive/zip does not check a CRC of 0, which some writers store when they do not know it
+	if f.Method != ZipMethodAES {
+		r.hash = crc32.NewIEEE()
+	}
+
+	return r
+}
+
+func (r *zipVerifyingReader) Read(p []byte) (int, error) {
+	if r.done {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if err == io.EOF && r.hash != nil && r.hash.Sum32() != r.want {
+		err = zip.ErrChecksum
+	}
+	if err != nil {
+		r.done = true
+		if err != io.EOF {
+			r.err = err
+		}
+	}
+
+	return n, err
+}
+
+// Close reads what is left of the contents, which checks them, before closing the entry.
+// It returns the error of the check, which is also returned when it is closed again.
+func (r *zipVerifyingReader) Close() error {
+	if r.closed {
+		return r.err
+	}
+	r.closed = true
+
+	if !r.done {
+		// errors are recorded by Read
+		_, _ = io.Copy(io.Discard, contextReader{r.ctx, io.NopCloser(r)})
+		if !r.done && r.err == nil {
+			r.err = r.ctx.Err()
+		}
+	}
+	if err := r.ReadCloser.Close(); r.err == nil {
+		r.err = err
+	}
+
+	return r.err
+}
+
+// ZipArchiveComment returns the comment of the zip archive being extracted,
+// given the context passed to the FileHandler by Zip.Extract or Zip.ExtractParallel.
+func ZipArchiveComment(ctx context.Context) string {
+	comment, _ := ctx.Value(zipCommentKey{}).(string)
+	return comment
+}
+
+// ZipSummary returns the number of entries, the archive comment and the total compressed
+// and uncompressed sizes of the entries in the zip archive r of the given size.
+// Only the end of central directory records and the central directory are read,
+// so this is much cheaper than Extract for inspecting an archive.
+func ZipSummary(r io.ReaderAt, size int64) (entries int, comment string, totalCompressed, totalUncompressed int64, err error) {
+	// zip.NewReader reads the (Zip64) end of central directory and the central directory, but no entry bodies
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, "", 0, 0, err
+	}
+
+	for _, f := range zr.File {
+		totalCompressed += int64(f.CompressedSize64)
+		totalUncompressed += int64(f.UncompressedSize64)
+	}
+
+	return len(zr.File), zr.Comment, totalCompressed, totalUncompressed, nil
+}
+
+// newReader returns a zip.Reader reading from ra, which is assumed to have the given size.
+func (z Zip) newReader(ra io.ReaderAt, size int64) (*zip.Reader, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil && z.AllowSFX {
+		// archive/zip accounts for prepended data on its own,
+		// but not if the offsets in the stub were not adjusted, so retry from the signature
+		sr, sfxErr := sfxSection(ra, size, zipHeader)
+		if sfxErr == nil {
+			zr, err = zip.NewReader(sr, sr.Size())
+		}
+	}
+
+	return zr, err
+}
+
 // decodeText decodes name and comment fields from hdr to UTF-8.
 // Doesn't work if text is already encoded in UTF-8 or if z.TextEncoding is not specified.
 func (z Zip) decodeText(hdr *zip.FileHeader) {
@@ -0,0 +1,369 @@
+package compressor
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// ZipMethodAES is the method of entries encrypted with WinZip AES;
+	// the actual compression method is stored in the AES extra field.
+	ZipMethodAES = 99
+
+	zipAESExtraID    = 0x9901
+	zipAESIterations = 1000
+	zipAESMACSize    = 10
+	zipAESKeySize    = 32 // AES-256 is used for writing
+)
+
+var (
+	// ErrPasswordRequired is returned when opening an encrypted entry without a password.
+	ErrPasswordRequired = errors.New("password required")
+	// ErrWrongPassword is returned when the password does not match the one the entry was encrypted with.
+	ErrWrongPassword = errors.New("wrong password")
+
+	errZipAESAuthentication = errors.New("zip: authentication code mismatch")
+)
+
+// zipAESExtra is the contents of the WinZip AES extra field.
+type zipAESExtra struct {
+	version  uint16 // 1 for AE-1, which keeps the CRC, 2 for AE-2
+	strength byte   // 1, 2 or 3 for AES-128, AES-192 or AES-256
+	method   uint16 // the actual compression method
+}
+
+// zipAESReader decrypts and authenticates the data of an AES-encrypted entry.
+type zipAESReader struct {
+	data   io.Reader // the encrypted data
+	raw    io.Reader // the rest of the entry, holding the authentication code
+	stream cipher.Stream
+	mac    hash.Hash
+	done   bool
+}
+
+// zipAESWriter encrypts and authenticates the data of an entry.
+type zipAESWriter struct {
+	w      io.Writer
+	header []byte // the salt and password verification value, not written yet
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+}
+
+// zipAESEntryWriter compresses the contents of an entry with the actual method before encrypting them.
+type zipAESEntryWriter struct {
+	io.WriteCloser // the compressor
+	aes            *zipAESWriter
+}
+
+// zipAESCTR is AES in counter mode with the little-endian counter used by WinZip,
+// which differs from the big-endian one of cipher.NewCTR.
+type zipAESCTR struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keystream [aes.BlockSize]byte
+	pos       int
+}
+
+// zipAESAuthReader reads the decompressed contents of an AES-encrypted entry. Decompressors may stop
+// at the end of the compressed stream without reading on to the end of the encrypted data,
+// so it reads the rest itself once they are done, which checks the authentication code.
+type zipAESAuthReader struct {
+	io.ReadCloser // the decompressor
+	aes           *zipAESReader
+}
+
+// zipChecksumReader verifies the CRC-32 of the decrypted contents of AE-1 entries.
+type zipChecksumReader struct {
+	io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (r *zipAESReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if n > 0 {
+		r.mac.Write(p[:n])
+		r.stream.XORKeyStream(p[:n], p[:n])
+	}
+
+	if err == io.EOF && !r.done {
+		r.done = true
+		code := make([]byte, zipAESMACSize)
+		if _, err := io.ReadFull(r.raw, code); err != nil {
+			return n, fmt.Errorf("reading authentication code: %w", err)
+		}
+		if !hmac.Equal(code, r.mac.Sum(nil)[:zipAESMACSize]) {
+			return n, errZipAESAuthentication
+		}
+	}
+
+	return n, err
+}
+
+func (r *zipAESAuthReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, r.aes); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+func (w *zipAESWriter) Write(p []byte) (int, error) {
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	buf := w.buf[:len(p)]
+	w.stream.XORKeyStream(buf, p)
+	w.mac.Write(buf)
+
+	return w.w.Write(buf)
+}
+
+// Close writes the authentication code.
+func (w *zipAESWriter) Close() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	_, err := w.w.Write(w.mac.Sum(nil)[:zipAESMACSize])
+	return err
+}
+
+// writeHeader writes the salt and password verification value before the encrypted data.
+// This is deferred until the first write, since archive/zip creates the compressor,
+// and thus this writer, before it writes the local file header.
+func (w *zipAESWriter) writeHeader() error {
+	if w.header == nil {
+		return nil
+	}
+
+	_, err := w.w.Write(w.header)
+	w.header = nil
+	return err
+}
+
+func (w zipAESEntryWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	return w.aes.Close()
+}
+
+func (s *zipAESCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if s.pos == aes.BlockSize {
+			for j := range s.counter {
+				s.counter[j]++
+				if s.counter[j] != 0 {
+					break
+				}
+			}
+			s.block.Encrypt(s.keystream[:], s.counter[:])
+			s.pos = 0
+		}
+		dst[i] = src[i] ^ s.keystream[s.pos]
+		s.pos++
+	}
+}
+
+func (r *zipChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.hash.Sum32() != r.want {
+		return n, zip.ErrChecksum
+	}
+
+	return n, err
+}
+
+// openAESFile opens the WinZip AES-encrypted entry f using password.
+func openAESFile(f *zip.File, password string) (io.ReadCloser, error) {
+	extra, ok := parseZipAESExtra(f.Extra)
+	if !ok {
+		return nil, fmt.Errorf("%s: missing or malformed AES extra field", f.Name)
+	}
+
+	if password == "" {
+		return nil, fmt.Errorf("%s: %w", f.Name, ErrPasswordRequired)
+	}
+
+	decompressor := zipDecompressor(extra.method)
+	if decompressor == nil {
+		return nil, fmt.Errorf("%s: %w", f.Name, zip.ErrAlgorithm)
+	}
+
+	keyLen := 8 * (int(extra.strength) + 1)
+	saltLen := keyLen / 2
+	dataLen := int64(f.CompressedSize64) - int64(saltLen) - 2 - zipAESMACSize
+	if dataLen < 0 {
+		return nil, fmt.Errorf("%s: %w", f.Name, zip.ErrFormat)
+	}
+
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, saltLen+2)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, fmt.Errorf("%s: reading salt: %w", f.Name, err)
+	}
+
+	keys := pbkdf2SHA1([]byte(password), header[:saltLen], zipAESIterations, 2*keyLen+2)
+	if !bytes.Equal(keys[2*keyLen:], header[saltLen:]) {
+		return nil, fmt.Errorf("%s: %w", f.Name, ErrWrongPassword)
+	}
+
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	ar := &zipAESReader{
+		data:   io.LimitReader(raw, dataLen),
+		raw:    raw,
+		stream: &zipAESCTR{block: block, pos: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+	}
+	dc := decompressor(ar)
+	if dc == nil {
+		return nil, fmt.Errorf("%s: %w", f.Name, zip.ErrAlgorithm)
+	}
+	var rc io.ReadCloser = &zipAESAuthReader{ReadCloser: dc, aes: ar}
+
+	// AE-2 entries do not store the CRC, since it would leak information about the contents
+	if extra.version == 1 {
+		rc = &zipChecksumReader{ReadCloser: rc, hash: crc32.NewIEEE(), want: f.CRC32}
+	}
+
+	return rc, nil
+}
+
+// newZipAESCompressor returns a compressor that compresses the contents of an entry
+// with method and encrypts them with AES-256, using a key derived from password and a random salt.
+func newZipAESCompressor(password string, method uint16) zip.Compressor {
+	return func(out io.Writer) (io.WriteCloser, error) {
+		compressor := zipCompressor(method)
+		if compressor == nil {
+			return nil, zip.ErrAlgorithm
+		}
+
+		salt := make([]byte, zipAESKeySize/2)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("generating salt: %w", err)
+		}
+
+		keys := pbkdf2SHA1([]byte(password), salt, zipAESIterations, 2*zipAESKeySize+2)
+		block, err := aes.NewCipher(keys[:zipAESKeySize])
+		if err != nil {
+			return nil, err
+		}
+
+		aw := &zipAESWriter{
+			w:      out,
+			header: append(salt, keys[2*zipAESKeySize:]...),
+			stream: &zipAESCTR{block: block, pos: aes.BlockSize},
+			mac:    hmac.New(sha1.New, keys[zipAESKeySize:2*zipAESKeySize]),
+		}
+		cw, err := compressor(aw)
+		if err != nil {
+			return nil, err
+		}
+
+		return zipAESEntryWriter{WriteCloser: cw, aes: aw}, nil
+	}
+}
+
+// zipAESExtraField returns the WinZip AES extra field of an AES-256 entry compressed with method.
+// It is marked AE-1, since archive/zip always writes the CRC.
+func zipAESExtraField(method uint16) []byte {
+	field := make([]byte, 11)
+	binary.LittleEndian.PutUint16(field, zipAESExtraID)
+	binary.LittleEndian.PutUint16(field[2:], 7)
+	binary.LittleEndian.PutUint16(field[4:], 1)
+	copy(field[6:], "AE")
+	field[8] = zipAESKeySize/8 - 1
+	binary.LittleEndian.PutUint16(field[9:], method)
+
+	return field
+}
+
+// parseZipAESExtra finds the WinZip AES field in the extra fields of an entry.
+func parseZipAESExtra(extra []byte) (zipAESExtra, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+
+		if id == zipAESExtraID && size >= 7 {
+			field := zipAESExtra{
+				version:  binary.LittleEndian.Uint16(extra),
+				strength: extra[4],
+				method:   binary.LittleEndian.Uint16(extra[5:]),
+			}
+			if field.strength < 1 || field.strength > 3 {
+				break
+			}
+			return field, true
+		}
+
+		extra = extra[size:]
+	}
+
+	return zipAESExtra{}, false
+}
+
+// pbkdf2SHA1 derives a key of keyLen bytes from password and salt
+// as specified by PKCS #5 v2.0 (RFC 8018), using HMAC-SHA1 as the pseudorandom function.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
@@ -0,0 +1,182 @@
+package compressor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// zipMacOSXDir is the directory in which macOS puts the AppleDouble entries of the files of a zip archive.
+	zipMacOSXDir = "__MACOSX/"
+
+	appleDoubleMagic         = 0x00051607
+	appleDoubleHeaderLen     = 26
+	appleDoubleEntryLen      = 12
+	appleDoubleResourceFork  = 2
+	appleDoubleFinderInfo    = 9
+	appleDoubleFinderInfoLen = 32
+
+	// the extended attributes follow the Finder info in the same entry, as written by copyfile(3)
+	appleDoubleAttrMagic     = "ATTR"
+	appleDoubleAttrHeaderLen = 36
+	appleDoubleAttrEntryLen  = 11 // without the name
+)
+
+var errNotAppleDouble = errors.New("not an AppleDouble file")
+
+// appleDoubleSidecars returns the AppleDouble entries ("._name") of the files in zr,
+// by the names of the files they belong to without trailing slashes.
+// Entries in the __MACOSX directory always count as such; the ones next to their files
+// only if the files are in the archive, since they might be just files whose names start with "._".
+func (z Zip) appleDoubleSidecars(zr *zip.Reader) map[string]*zip.File {
+	names := make(map[string]bool, len(zr.File))
+	for _, f := range zr.File {
+		names[strings.TrimSuffix(z.decodedName(f), "/")] = true
+	}
+
+	sidecars := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		name := z.decodedName(f)
+		owner, ok := appleDoubleOwner(name)
+		if ok && (strings.HasPrefix(name, zipMacOSXDir) || names[owner]) {
+			sidecars[owner] = f
+		}
+	}
+
+	return sidecars
+}
+
+// decodedName returns the name of f as Extract sees it, leaving f unchanged.
+func (z Zip) decodedName(f *zip.File) string {
+	hdr := f.FileHeader
+	z.decodeText(&hdr)
+	return normalizeSeparators(hdr.Name)
+}
+
+// isAppleDoubleEntry reports whether the entry f, named name, is one that MergeAppleDouble leaves out:
+// the __MACOSX directory and its contents, and the AppleDouble entries in sidecars.
+func isAppleDoubleEntry(name string, f *zip.File, sidecars map[string]*zip.File) bool {
+	if strings.HasPrefix(name, zipMacOSXDir) {
+		return true
+	}
+
+	owner, ok := appleDoubleOwner(name)
+	return ok && sidecars[owner] == f
+}
+
+// appleDoubleOwner returns the name of the file that the AppleDouble entry name belongs to,
+// or false if name is not named like one.
+func appleDoubleOwner(name string) (string, bool) {
+	dir, base := path.Split(strings.TrimSuffix(name, "/"))
+	if !strings.HasPrefix(base, "._") || len(base) == 2 {
+		return "", false
+	}
+
+	return path.Join(strings.TrimPrefix(dir, zipMacOSXDir), base[2:]), true
+}
+
+// mergeAppleDouble sets the Xattrs of file from the AppleDouble entry sidecar.
+func (z Zip) mergeAppleDouble(file *File, sidecar *zip.File) error {
+	rc, err := z.openFile(sidecar)
+	if err != nil {
+		return fmt.Errorf("opening AppleDouble entry %s: %w", sidecar.Name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("reading AppleDouble entry %s: %w", sidecar.Name, err)
+	}
+
+	xattrs, err := parseAppleDouble(data)
+	if err != nil {
+		return fmt.Errorf("parsing AppleDouble entry %s: %w", sidecar.Name, err)
+	}
+	file.Xattrs = xattrs
+
+	return nil
+}
+
+// parseAppleDouble returns the extended attributes stored in the AppleDouble file data.
+// The resource fork and the Finder info, unless it is empty, are returned as the
+// com.apple.ResourceFork and com.apple.FinderInfo attributes, like macOS presents them.
+func parseAppleDouble(data []byte) (map[string]string, error) {
+	if len(data) < appleDoubleHeaderLen || binary.BigEndian.Uint32(data) != appleDoubleMagic {
+		return nil, errNotAppleDouble
+	}
+
+	xattrs := make(map[string]string)
+	numEntries := int(binary.BigEndian.Uint16(data[24:]))
+	for i := 0; i < numEntries; i++ {
+		pos := appleDoubleHeaderLen + i*appleDoubleEntryLen
+		if pos+appleDoubleEntryLen > len(data) {
+			return nil, fmt.Errorf("entry %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		id := binary.BigEndian.Uint32(data[pos:])
+		offset := int64(binary.BigEndian.Uint32(data[pos+4:]))
+		length := int64(binary.BigEndian.Uint32(data[pos+8:]))
+		if offset+length > int64(len(data)) {
+			return nil, fmt.Errorf("entry %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		entry := data[offset : offset+length]
+
+		switch id {
+		case appleDoubleResourceFork:
+			if len(entry) > 0 {
+				xattrs["com.apple.ResourceFork"] = string(entry)
+			}
+		case appleDoubleFinderInfo:
+			finderInfo := entry
+			if len(finderInfo) > appleDoubleFinderInfoLen {
+				finderInfo = finderInfo[:appleDoubleFinderInfoLen]
+			}
+			if len(bytes.Trim(finderInfo, "\x00")) > 0 {
+				xattrs["com.apple.FinderInfo"] = string(finderInfo)
+			}
+			if err := parseAppleDoubleAttrs(data, offset+appleDoubleFinderInfoLen, offset+length, xattrs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return xattrs, nil
+}
+
+// parseAppleDoubleAttrs adds the extended attributes whose header is at the 4-byte aligned offset
+// after start in data to xattrs. The header must end before end, which is the end of the Finder info entry.
+// It is not an error if there is no header.
+func parseAppleDoubleAttrs(data []byte, start, end int64, xattrs map[string]string) error {
+	pos := (start + 3) &^ 3
+	if pos+appleDoubleAttrHeaderLen > end || string(data[pos:pos+4]) != appleDoubleAttrMagic {
+		return nil
+	}
+
+	numAttrs := int(binary.BigEndian.Uint16(data[pos+34:]))
+	pos += appleDoubleAttrHeaderLen
+	for i := 0; i < numAttrs; i++ {
+		if pos+appleDoubleAttrEntryLen > end {
+			return fmt.Errorf("extended attribute %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		offset := int64(binary.BigEndian.Uint32(data[pos:]))
+		length := int64(binary.BigEndian.Uint32(data[pos+4:]))
+		nameLen := int64(data[pos+10])
+		namePos := pos + appleDoubleAttrEntryLen
+		if namePos+nameLen > end || offset+length > int64(len(data)) {
+			return fmt.Errorf("extended attribute %d: %w", i, io.ErrUnexpectedEOF)
+		}
+
+		// the length of the name includes its terminating NUL
+		name := strings.TrimRight(string(data[namePos:namePos+nameLen]), "\x00")
+		xattrs[name] = string(data[offset : offset+length])
+
+		pos = (namePos + nameLen + 3) &^ 3
+	}
+
+	return nil
+}
@@ -0,0 +1,387 @@
+package compressor
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pchchv/golog"
+)
+
+const (
+	zipLocalHeaderLen     = 30 // without the name and the extra field
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+	zipFlagUTF8           = 0x800
+)
+
+var (
+	zipCentralHeaderSignature  = []byte("PK\x01\x02")
+	zipDataDescriptorSignature = []byte("PK\x07\x08")
+	zip64DirectoryEndSignature = []byte("PK\x06\x06")
+)
+
+// zipStreamEntry reads the contents of an entry of a zip archive that is read sequentially.
+type zipStreamEntry struct {
+	hdr  *zip.FileHeader
+	raw  io.Reader                // the compressed contents
+	desc *zipDataDescriptorReader // raw, if the sizes and CRC follow the contents
+	rc   io.ReadCloser            // the decompressed contents, once opened
+	hash hash.Hash32
+}
+
+// zipDataDescriptorReader reads the compressed contents of an entry whose size is not known in advance,
+// up to the data descriptor that follows them, which it then skips. The data descriptor is recognized
+// by its signature and the compressed size in it, which must be the number of bytes read so far;
+// descriptors without the optional signature are not recognized.
+type zipDataDescriptorReader struct {
+	br    *bufio.Reader
+	zip64 bool // the sizes in the descriptor have 8 bytes
+	n     int64
+	crc   uint32 // from the descriptor, once it is read
+	done  bool
+}
+
+// extractStream is Extract for archives that are read sequentially from r, entry by entry,
+// without the central directory, which comes last. The entries are therefore described by their local headers,
+// which lack the external attributes, so that their modes are the defaults for their types, and symbolic links
+// are regular files. Entries encrypted with a password cannot be opened, and MergeAppleDouble is ignored.
+func (z Zip) extractStream(ctx context.Context, r io.Reader, pathsInArchive []string, handleFile FileHandler) error {
+	br := bufio.NewReader(r)
+
+	skipDirs := skipList{}
+	included := newPathSet(pathsInArchive)
+
+	var p *progress
+	if z.Progress != nil {
+		p = newProgress(z.Progress, -1)
+	}
+
+	mode := errorMode(z.ErrorMode, z.ContinueOnError)
+	var errs MultiError
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err // honor context cancellation
+		}
+
+		entry, err := readZipLocalHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading header of entry %d: %w", i, err)
+		}
+
+		// ensure filename and comment are UTF-8 encoded (issue #147 and PR #305)
+		z.decodeText(entry.hdr)
+		entry.hdr.Name = normalizeSeparators(entry.hdr.Name)
+		name := entry.hdr.Name
+
+		if included.includes(name) && !skipDirs.skipped(name, z.OnSkip) {
+			file := z.streamEntryFile(ctx, entry, p)
+			err = handleFile(ctx, file)
+			if err == nil && z.VerifyChecksums && !file.IsDir() {
+				err = entry.verify()
+			}
+			if errors.Is(err, fs.SkipDir) {
+				// if a directory, skip this path; if a file, skip the folder path
+				dirPath := name
+				if !file.IsDir() {
+					dirPath = path.Dir(name) + "/"
+				}
+				skipDirs.add(dirPath)
+				if z.OnSkip != nil {
+					z.OnSkip(dirPath)
+				}
+			} else if errors.Is(err, ErrStopWalk) {
+				break
+			} else if err != nil {
+				err = fmt.Errorf("handling file %d: %s: %w", i, name, err)
+				if !mode.continues() {
+					return err
+				}
+				golog.Info("[ERROR] %v", err)
+				errs.add(err)
+			}
+		}
+
+		// move on to the next header, whether or not the contents were read
+		if err := entry.close(); err != nil {
+			return fmt.Errorf("skipping contents of entry %d: %s: %w", i, name, err)
+		}
+	}
+
+	return mode.result(&errs)
+}
+
+// streamEntryFile returns the File to pass to the handler for entry.
+// Since the contents are read from the archive as it is streamed, the file can only be read once.
+func (z Zip) streamEntryFile(ctx context.Context, entry *zipStreamEntry, p *progress) File {
+	setZipNTFSModTime(entry.hdr)
+
+	file := File{
+		FileInfo: zipEntryInfo(entry.hdr),
+		Header:   *entry.hdr,
+		FileName: entry.hdr.Name,
+		Open: func() (io.ReadCloser, error) {
+			if err := entry.open(); err != nil {
+				return nil, err
+			}
+			return contextReader{ctx, io.NopCloser(entry)}, nil
+		},
+	}
+	file = p.file(file)
+	if z.ContentTransform != nil && file.Mode().IsRegular() {
+		file = transformedFile(file, z.ContentTransform)
+	}
+
+	return file
+}
+
+// readZipLocalHeader reads the local header of the next entry from br, returning io.EOF
+// if the entries are followed by the central directory or the end of the archive.
+func readZipLocalHeader(br *bufio.Reader) (*zipStreamEntry, error) {
+	sig, err := br.Peek(4)
+	if err == io.EOF && len(sig) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, zipCentralHeaderSignature),
+		bytes.Equal(sig, zipDirectoryEndSignature),
+		bytes.Equal(sig, zip64DirectoryEndSignature):
+		return nil, io.EOF
+	case !bytes.Equal(sig, zipHeader):
+		return nil, fmt.Errorf("%w: no local file header", zip.ErrFormat)
+	}
+
+	buf := make([]byte, zipLocalHeaderLen)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	hdr := &zip.FileHeader{
+		ReaderVersion:      le.Uint16(buf[4:]),
+		Flags:              le.Uint16(buf[6:]),
+		Method:             le.Uint16(buf[8:]),
+		ModifiedTime:       le.Uint16(buf[10:]),
+		ModifiedDate:       le.Uint16(buf[12:]),
+		CRC32:              le.Uint32(buf[14:]),
+		CompressedSize64:   uint64(le.Uint32(buf[18:])),
+		UncompressedSize64: uint64(le.Uint32(buf[22:])),
+	}
+
+	rest := make([]byte, int(le.Uint16(buf[26:]))+int(le.Uint16(buf[28:])))
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, err
+	}
+	nameLen := le.Uint16(buf[26:])
+	hdr.Name = string(rest[:nameLen])
+	hdr.Extra = rest[nameLen:]
+	// like archive/zip, names that are plain ASCII are UTF-8 regardless of the flag
+	hdr.NonUTF8 = !utf8.ValidString(hdr.Name) || hdr.Flags&zipFlagUTF8 == 0 && !isASCII(hdr.Name)
+
+	zip64 := parseZipLocalExtra(hdr)
+
+	entry := &zipStreamEntry{hdr: hdr, hash: crc32.NewIEEE()}
+	if hdr.Flags&zipFlagDataDescriptor != 0 {
+		entry.desc = &zipDataDescriptorReader{br: br, zip64: zip64}
+		entry.raw = entry.desc
+	} else {
+		entry.raw = io.LimitReader(br, int64(hdr.CompressedSize64))
+	}
+
+	return entry, nil
+}
+
+// parseZipLocalExtra sets the sizes of hdr from its Zip64 extra field and its modification time
+// from its extended timestamp, and reports whether there is a Zip64 extra field.
+func parseZipLocalExtra(hdr *zip.FileHeader) bool {
+	var zip64 bool
+	le := binary.LittleEndian
+	for extra := hdr.Extra; len(extra) >= 4; {
+		tag, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		switch tag {
+		case zipExtraZip64:
+			zip64 = true
+			// only the sizes that do not fit into the header are in the field, in this order
+			if hdr.UncompressedSize64 == 0xffffffff && len(field) >= 8 {
+				hdr.UncompressedSize64 = le.Uint64(field)
+				field = field[8:]
+			}
+			if hdr.CompressedSize64 == 0xffffffff && len(field) >= 8 {
+				hdr.CompressedSize64 = le.Uint64(field)
+			}
+		case zipExtraTimestamp:
+			if len(field) >= 5 && field[0]&1 != 0 {
+				hdr.Modified = time.Unix(int64(le.Uint32(field[1:])), 0).UTC()
+			}
+		}
+	}
+
+	return zip64
+}
+
+// open prepares the decompressor of the entry, which may only be done once.
+func (e *zipStreamEntry) open() error {
+	if e.rc != nil {
+		return fmt.Errorf("%s: contents were already read", e.hdr.Name)
+	}
+	if e.hdr.Flags&zipFlagEncrypted != 0 || e.hdr.Method == ZipMethodAES {
+		return fmt.Errorf("%s: encrypted entries cannot be read from a stream", e.hdr.Name)
+	}
+
+	decompressor := zipDecompressor(e.hdr.Method)
+	if decompressor == nil {
+		return fmt.Errorf("%s: %w", e.hdr.Name, zip.ErrAlgorithm)
+	}
+	e.rc = decompressor(e.raw)
+	if e.rc == nil {
+		return fmt.Errorf("%s: %w", e.hdr.Name, zip.ErrAlgorithm)
+	}
+
+	return nil
+}
+
+// verify reads what is left of the decompressed contents of the entry, which checks their CRC.
+// The contents of encrypted entries cannot be read, so they are not checked.
+func (e *zipStreamEntry) verify() error {
+	if e.hdr.Flags&zipFlagEncrypted != 0 || e.hdr.Method == ZipMethodAES {
+		return nil
+	}
+	if e.rc == nil {
+		if err := e.open(); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(io.Discard, e); err != nil {
+		return fmt.Errorf("verifying checksum: %w", err)
+	}
+
+	return nil
+}
+
+// Read reads the decompressed contents of the entry, checking their CRC at the end.
+func (e *zipStreamEntry) Read(p []byte) (int, error) {
+	n, err := e.rc.Read(p)
+	e.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	// the decompressor might stop before the data descriptor, which has the CRC
+	if _, err := io.Copy(io.Discard, e.raw); err != nil {
+		return n, err
+	}
+	want := e.hdr.CRC32
+	if e.desc != nil {
+		want = e.desc.crc
+	}
+	if e.hash.Sum32() != want {
+		return n, zip.ErrChecksum
+	}
+
+	return n, io.EOF
+}
+
+// close closes the decompressor of the entry, if it was opened, and skips what is left of its contents.
+func (e *zipStreamEntry) close() error {
+	if e.rc != nil {
+		e.rc.Close()
+	}
+
+	_, err := io.Copy(io.Discard, e.raw)
+	return err
+}
+
+func (r *zipDataDescriptorReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	// the signature, CRC and sizes, followed by the signature of the next header unless the archive ends
+	buf, err := r.br.Peek(4 + 4 + 16 + 4)
+	if len(buf) < 4+4+8 {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if n := r.descriptorLen(buf); n > 0 {
+		r.crc = binary.LittleEndian.Uint32(buf[4:])
+		r.done = true
+		if _, err := r.br.Discard(n); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	// pass on the contents up to where the next descriptor might start;
+	// the last bytes are held back in case they are the start of its signature
+	avail, _ := r.br.Peek(r.br.Buffered())
+	k := bytes.Index(avail[1:], zipDataDescriptorSignature) + 1
+	if k == 0 {
+		k = len(avail) - (len(zipDataDescriptorSignature) - 1)
+	}
+	if k > len(p) {
+		k = len(p)
+	}
+	n, err := io.ReadFull(r.br, p[:k])
+	r.n += int64(n)
+
+	return n, err
+}
+
+// descriptorLen returns the length of the data descriptor at the start of buf, or 0 if there is none.
+func (r *zipDataDescriptorReader) descriptorLen(buf []byte) int {
+	if !bytes.Equal(buf[:4], zipDataDescriptorSignature) {
+		return 0
+	}
+
+	le := binary.LittleEndian
+	n := 4 + 4 + 8
+	if r.zip64 || r.n >= 0xffffffff {
+		n = 4 + 4 + 16
+		if len(buf) < n || le.Uint64(buf[8:]) != uint64(r.n) {
+			return 0
+		}
+	} else if le.Uint32(buf[8:]) != uint32(r.n) {
+		return 0
+	}
+
+	// unless the archive ends, a header follows
+	if len(buf) >= n+2 && !bytes.Equal(buf[n:n+2], zipHeader[:2]) {
+		return 0
+	}
+
+	return n
+}
+
+// isASCII reports whether s consists of ASCII characters only.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
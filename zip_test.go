@@ -0,0 +1,1197 @@
+package compressor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// two entries, hello.txt and world.txt, stored with AES-256 (AE-2) and the password "golang"
+//
+//go:embed test/aes.zip
+var testAESZip []byte
+
+func TestZipSFX(t *testing.T) {
+	junk := bytes.Repeat([]byte("MZ stub "), 512)
+	sfx := append(junk, testZIP...)
+
+	// seekable streams are matched by the end of central directory record regardless
+	mr, err := Zip{}.Match("", io.MultiReader(bytes.NewReader(sfx)))
+	checkErr(t, err, "matching without AllowSFX")
+	if mr.ByStream {
+		t.Fatalf("expected no stream match without AllowSFX")
+	}
+
+	z := Zip{AllowSFX: true}
+	mr, err = z.Match("", bytes.NewReader(sfx))
+	checkErr(t, err, "matching with AllowSFX")
+	if !mr.ByStream {
+		t.Fatalf("expected stream match with AllowSFX")
+	}
+
+	var names []string
+	err = z.Extract(context.Background(), bytes.NewReader(sfx), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if _, err := io.ReadAll(rc); err != nil {
+			return err
+		}
+		names = append(names, f.FileName)
+		return nil
+	})
+	checkErr(t, err, "extracting sfx zip")
+	if len(names) != 1 || names[0] != "go.mod" {
+		t.Fatalf("expected [go.mod] but got %v", names)
+	}
+}
+
+func TestSetContinueOnError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"bad.txt", "good.txt"} {
+		content := []byte("content of " + name)
+		checksum := crc32.ChecksumIEEE(content)
+		if name == "bad.txt" {
+			checksum++ // corrupt the entry
+		}
+
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              checksum,
+			CompressedSize64:   uint64(len(content)),
+			UncompressedSize64: uint64(len(content)),
+		})
+		checkErr(t, err, "creating entry %s", name)
+		_, err = w.Write(content)
+		checkErr(t, err, "writing entry %s", name)
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	var format Format = new(Zip)
+	if !SetContinueOnError(format, true) {
+		t.Fatalf("expected *Zip to implement ErrorTolerant")
+	}
+	if SetContinueOnError(Zip{}, true) {
+		t.Fatalf("expected Zip value not to implement ErrorTolerant")
+	}
+
+	var extracted []string
+	err := format.(Extractor).Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if _, err := io.ReadAll(rc); err != nil {
+			return err
+		}
+		extracted = append(extracted, f.FileName)
+		return nil
+	})
+	if len(extracted) != 1 || extracted[0] != "good.txt" {
+		t.Fatalf("expected extraction to continue past the bad entry, got %v", extracted)
+	}
+	var me *MultiError
+	if !errors.As(err, &me) || len(me.Errors) != 1 || !errors.Is(err, zip.ErrChecksum) {
+		t.Fatalf("expected the error of the bad entry to be returned at the end, got %v", err)
+	}
+}
+
+func TestZipZeroSizeLocalHeader(t *testing.T) {
+	content := bytes.Repeat([]byte("streamed content "), 100)
+
+	// entries written by Create use data descriptors,
+	// so the sizes in the local header are zero
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	w, err := zw.Create("streamed.txt")
+	checkErr(t, err, "creating entry")
+	_, err = w.Write(content)
+	checkErr(t, err, "writing entry")
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	data := buf.Bytes()
+	if size := binary.LittleEndian.Uint32(data[22:26]); size != 0 {
+		t.Fatalf("expected zero uncompressed size in local header, got %d", size)
+	}
+
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(data), nil, func(ctx context.Context, f File) error {
+		if f.Size() != int64(len(content)) {
+			t.Errorf("expected size %d but got %d", len(content), f.Size())
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("expected full content (%d bytes), got %d bytes", len(content), len(b))
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+}
+
+func TestZipAES(t *testing.T) {
+	var contents []string
+	err := Zip{Password: "golang"}.Extract(context.Background(), bytes.NewReader(testAESZip), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		contents = append(contents, string(b))
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if len(contents) != 2 || contents[0] != "hello" || contents[1] != "world" {
+		t.Fatalf("expected decrypted contents but got %q", contents)
+	}
+
+	for _, tc := range []struct {
+		password string
+		expected error
+	}{
+		{"", ErrPasswordRequired},
+		{"gopher", ErrWrongPassword},
+	} {
+		err := Zip{Password: tc.password}.Extract(context.Background(), bytes.NewReader(testAESZip), nil, func(ctx context.Context, f File) error {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			return rc.Close()
+		})
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("password %q: expected %v but got %v", tc.password, tc.expected, err)
+		}
+	}
+
+	// a tampered byte of data fails authentication
+	tampered := append([]byte(nil), testAESZip...)
+	tampered[0x50]++
+	err = Zip{Password: "golang"}.Extract(context.Background(), bytes.NewReader(tampered), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		_, err = io.Copy(io.Discard, rc)
+		return err
+	})
+	if !errors.Is(err, errZipAESAuthentication) {
+		t.Fatalf("expected tampered data to fail authentication but got %v", err)
+	}
+}
+
+func TestZipAESRoundTrip(t *testing.T) {
+	contents := strings.Repeat("secret contents ", 100)
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte(contents), 0644)
+	checkErr(t, err, "writing file")
+	files, err := FilesFromDisk(nil, map[string]string{dir: "dir"})
+	checkErr(t, err, "getting files from disk")
+
+	buf := new(bytes.Buffer)
+	err = Zip{Password: "hunter2"}.Archive(context.Background(), buf, files)
+	checkErr(t, err, "archiving")
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading archive")
+	for _, f := range zr.File {
+		encrypted := f.Method == ZipMethodAES && f.Flags&0x1 != 0
+		if encrypted == f.FileInfo().IsDir() {
+			t.Errorf("%s: expected only files to be encrypted, but got method %d and flags %#x", f.Name, f.Method, f.Flags)
+		}
+	}
+
+	extract := func(password string) (string, error) {
+		var extracted string
+		err := Zip{Password: password}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+			if f.IsDir() {
+				return nil
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			b, err := io.ReadAll(rc)
+			extracted = string(b)
+			return err
+		})
+		return extracted, err
+	}
+
+	extracted, err := extract("hunter2")
+	checkErr(t, err, "extracting")
+	if extracted != contents {
+		t.Fatalf("expected round-tripped contents but got %q", extracted)
+	}
+
+	if _, err := extract("hunter3"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("expected %v but got %v", ErrWrongPassword, err)
+	}
+}
+
+func TestZipAESTamperedAuthenticationCode(t *testing.T) {
+	contents := strings.Repeat("secret contents ", 100)
+	for _, z := range []Zip{{Password: "hunter2", StoreOnly: true}, {Password: "hunter2"}} {
+		var buf bytes.Buffer
+		err := z.Archive(context.Background(), &buf, FilesFromBytes(time.Now(), map[string][]byte{"secret.txt": []byte(contents)}))
+		checkErr(t, err, "archiving")
+
+		// the authentication code is at the end of the data of the entry
+		archive := buf.Bytes()
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		checkErr(t, err, "reading archive")
+		offset, err := zr.File[0].DataOffset()
+		checkErr(t, err, "getting data offset")
+		archive[offset+int64(zr.File[0].CompressedSize64)-1] ^= 0xff
+
+		err = z.Extract(context.Background(), bytes.NewReader(archive), nil, func(ctx context.Context, f File) error {
+			data, err := f.ReadAll(1 << 20)
+			if err == nil && string(data) != contents {
+				t.Errorf("store only %t: expected the original contents but got %q", z.StoreOnly, data)
+			}
+			return err
+		})
+		if !errors.Is(err, errZipAESAuthentication) {
+			t.Errorf("store only %t: expected %v but got %v", z.StoreOnly, errZipAESAuthentication, err)
+		}
+	}
+}
+
+func TestZipSummary(t *testing.T) {
+	entries, comment, totalCompressed, totalUncompressed, err := ZipSummary(bytes.NewReader(nodirZIP), int64(len(nodirZIP)))
+	checkErr(t, err, "summarizing")
+	if entries != 7 {
+		t.Errorf("expected 7 entries but got %d", entries)
+	}
+	if comment != "" {
+		t.Errorf("expected no comment but got %q", comment)
+	}
+	if totalCompressed != 7928 || totalUncompressed != 20761 {
+		t.Errorf("expected 7928 compressed and 20761 uncompressed bytes but got %d and %d", totalCompressed, totalUncompressed)
+	}
+
+	_, _, _, _, err = ZipSummary(bytes.NewReader(nodirZIP[:len(nodirZIP)/2]), int64(len(nodirZIP)/2))
+	if err == nil {
+		t.Errorf("expected an error for a truncated archive")
+	}
+}
+
+func TestZipExtractParallel(t *testing.T) {
+	readAll := func(mu *sync.Mutex, contents map[string]string) FileHandler {
+		return func(ctx context.Context, f File) error {
+			if f.IsDir() {
+				return nil
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			contents[f.FileName] = string(b)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	var mu sync.Mutex
+	want := make(map[string]string)
+	err := Zip{}.Extract(context.Background(), bytes.NewReader(nodirZIP), nil, readAll(&mu, want))
+	checkErr(t, err, "extracting sequentially")
+
+	for _, workers := range []int{0, 1, 4} {
+		got := make(map[string]string)
+		err := Zip{}.ExtractParallel(context.Background(), bytes.NewReader(nodirZIP), nil, readAll(&mu, got), workers)
+		checkErr(t, err, "extracting in parallel")
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers=%d: expected %d files but got %d", workers, len(want), len(got))
+		}
+	}
+
+	errBoom := errors.New("boom")
+	err = Zip{}.ExtractParallel(context.Background(), bytes.NewReader(nodirZIP), nil, func(context.Context, File) error {
+		return errBoom
+	}, 4)
+	if !errors.Is(err, errBoom) {
+		t.Errorf("expected the handler's error but got %v", err)
+	}
+}
+
+func BenchmarkZipExtract(b *testing.B) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	content := bytes.Repeat([]byte("compressible content "), 1<<12)
+	for i := 0; i < 64; i++ {
+		w, err := zw.Create(fmt.Sprintf("file%d.txt", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	discard := func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(io.Discard, rc)
+		return err
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := (Zip{}).Extract(context.Background(), bytes.NewReader(archive), nil, discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := (Zip{}).ExtractParallel(context.Background(), bytes.NewReader(archive), nil, discard, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestZipCompressionMethod(t *testing.T) {
+	name, info := newTempTextFile(t, strings.Repeat("compressible ", 100))
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	var files []File
+	for _, fileName := range []string{"photo.jpg", "notes.txt"} {
+		files = append(files, File{
+			FileInfo: info,
+			FileName: fileName,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(name)
+			},
+		})
+	}
+
+	for i, tc := range []struct {
+		format Zip
+		want   map[string]uint16
+	}{
+		{
+			format: Zip{SelectiveCompression: true},
+			want:   map[string]uint16{"photo.jpg": zip.Store, "notes.txt": zip.Deflate},
+		},
+		{
+			format: Zip{SelectiveCompression: true, Compression: ZipMethodBzip2},
+			want:   map[string]uint16{"photo.jpg": zip.Store, "notes.txt": ZipMethodBzip2},
+		},
+		{
+			format: Zip{},
+			want:   map[string]uint16{"photo.jpg": zip.Deflate, "notes.txt": zip.Deflate},
+		},
+		{
+			format: Zip{Compression: ZipMethodZstd},
+			want:   map[string]uint16{"photo.jpg": ZipMethodZstd, "notes.txt": ZipMethodZstd},
+		},
+		{
+			format: Zip{StoreOnly: true},
+			want:   map[string]uint16{"photo.jpg": zip.Store, "notes.txt": zip.Store},
+		},
+		{
+			format: Zip{StoreOnly: true, SelectiveCompression: true, Compression: ZipMethodXz},
+			want:   map[string]uint16{"photo.jpg": zip.Store, "notes.txt": zip.Store},
+		},
+	} {
+		var buf bytes.Buffer
+		err := tc.format.Archive(context.Background(), &buf, files)
+		checkErr(t, err, "archiving")
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		checkErr(t, err, "reading archive")
+		for _, f := range zr.File {
+			if f.Method != tc.want[f.Name] {
+				t.Errorf("test %d: %s: expected method %d but got %d", i, f.Name, tc.want[f.Name], f.Method)
+			}
+		}
+	}
+}
+
+func TestZipMatchPrependedData(t *testing.T) {
+	junk := append([]byte("\xef\xbb\xbf"), bytes.Repeat([]byte{'x'}, 97)...)
+	prepended := append(junk, testZIP...)
+
+	mr, err := Zip{}.Match("", bytes.NewReader(prepended))
+	checkErr(t, err, "matching")
+	if !mr.ByStream {
+		t.Fatalf("expected stream match of zip with prepended data")
+	}
+
+	format, stream, err := Identify("", bytes.NewReader(prepended))
+	checkErr(t, err, "identifying")
+	if _, ok := format.(Zip); !ok {
+		t.Fatalf("expected zip but got %s", format.Name())
+	}
+
+	var names []string
+	err = format.(Extractor).Extract(context.Background(), stream, nil, func(ctx context.Context, f File) error {
+		names = append(names, f.FileName)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(names, []string{"go.mod"}) {
+		t.Errorf("expected [go.mod] but got %v", names)
+	}
+
+	// without a seekable stream, only the start of the stream can be checked
+	mr, err = Zip{}.Match("", io.MultiReader(bytes.NewReader(prepended)))
+	checkErr(t, err, "matching")
+	if mr.ByStream {
+		t.Errorf("expected no stream match without a seekable stream")
+	}
+}
+
+func TestZipExtractCancelDuringRead(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("large.bin")
+	checkErr(t, err, "creating entry")
+	_, err = w.Write(make([]byte, 64<<20))
+	checkErr(t, err, "writing entry")
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var read int64
+	err = Zip{}.Extract(ctx, bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		chunk := make([]byte, 32<<10)
+		n, err := rc.Read(chunk)
+		read += int64(n)
+		if err != nil {
+			return err
+		}
+		cancel()
+
+		n64, err := io.Copy(io.Discard, rc)
+		read += n64
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+	if read >= 64<<20 {
+		t.Errorf("expected the read to be interrupted, but the whole entry was read")
+	}
+}
+
+func TestZipSeekableOutputLocalHeaders(t *testing.T) {
+	name, info := newTempTextFile(t, strings.Repeat("compressible ", 1000))
+	t.Cleanup(func() {
+		os.Remove(name)
+	})
+
+	dir, err := os.Stat(t.TempDir())
+	checkErr(t, err, "getting directory info")
+
+	files := []File{
+		{
+			FileInfo: dir,
+			FileName: "dir",
+		},
+	}
+	for _, fileName := range []string{"dir/a.txt", "dir/b.jpg", "c.txt"} {
+		files = append(files, File{
+			FileInfo: info,
+			FileName: fileName,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(name)
+			},
+		})
+	}
+
+	for i, format := range []Zip{
+		{},
+		{SelectiveCompression: true, Compression: ZipMethodZstd},
+		{Password: "secret"},
+	} {
+		out, err := os.CreateTemp(t.TempDir(), "*.zip")
+		checkErr(t, err, "creating output file")
+		err = format.Archive(context.Background(), out, files)
+		checkErr(t, err, "archiving")
+		checkErr(t, out.Close(), "closing output file")
+
+		data, err := os.ReadFile(out.Name())
+		checkErr(t, err, "reading output file")
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		checkErr(t, err, "reading archive")
+
+		// the entries follow each other without data descriptors, so their local headers can be walked
+		var offset int
+		for _, f := range zr.File {
+			hdr := data[offset:]
+			if sig := binary.LittleEndian.Uint32(hdr); sig != 0x04034b50 {
+				t.Fatalf("test %d: %s: expected local header at offset %d but got signature %#x", i, f.Name, offset, sig)
+			}
+			if f.Flags&0x8 != 0 || binary.LittleEndian.Uint16(hdr[6:])&0x8 != 0 {
+				t.Errorf("test %d: %s: expected no data descriptor", i, f.Name)
+			}
+
+			crc := binary.LittleEndian.Uint32(hdr[14:])
+			compressed := binary.LittleEndian.Uint32(hdr[18:])
+			uncompressed := binary.LittleEndian.Uint32(hdr[22:])
+			if crc != f.CRC32 || uint64(compressed) != f.CompressedSize64 || uint64(uncompressed) != f.UncompressedSize64 {
+				t.Errorf("test %d: %s: expected CRC %#x and sizes %d/%d in local header but got %#x and %d/%d",
+					i, f.Name, f.CRC32, f.CompressedSize64, f.UncompressedSize64, crc, compressed, uncompressed)
+			}
+			if !f.FileInfo().IsDir() && uncompressed != uint32(info.Size()) {
+				t.Errorf("test %d: %s: expected uncompressed size %d but got %d", i, f.Name, info.Size(), uncompressed)
+			}
+
+			offset += 30 + int(binary.LittleEndian.Uint16(hdr[26:])) + int(binary.LittleEndian.Uint16(hdr[28:])) + int(compressed)
+		}
+
+		var extracted int
+		err = format.Extract(context.Background(), bytes.NewReader(data), nil, func(ctx context.Context, f File) error {
+			if f.IsDir() {
+				return nil
+			}
+			extracted++
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			_, err = io.Copy(io.Discard, rc)
+			return err
+		})
+		checkErr(t, err, "extracting")
+		if extracted != 3 {
+			t.Errorf("test %d: expected 3 files but got %d", i, extracted)
+		}
+	}
+}
+
+func TestZipComment(t *testing.T) {
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("file a"), "b.txt": []byte("file b")})
+	files[0].Header = zip.FileHeader{Comment: "comment of a"}
+
+	var buf bytes.Buffer
+	err := Zip{Comment: "comment of the archive"}.Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	_, comment, _, _, err := ZipSummary(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading summary")
+	if comment != "comment of the archive" {
+		t.Errorf("expected archive comment %q but got %q", "comment of the archive", comment)
+	}
+
+	want := map[string]string{"a.txt": "comment of a", "b.txt": ""}
+	var extracted int
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		extracted++
+		if comment := ZipArchiveComment(ctx); comment != "comment of the archive" {
+			t.Errorf("%s: expected archive comment %q but got %q", f.FileName, "comment of the archive", comment)
+		}
+		if comment := f.Header.(zip.FileHeader).Comment; comment != want[f.FileName] {
+			t.Errorf("%s: expected comment %q but got %q", f.FileName, want[f.FileName], comment)
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if extracted != len(want) {
+		t.Errorf("expected %d files but got %d", len(want), extracted)
+	}
+
+	err = Zip{Comment: strings.Repeat("x", 1<<16)}.Archive(context.Background(), io.Discard, files)
+	if err == nil {
+		t.Error("expected an error for a comment that is too long")
+	}
+}
+
+func TestZipHeaderModTime(t *testing.T) {
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	files := FilesFromBytes(time.Now(), map[string][]byte{"a.txt": []byte("file a"), "b.txt": []byte("file b")})
+	files[0].Header = &zip.FileHeader{Modified: modTime}
+
+	var buf bytes.Buffer
+	err := Zip{}.Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		if got := f.ModTime(); (f.FileName == "a.txt") != got.Equal(modTime) {
+			t.Errorf("%s: unexpected modification time %v", f.FileName, got)
+		}
+		if got := f.Header.(zip.FileHeader).Modified; f.FileName == "a.txt" && !got.Equal(modTime) {
+			t.Errorf("%s: expected modification time %v in the header but got %v", f.FileName, modTime, got)
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+}
+
+func TestZipModTimeRoundTrip(t *testing.T) {
+	modTime := time.Date(2021, 7, 8, 9, 10, 11, 123456700, time.FixedZone("IST", 5*3600+1800))
+	files := FilesFromBytes(modTime, map[string][]byte{"a.txt": []byte("file a")})
+
+	// the entries are written with CreateHeader to a buffer, but with CreateRaw to a file, which is seekable
+	var buf bytes.Buffer
+	checkErr(t, Zip{}.Archive(context.Background(), &buf, files), "archiving to buffer")
+	out, err := os.Create(filepath.Join(t.TempDir(), "a.zip"))
+	checkErr(t, err, "creating file")
+	defer out.Close()
+	checkErr(t, Zip{}.Archive(context.Background(), out, files), "archiving to file")
+	fileData, err := os.ReadFile(out.Name())
+	checkErr(t, err, "reading file")
+
+	for name, data := range map[string][]byte{"buffer": buf.Bytes(), "file": fileData} {
+		err := Zip{}.Extract(context.Background(), bytes.NewReader(data), nil, func(ctx context.Context, f File) error {
+			if diff := f.ModTime().Sub(modTime); diff < -time.Second || diff > time.Second {
+				t.Errorf("%s: expected modification time %v but got %v", name, modTime, f.ModTime())
+			}
+
+			modified := f.Header.(zip.FileHeader).Modified
+			if !modified.Equal(modTime) {
+				t.Errorf("%s: expected modification time %v in the header but got %v", name, modTime, modified)
+			}
+			if _, offset := modified.Zone(); offset != 5*3600+1800 {
+				t.Errorf("%s: expected the time zone offset of %v in the header but got %d", name, modTime, offset)
+			}
+			return nil
+		})
+		checkErr(t, err, "%s: extracting", name)
+	}
+}
+
+// appleDouble returns an AppleDouble file holding xattrs, laid out like the ones macOS writes:
+// the extended attributes follow the Finder info, and the resource fork is empty.
+func appleDouble(xattrs map[string]string) []byte {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	align := func(n int) int { return (n + 3) &^ 3 }
+
+	const finderInfoOffset = 50
+	attrHeader := align(finderInfoOffset + 32)
+	pos := attrHeader + 36
+	entries := make([]int, len(names))
+	for i, name := range names {
+		entries[i] = pos
+		pos = align(pos + 11 + len(name) + 1)
+	}
+	values := make([]int, len(names))
+	for i, name := range names {
+		values[i] = pos
+		pos += len(xattrs[name])
+	}
+
+	data := make([]byte, pos)
+	binary.BigEndian.PutUint32(data, 0x00051607)
+	binary.BigEndian.PutUint32(data[4:], 0x00020000)
+	binary.BigEndian.PutUint16(data[24:], 2)
+	binary.BigEndian.PutUint32(data[26:], 9)
+	binary.BigEndian.PutUint32(data[30:], finderInfoOffset)
+	binary.BigEndian.PutUint32(data[34:], uint32(pos-finderInfoOffset))
+	binary.BigEndian.PutUint32(data[38:], 2)
+	binary.BigEndian.PutUint32(data[42:], uint32(pos))
+
+	copy(data[attrHeader:], "ATTR")
+	binary.BigEndian.PutUint16(data[attrHeader+34:], uint16(len(names)))
+	for i, name := range names {
+		binary.BigEndian.PutUint32(data[entries[i]:], uint32(values[i]))
+		binary.BigEndian.PutUint32(data[entries[i]+4:], uint32(len(xattrs[name])))
+		data[entries[i]+10] = byte(len(name) + 1)
+		copy(data[entries[i]+11:], name)
+		copy(data[values[i]:], xattrs[name])
+	}
+
+	return data
+}
+
+// testAppleDoubleZip returns a zip archive like the ones created on macOS, with the extended attributes
+// of a.txt and dir/b.txt in AppleDouble entries in the __MACOSX directory, and dir/._c.txt,
+// which is just a file, since there is no dir/c.txt.
+func testAppleDoubleZip(t *testing.T, xattrs map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"a.txt", []byte("file a")},
+		{"dir/", nil},
+		{"dir/b.txt", []byte("file b")},
+		{"dir/._c.txt", []byte("file c")},
+		{"__MACOSX/", nil},
+		{"__MACOSX/._a.txt", appleDouble(xattrs)},
+		{"__MACOSX/dir/", nil},
+		{"__MACOSX/dir/._b.txt", appleDouble(xattrs)},
+	} {
+		w, err := zw.Create(entry.name)
+		checkErr(t, err, "creating %s", entry.name)
+		_, err = w.Write(entry.contents)
+		checkErr(t, err, "writing %s", entry.name)
+	}
+	checkErr(t, zw.Close(), "closing archive")
+
+	return buf.Bytes()
+}
+
+func TestZipMergeAppleDouble(t *testing.T) {
+	xattrs := map[string]string{
+		"com.apple.quarantine": "0081;63d8f1a2;Safari;",
+		"user.comment":         "merged",
+	}
+	data := testAppleDoubleZip(t, xattrs)
+
+	want := map[string]map[string]string{
+		"a.txt":       xattrs,
+		"dir/":        nil,
+		"dir/b.txt":   xattrs,
+		"dir/._c.txt": nil,
+	}
+
+	var mu sync.Mutex
+	check := func(ctx context.Context, f File) error {
+		mu.Lock()
+		defer mu.Unlock()
+		wantXattrs, ok := want[f.FileName]
+		if !ok {
+			t.Errorf("unexpected file %s", f.FileName)
+		} else if (len(wantXattrs) > 0 || len(f.Xattrs) > 0) && !reflect.DeepEqual(f.Xattrs, wantXattrs) {
+			t.Errorf("%s: expected extended attributes %v but got %v", f.FileName, wantXattrs, f.Xattrs)
+		}
+		delete(want, f.FileName)
+		return nil
+	}
+
+	z := Zip{MergeAppleDouble: true}
+	err := z.Extract(context.Background(), bytes.NewReader(data), nil, check)
+	checkErr(t, err, "extracting")
+	if len(want) > 0 {
+		t.Errorf("expected files %v to be extracted", want)
+	}
+
+	want = map[string]map[string]string{"a.txt": xattrs, "dir/": nil, "dir/b.txt": xattrs, "dir/._c.txt": nil}
+	err = z.ExtractParallel(context.Background(), bytes.NewReader(data), nil, check, 2)
+	checkErr(t, err, "extracting in parallel")
+	if len(want) > 0 {
+		t.Errorf("expected files %v to be extracted in parallel", want)
+	}
+
+	var extracted int
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(data), nil, func(ctx context.Context, f File) error {
+		extracted++
+		return nil
+	})
+	checkErr(t, err, "extracting without merging")
+	if extracted != 8 {
+		t.Errorf("expected all 8 entries without merging but got %d", extracted)
+	}
+}
+
+func TestNewWebZip(t *testing.T) {
+	media := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(media)
+	text := []byte(strings.Repeat("<p>the quick brown fox jumps over the lazy dog</p>\n", 100))
+
+	files := FilesFromBytes(time.Now(), map[string][]byte{
+		"index.html":       text,
+		"style.css":        text,
+		"video/intro.mp4":  media,
+		"images/photo.JPG": media,
+		"fonts/sans.woff2": media,
+	})
+
+	var buf bytes.Buffer
+	err := NewWebZip().Archive(context.Background(), &buf, files)
+	checkErr(t, err, "archiving")
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading archive")
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		wantStored := strings.Contains(f.Name, "/")
+		if stored := f.Method == zip.Store; stored != wantStored {
+			t.Errorf("%s: expected stored to be %t but the method is %d", f.Name, wantStored, f.Method)
+		}
+
+		// the contents of stored entries are in the archive as they are, so a range can be read at its offset
+		if wantStored {
+			offset, err := f.DataOffset()
+			checkErr(t, err, "%s: getting data offset", f.Name)
+			got := buf.Bytes()[offset+1000 : offset+1100]
+			if !bytes.Equal(got, media[1000:1100]) {
+				t.Errorf("%s: expected the contents at the data offset", f.Name)
+			}
+		}
+	}
+}
+
+func TestZipOnSkip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"keep.txt", "skip/", "skip/a.txt", "skip/sub/b.txt", "other/c.txt"} {
+		_, err := zw.Create(name)
+		checkErr(t, err, "creating %s", name)
+	}
+	checkErr(t, zw.Close(), "closing archive")
+
+	var skipped, handled []string
+	z := Zip{OnSkip: func(dir string) { skipped = append(skipped, dir) }}
+	err := z.Extract(context.Background(), bytes.NewReader(buf.Bytes()), nil, func(ctx context.Context, f File) error {
+		handled = append(handled, f.FileName)
+		if f.FileName == "skip/" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+
+	if want := []string{"keep.txt", "skip/", "other/c.txt"}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("expected the handled entries to be %v but got %v", want, handled)
+	}
+	// once when the directory is skipped, then once for each entry in it
+	if want := []string{"skip/", "skip/", "skip/"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("expected OnSkip to be called with %v but got %v", want, skipped)
+	}
+}
+
+func TestZipExecutableBit(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "run.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho hello\n"), 0o755)
+	checkErr(t, err, "writing script")
+	err = os.Chmod(script, 0o755) // regardless of the umask
+	checkErr(t, err, "setting mode")
+	files, err := FilesFromDisk(nil, map[string]string{script: "run.sh"})
+	checkErr(t, err, "getting files")
+
+	var archived bytes.Buffer
+	err = Zip{}.Archive(context.Background(), &archived, files)
+	checkErr(t, err, "archiving")
+
+	// like 7-Zip on Windows, which stores the unix mode along with the DOS attributes
+	var windows bytes.Buffer
+	zw := zip.NewWriter(&windows)
+	hdr := &zip.FileHeader{Name: "run.sh", Method: zip.Deflate, CreatorVersion: 0<<8 | 20}
+	hdr.ExternalAttrs = (0o100755 << 16) | 0x8000 | 0x20 // unix extension and archive bit
+	w, err := zw.CreateHeader(hdr)
+	checkErr(t, err, "creating entry")
+	io.WriteString(w, "#!/bin/sh\necho hello\n")
+	checkErr(t, zw.Close(), "closing archive")
+
+	for name, archive := range map[string][]byte{"created on unix": archived.Bytes(), "created on windows": windows.Bytes()} {
+		err := Zip{}.Extract(context.Background(), bytes.NewReader(archive), nil, func(ctx context.Context, f File) error {
+			if perm := f.Mode().Perm(); perm != 0o755 {
+				t.Errorf("%s: expected mode 0755 but got %o", name, perm)
+			}
+			return nil
+		})
+		checkErr(t, err, "%s: extracting", name)
+
+		if runtime.GOOS == "windows" {
+			continue // no executable bit on disk
+		}
+		dest := t.TempDir()
+		err = ExtractToDisk(context.Background(), Zip{}, bytes.NewReader(archive), nil, dest, nil)
+		checkErr(t, err, "%s: extracting to disk", name)
+		info, err := os.Stat(filepath.Join(dest, "run.sh"))
+		checkErr(t, err, "%s: stat", name)
+		if info.Mode().Perm()&0o111 != 0o111 {
+			t.Errorf("%s: expected the extracted script to be executable but its mode is %v", name, info.Mode())
+		}
+	}
+
+	// DOS attributes alone are used as before
+	var dos bytes.Buffer
+	zw = zip.NewWriter(&dos)
+	hdr = &zip.FileHeader{Name: "readonly.txt", CreatorVersion: 0<<8 | 20, ExternalAttrs: 0x01}
+	_, err = zw.CreateHeader(hdr)
+	checkErr(t, err, "creating entry")
+	checkErr(t, zw.Close(), "closing archive")
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(dos.Bytes()), nil, func(ctx context.Context, f File) error {
+		if perm := f.Mode().Perm(); perm != 0o444 {
+			t.Errorf("expected a read-only file to have mode 0444 but got %o", perm)
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting")
+}
+
+func TestZipExtractStream(t *testing.T) {
+	ctx := context.Background()
+
+	// the contents are larger than the buffer of the reader, and contain the signature of data descriptors
+	random := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	contents := map[string][]byte{
+		"dir/random.bin":     random,
+		"dir/signature.txt":  bytes.Repeat([]byte("PK\x07\x08 is the signature of data descriptors\n"), 200),
+		"empty.txt":          {},
+		"text/utf8-ëñ.txt":   []byte("hello"),
+		"text/repeating.txt": bytes.Repeat([]byte("a"), 1<<20),
+	}
+
+	extract := func(archive io.Reader) map[string]string {
+		got := make(map[string]string)
+		err := Zip{}.Extract(ctx, archive, nil, func(ctx context.Context, f File) error {
+			if f.IsDir() {
+				got[f.FileName] = "dir"
+				return nil
+			}
+			data, err := f.ReadAll(2 << 20)
+			got[f.FileName] = string(data)
+			return err
+		})
+		checkErr(t, err, "extracting")
+		return got
+	}
+
+	var archives [][]byte
+	for _, z := range []Zip{{}, {StoreOnly: true}, {Compression: ZipMethodZstd}} {
+		var buf bytes.Buffer
+		err := z.Archive(ctx, &buf, FilesFromBytes(time.Now(), contents))
+		checkErr(t, err, "archiving with method %d", z.Compression)
+		archives = append(archives, buf.Bytes())
+	}
+	archives = append(archives, testZIP, nodirZIP, unorderZip)
+
+	for i, archive := range archives {
+		want := extract(bytes.NewReader(archive))
+		// hide the io.ReaderAt and io.Seeker of the reader
+		got := extract(io.MultiReader(bytes.NewReader(archive)))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("archive %d: expected the same files as when seekable, but got %d files instead of %d", i, len(got), len(want))
+		}
+	}
+
+	// a corrupted entry fails its checksum
+	archive := append([]byte(nil), archives[1]...)
+	i := bytes.Index(archive, []byte("hello"))
+	archive[i] = 'j'
+	err := Zip{}.Extract(ctx, io.MultiReader(bytes.NewReader(archive)), nil, func(ctx context.Context, f File) error {
+		if f.IsDir() {
+			return nil
+		}
+		_, err := f.ReadAll(2 << 20)
+		return err
+	})
+	if !errors.Is(err, zip.ErrChecksum) {
+		t.Errorf("expected a checksum error but got %v", err)
+	}
+}
+
+func TestZipStopWalk(t *testing.T) {
+	ctx := context.Background()
+	files := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("file%d.txt", i)] = []byte("data")
+	}
+	var buf bytes.Buffer
+	checkErr(t, Zip{}.Archive(ctx, &buf, FilesFromBytes(time.Now(), files)), "archiving")
+
+	for _, tc := range []struct {
+		name    string
+		extract func(FileHandler) error
+		max     int
+	}{
+		{
+			name: "extract",
+			extract: func(h FileHandler) error {
+				return Zip{ContinueOnError: true}.Extract(ctx, bytes.NewReader(buf.Bytes()), nil, h)
+			},
+			max: 3,
+		},
+		{
+			name: "stream",
+			extract: func(h FileHandler) error {
+				return Zip{ContinueOnError: true}.Extract(ctx, io.MultiReader(bytes.NewReader(buf.Bytes())), nil, h)
+			},
+			max: 3,
+		},
+		{
+			name: "parallel",
+			extract: func(h FileHandler) error {
+				return Zip{}.ExtractParallel(ctx, bytes.NewReader(buf.Bytes()), nil, SerializeHandler(h), 2)
+			},
+			// the other worker may still be handling a file
+			max: 4,
+		},
+	} {
+		var handled int
+		err := tc.extract(func(ctx context.Context, f File) error {
+			handled++
+			if handled == 3 {
+				return ErrStopWalk
+			}
+			return nil
+		})
+		checkErr(t, err, "%s: extracting", tc.name)
+		if handled < 3 || handled > tc.max {
+			t.Errorf("%s: expected to stop after 3 files but handled %d", tc.name, handled)
+		}
+	}
+}
+
+func TestZipVerifyChecksums(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	err := Zip{StoreOnly: true}.Archive(ctx, &buf, FilesFromBytes(time.Now(), map[string][]byte{
+		"dir/corrupt.txt": []byte("hello corruption"),
+		"intact.txt":      []byte("all good"),
+	}))
+	checkErr(t, err, "archiving")
+	archive := buf.Bytes()
+	i := bytes.Index(archive, []byte("hello corruption"))
+	archive[i] = 'j'
+
+	// the handlers do not read the files, so the corruption goes unnoticed unless checksums are verified
+	skipContents := func(ctx context.Context, f File) error { return nil }
+	for _, tc := range []struct {
+		name    string
+		extract func(z Zip) error
+	}{
+		{
+			name: "extract",
+			extract: func(z Zip) error {
+				return z.Extract(ctx, bytes.NewReader(archive), nil, skipContents)
+			},
+		},
+		{
+			name: "stream",
+			extract: func(z Zip) error {
+				return z.Extract(ctx, io.MultiReader(bytes.NewReader(archive)), nil, skipContents)
+			},
+		},
+		{
+			name: "parallel",
+			extract: func(z Zip) error {
+				return z.ExtractParallel(ctx, bytes.NewReader(archive), nil, skipContents, 2)
+			},
+		},
+	} {
+		checkErr(t, tc.extract(Zip{}), "%s: extracting without verifying checksums", tc.name)
+
+		err := tc.extract(Zip{VerifyChecksums: true})
+		if !errors.Is(err, zip.ErrChecksum) || !strings.Contains(err.Error(), "dir/corrupt.txt") {
+			t.Errorf("%s: expected a checksum error for dir/corrupt.txt but got %v", tc.name, err)
+		}
+
+		var multi *MultiError
+		err = tc.extract(Zip{VerifyChecksums: true, ErrorMode: ContinueCollect})
+		if !errors.As(err, &multi) || len(multi.Errors) != 1 || !errors.Is(multi.Errors[0], zip.ErrChecksum) {
+			t.Errorf("%s: expected a single collected checksum error but got %v", tc.name, err)
+		}
+	}
+
+	// the error is reported even if the handler reads only part of the file and ignores the error of closing it
+	err = Zip{VerifyChecksums: true}.Extract(ctx, bytes.NewReader(archive), nil, func(ctx context.Context, f File) error {
+		if f.IsDir() {
+			return nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = rc.Read(make([]byte, 1))
+		rc.Close()
+		return err
+	})
+	if !errors.Is(err, zip.ErrChecksum) {
+		t.Errorf("partial read: expected a checksum error but got %v", err)
+	}
+
+	// files read by the handler are not read again to verify them
+	var large bytes.Buffer
+	err = Zip{}.Archive(ctx, &large, FilesFromBytes(time.Now(), map[string][]byte{
+		"random.bin": func() []byte {
+			b := make([]byte, 1<<20)
+			rand.New(rand.NewSource(1)).Read(b)
+			return b
+		}(),
+	}))
+	checkErr(t, err, "archiving large file")
+	bytesRead := func(z Zip) int64 {
+		counter := &countingReaderAt{ReaderAt: bytes.NewReader(large.Bytes())}
+		err := z.Extract(ctx, io.NewSectionReader(counter, 0, int64(large.Len())), nil, func(ctx context.Context, f File) error {
+			_, err := f.ReadAll(2 << 20)
+			return err
+		})
+		checkErr(t, err, "extracting large file")
+		return counter.n
+	}
+	if plain, verified := bytesRead(Zip{}), bytesRead(Zip{VerifyChecksums: true}); verified > plain+plain/10 {
+		t.Errorf("expected about %d bytes to be read when verifying checksums but got %d", plain, verified)
+	}
+
+	// intact archives pass, including encrypted ones whose contents are authenticated instead
+	for i, tc := range []struct {
+		z    Zip
+		data []byte
+	}{
+		{z: Zip{VerifyChecksums: true}, data: testZIP},
+		{z: Zip{VerifyChecksums: true}, data: nodirZIP},
+		{z: Zip{VerifyChecksums: true, Password: "golang"}, data: testAESZip},
+	} {
+		checkErr(t, tc.z.Extract(ctx, bytes.NewReader(tc.data), nil, skipContents), "verifying intact archive %d", i)
+	}
+}
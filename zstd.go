@@ -2,8 +2,11 @@ package compressor
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -12,6 +15,34 @@ import (
 type Zstd struct {
 	EncoderOptions []zstd.EOption
 	DecoderOptions []zstd.DOption
+
+	// Dictionaries for compressing and decompressing, which improve the ratio
+	// for many small, similar payloads. Either a dictionary in the zstd format
+	// (e.g. trained with zstd --train), or raw content, which is used as is with ID 0.
+	// The same dictionary must be used for decompressing as for compressing.
+	EncoderDict []byte
+	DecoderDict []byte
+
+	// encoders and decoders to reuse, see NewPooledZstd
+	pool *zstdPool
+}
+
+// zstdPool holds encoders and decoders created with the options of a Zstd, to be reset for each stream.
+type zstdPool struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+// pooledZstdEncoder is an encoder that returns itself to its pool when it is closed.
+type pooledZstdEncoder struct {
+	enc  *zstd.Encoder
+	pool *zstdPool
+}
+
+// pooledZstdDecoder is a decoder that returns itself to its pool when it is closed.
+type pooledZstdDecoder struct {
+	dec  *zstd.Decoder
+	pool *zstdPool
 }
 
 type errorCloser struct {
@@ -21,6 +52,20 @@ type errorCloser struct {
 // magic number at the beginning of Zstandard files
 var zstdHeader = []byte{0x28, 0xb5, 0x2f, 0xfd}
 
+// skippable frames, which carry application metadata, start with one of the magic numbers 0x184D2A50 to 0x184D2A5F,
+// stored in little endian like the size of their data that follows
+const (
+	zstdSkippableMagic     = 0x184d2a50
+	zstdSkippableMagicMask = 0xfffffff0
+	zstdSkippableHeaderLen = 8
+)
+
+// zstdSkippableMatchLimit is the most data of leading skippable frames that Match skips to find the first Zstandard frame.
+const zstdSkippableMatchLimit = 1 << 20
+
+// magic number at the beginning of Zstandard dictionaries
+var zstdDictHeader = []byte{0x37, 0xa4, 0x30, 0xec}
+
 func init() {
 	RegisterFormat(Zstd{})
 }
@@ -29,6 +74,8 @@ func (Zstd) Name() string {
 	return ".zst"
 }
 
+// Match matches the file header, which may be preceded by skippable frames,
+// as long as there is no more than zstdSkippableMatchLimit bytes of them.
 func (zs Zstd) Match(filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
 
@@ -37,28 +84,156 @@ func (zs Zstd) Match(filename string, stream io.Reader) (MatchResult, error) {
 		mr.ByName = true
 	}
 
-	// match file header
-	buf, err := readAtMost(stream, len(zstdHeader))
-	if err != nil {
-		return mr, err
+	// match file header, after any skippable frames
+	var skipped int64
+	for {
+		buf, err := readAtMost(stream, zstdSkippableHeaderLen)
+		if err != nil {
+			return mr, err
+		}
+		if len(buf) >= len(zstdHeader) && bytes.Equal(buf[:len(zstdHeader)], zstdHeader) {
+			mr.ByStream = true
+			return mr, nil
+		}
+		if len(buf) < zstdSkippableHeaderLen || binary.LittleEndian.Uint32(buf)&zstdSkippableMagicMask != zstdSkippableMagic {
+			return mr, nil
+		}
+
+		size := int64(binary.LittleEndian.Uint32(buf[4:]))
+		if skipped += size; skipped > zstdSkippableMatchLimit {
+			return mr, nil
+		}
+		if _, err := io.CopyN(io.Discard, stream, size); errors.Is(err, io.EOF) {
+			return mr, nil
+		} else if err != nil {
+			return mr, err
+		}
 	}
+}
 
-	mr.ByStream = bytes.Equal(buf, zstdHeader)
-
-	return mr, nil
+// NewPooledZstd returns zs set up to reuse its encoders and decoders, which are reset for each stream
+// instead of being created anew. Creating them allocates their buffers and windows,
+// which is expensive when compressing or decompressing many small streams.
+// The returned value, and copies of it, are safe for concurrent use, since each stream
+// gets an encoder or decoder of its own, which is returned for reuse when the stream is closed.
+// Streams that are not closed are not reused, and the options of the returned value must not be changed.
+func NewPooledZstd(zs Zstd) Zstd {
+	zs.pool = new(zstdPool)
+	return zs
 }
 
 func (zs Zstd) OpenWriter(w io.Writer) (io.WriteCloser, error) {
-	return zstd.NewWriter(w, zs.EncoderOptions...)
+	if zs.pool == nil {
+		return zstd.NewWriter(w, zs.encoderOptions()...)
+	}
+
+	enc, ok := zs.pool.encoders.Get().(*zstd.Encoder)
+	if ok {
+		enc.Reset(w)
+	} else {
+		var err error
+		if enc, err = zstd.NewWriter(w, zs.encoderOptions()...); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pooledZstdEncoder{enc: enc, pool: zs.pool}, nil
 }
 
 func (zs Zstd) OpenReader(r io.Reader) (io.ReadCloser, error) {
-	zr, err := zstd.NewReader(r, zs.DecoderOptions...)
-	if err != nil {
-		return nil, err
+	if zs.pool == nil {
+		zr, err := zstd.NewReader(r, zs.decoderOptions()...)
+		if err != nil {
+			return nil, err
+		}
+
+		return errorCloser{zr}, nil
+	}
+
+	dec, ok := zs.pool.decoders.Get().(*zstd.Decoder)
+	if ok {
+		if err := dec.Reset(r); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if dec, err = zstd.NewReader(r, zs.decoderOptions()...); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pooledZstdDecoder{dec: dec, pool: zs.pool}, nil
+}
+
+// encoderOptions returns the EncoderOptions along with the one for the EncoderDict.
+func (zs Zstd) encoderOptions() []zstd.EOption {
+	opts := zs.EncoderOptions
+	if zs.EncoderDict != nil {
+		dictOpt := zstd.WithEncoderDictRaw(0, zs.EncoderDict)
+		if bytes.HasPrefix(zs.EncoderDict, zstdDictHeader) {
+			dictOpt = zstd.WithEncoderDict(zs.EncoderDict)
+		}
+		// limit the capacity, so that the options of the caller are not appended to
+		opts = append(opts[:len(opts):len(opts)], dictOpt)
+	}
+
+	return opts
+}
+
+// decoderOptions returns the DecoderOptions along with the one for the DecoderDict.
+func (zs Zstd) decoderOptions() []zstd.DOption {
+	opts := zs.DecoderOptions
+	if zs.DecoderDict != nil {
+		dictOpt := zstd.WithDecoderDictRaw(0, zs.DecoderDict)
+		if bytes.HasPrefix(zs.DecoderDict, zstdDictHeader) {
+			dictOpt = zstd.WithDecoderDicts(zs.DecoderDict)
+		}
+		opts = append(opts[:len(opts):len(opts)], dictOpt)
+	}
+
+	return opts
+}
+
+func (pe *pooledZstdEncoder) Write(p []byte) (int, error) {
+	if pe.enc == nil {
+		return 0, errors.New("write to closed compressor")
+	}
+
+	return pe.enc.Write(p)
+}
+
+func (pe *pooledZstdEncoder) Close() error {
+	if pe.enc == nil {
+		return nil
+	}
+
+	err := pe.enc.Close()
+	pe.enc.Reset(nil) // do not keep the output alive in the pool
+	pe.pool.encoders.Put(pe.enc)
+	pe.enc = nil
+
+	return err
+}
+
+func (pd *pooledZstdDecoder) Read(p []byte) (int, error) {
+	if pd.dec == nil {
+		return 0, errors.New("read from closed decompressor")
 	}
 
-	return errorCloser{zr}, nil
+	return pd.dec.Read(p)
+}
+
+func (pd *pooledZstdDecoder) Close() error {
+	if pd.dec == nil {
+		return nil
+	}
+
+	// stops decoding in the background and releases the input
+	pd.dec.Reset(nil)
+	pd.pool.decoders.Put(pd.dec)
+	pd.dec = nil
+
+	return nil
 }
 
 func (ec errorCloser) Close() error {
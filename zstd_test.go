@@ -0,0 +1,186 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstdDict(t *testing.T) {
+	blob := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"type":"event","source":"sensor-%d","unit":"celsius","status":"ok","value":%d}`, i, i%7, i*3%50))
+	}
+
+	// raw content dictionary made of samples of the payloads
+	var dict []byte
+	for i := 1000; i < 1010; i++ {
+		dict = append(dict, blob(i)...)
+	}
+
+	// the default level makes little use of dictionaries for payloads this small
+	level := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBetterCompression)}
+
+	var plainSize, dictSize int
+	for i := 0; i < 20; i++ {
+		plain := compress(t, ".zst", blob(i), Zstd{EncoderOptions: level}.OpenWriter)
+		plainSize += len(plain)
+
+		withDict := compress(t, ".zst", blob(i), Zstd{EncoderOptions: level, EncoderDict: dict}.OpenWriter)
+		dictSize += len(withDict)
+
+		r, err := Zstd{DecoderDict: dict}.OpenReader(bytes.NewReader(withDict))
+		checkErr(t, err, "opening reader")
+		decompressed, err := io.ReadAll(r)
+		checkErr(t, err, "decompressing blob %d", i)
+		r.Close()
+		if !bytes.Equal(decompressed, blob(i)) {
+			t.Fatalf("expected blob %d to round-trip but got %q", i, decompressed)
+		}
+	}
+
+	if dictSize >= plainSize {
+		t.Fatalf("expected the output with a dictionary to be smaller, but got %d bytes with and %d without", dictSize, plainSize)
+	}
+}
+
+func TestZstdSkippableFrame(t *testing.T) {
+	content := []byte("this is text")
+	compressed := compress(t, ".zst", content, Zstd{}.OpenWriter)
+
+	skippable := func(magic uint32, data string) []byte {
+		frame := make([]byte, 8, 8+len(data))
+		binary.LittleEndian.PutUint32(frame, magic)
+		binary.LittleEndian.PutUint32(frame[4:], uint32(len(data)))
+		return append(frame, data...)
+	}
+	var stream []byte
+	stream = append(stream, skippable(0x184d2a50, `{"author":"gopher"}`)...)
+	stream = append(stream, skippable(0x184d2a5f, "more metadata")...)
+	stream = append(stream, compressed...)
+
+	format, r, err := Identify("", bytes.NewReader(stream))
+	checkErr(t, err, "identifying")
+	if _, ok := format.(Zstd); !ok {
+		t.Fatalf("expected Zstd but got %T", format)
+	}
+
+	rc, err := format.(Zstd).OpenReader(r)
+	checkErr(t, err, "opening reader")
+	defer rc.Close()
+	decompressed, err := io.ReadAll(rc)
+	checkErr(t, err, "decompressing")
+	if !bytes.Equal(decompressed, content) {
+		t.Errorf("expected %q but got %q", content, decompressed)
+	}
+
+	for name, stream := range map[string][]byte{
+		"skippable frame only":      skippable(0x184d2a50, "metadata"),
+		"truncated skippable frame": skippable(0x184d2a50, "metadata")[:10],
+		"followed by other data":    append(skippable(0x184d2a50, "metadata"), "PK\x03\x04"...),
+		"other magic":               append(skippable(0x184d2a60, "metadata"), compressed...),
+	} {
+		mr, err := Zstd{}.Match("", bytes.NewReader(stream))
+		checkErr(t, err, "%s: matching", name)
+		if mr.ByStream {
+			t.Errorf("%s: expected no match by stream", name)
+		}
+	}
+}
+
+func TestZstdPooled(t *testing.T) {
+	zs := NewPooledZstd(Zstd{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				payload := []byte(strings.Repeat(fmt.Sprintf("payload %d-%d ", g, i), i+1))
+
+				var buf bytes.Buffer
+				w, err := zs.OpenWriter(&buf)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				w.Write(payload)
+				if err := w.Close(); err != nil {
+					t.Error(err)
+					return
+				}
+
+				r, err := zs.OpenReader(&buf)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := io.ReadAll(r)
+				r.Close()
+				if err != nil || !bytes.Equal(got, payload) {
+					t.Errorf("payload %d-%d: expected it to round-trip but got %q (%v)", g, i, got, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// closed streams are not usable anymore, while their encoder and decoder are reused
+	w, err := zs.OpenWriter(io.Discard)
+	checkErr(t, err, "opening writer")
+	checkErr(t, w.Close(), "closing writer")
+	if _, err := w.Write([]byte("late")); err == nil {
+		t.Error("expected an error writing to a closed writer")
+	}
+}
+
+func BenchmarkZstdSmallPayloads(b *testing.B) {
+	payloads := make([][]byte, 1000)
+	for i := range payloads {
+		payloads[i] = []byte(fmt.Sprintf(`{"id":%d,"type":"event","status":"ok","value":%d}`, i, i*7%100))
+	}
+
+	for _, bc := range []struct {
+		name string
+		zs   Zstd
+	}{
+		{name: "fresh", zs: Zstd{}},
+		{name: "pooled", zs: NewPooledZstd(Zstd{})},
+	} {
+		zs := bc.zs
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				for _, payload := range payloads {
+					buf.Reset()
+					w, err := zs.OpenWriter(&buf)
+					if err != nil {
+						b.Fatal(err)
+					}
+					w.Write(payload)
+					if err := w.Close(); err != nil {
+						b.Fatal(err)
+					}
+
+					r, err := zs.OpenReader(&buf)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(io.Discard, r); err != nil {
+						b.Fatal(err)
+					}
+					r.Close()
+				}
+			}
+		})
+	}
+}